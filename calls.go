@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/david-biro/rtpdump/rtp"
+	"github.com/david-biro/rtpdump/srtp"
+	"github.com/urfave/cli"
+)
+
+var callsCmd = func(c *cli.Context) error {
+	loadKeyFile(c)
+
+	inputFiles := captureFiles(c)
+
+	if len(inputFiles) == 0 {
+		cli.ShowCommandHelp(c, "calls")
+		return cli.NewExitError("wrong usage for calls", 1)
+	}
+
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
+
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+	}
+
+	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
+
+	rtpReader.KeepPackets(false)
+	rtpStreams := rtpReader.GetStreams()
+
+	if len(rtpStreams) <= 0 {
+		fmt.Println("No streams found")
+		return nil
+	}
+
+	calls := rtp.GroupCalls(rtpStreams)
+	for i, call := range calls {
+		fmt.Printf("%d: %s\n", i+1, call)
+		for j, s := range call.Streams {
+			format := "pt " + strconv.Itoa(s.PayloadType)
+			if s.Format != nil {
+				format = s.Format.String()
+			}
+			fmt.Printf("   %s %d: 0x%08X   %s   packets:%d lost:%d (%.2f%%) mean jitter:%.2fms max jitter:%.2fms max delta:%.2fms\n",
+				call.Direction(s),
+				call.StreamIndexes[j],
+				s.Ssrc,
+				format,
+				s.TotalPackets,
+				s.LostPackets,
+				s.LostPercent(),
+				s.MeanJitter,
+				s.MaxJitter,
+				s.MaxDelta.Seconds()*1000,
+			)
+		}
+	}
+	fmt.Printf("total: %d calls, %d streams\n", len(calls), len(rtpStreams))
+	return nil
+}
+
+// callStreamIndexes reads the capture to find indexes of streams in the call with given index,
+// SRTP state is reset so the capture can be read again
+func callStreamIndexes(c *cli.Context, inputFiles []string, callIndex int) ([]int, error) {
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
+	if err != nil {
+		return nil, cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+	}
+	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return nil, err
+	}
+
+	rtpReader.KeepPackets(false)
+	calls := rtp.GroupCalls(rtpReader.GetStreams())
+	srtp.ResetContexts()
+	if callIndex < 1 || callIndex > len(calls) {
+		return nil, cli.NewExitError("call with specified index doesn't exist", 1)
+	}
+	return calls[callIndex-1].StreamIndexes, nil
+}
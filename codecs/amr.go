@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 
 	"github.com/david-biro/rtpdump/log"
 	"github.com/david-biro/rtpdump/rtp"
@@ -12,13 +14,33 @@ import (
 
 const AMR_NB_MAGIC string = "#!AMR\n"
 const AMR_WB_MAGIC string = "#!AMR-WB\n"
+const AMR_NB_MC_MAGIC string = "#!AMR_MC1.0\n"
+const AMR_WB_MC_MAGIC string = "#!AMR-WB_MC1.0\n"
 
 var AMR_NB_FRAME_SIZE []int = []int{12, 13, 15, 17, 19, 20, 26, 31, 5, 0, 0, 0, 0, 0, 0, 0}
 var AMR_WB_FRAME_SIZE []int = []int{17, 23, 32, 36, 40, 46, 50, 58, 60, 5, 5, 0, 0, 0, 0, 0}
 
+// speech bits of each frame type, frame sizes above are these rounded up to octets
+var AMR_NB_FRAME_BITS []int = []int{95, 103, 118, 134, 148, 159, 204, 244, 39, 0, 0, 0, 0, 0, 0, 0}
+var AMR_WB_FRAME_BITS []int = []int{132, 177, 253, 285, 317, 365, 397, 461, 477, 40, 0, 0, 0, 0, 0, 0}
+
+// class A bits of each frame type, protected by payload CRC (3GPP TS 26.101, TS 26.201)
+var AMR_NB_CLASS_A_BITS []int = []int{42, 49, 55, 58, 61, 75, 65, 81, 39, 0, 0, 0, 0, 0, 0, 0}
+var AMR_WB_CLASS_A_BITS []int = []int{54, 64, 72, 72, 72, 72, 72, 72, 72, 40, 0, 0, 0, 0, 0, 0}
+
 const AMR_NB_SAMPLE_RATE = 8000
 const AMR_WB_SAMPLE_RATE = 16000
 
+// channels of a multi-channel session at most, RFC 4867 section 4.1
+const AMR_MAX_CHANNELS = 6
+
+// amrFrame is a speech frame of a payload, data is octet-aligned as in storage format
+type amrFrame struct {
+	frameType int
+	quality   bool
+	data      []byte
+}
+
 type Amr struct {
 	started       bool
 	configured    bool
@@ -28,11 +50,21 @@ type Amr struct {
 	sampleRateSet bool
 	timestamp     uint32
 
+	// RFC 4867 payload options, all of them require octet-aligned mode
+	channels      int
+	interleaving  bool
+	crc           bool
+	robustSorting bool
+
+	// frame-blocks of the current interleaving group by timestamp
+	interleaved map[uint32][]amrFrame
+	crcErrors   int
+
 	lastSeq uint16
 }
 
 func NewAmr() Codec {
-	return &Amr{started: false, configured: false, timestamp: 0}
+	return &Amr{started: false, configured: false, timestamp: 0, channels: 1}
 }
 
 func (amr *Amr) Init() {
@@ -45,6 +77,8 @@ func (amr *Amr) Reset() {
 	amr.sampleRate = 0
 	amr.timestamp = 0
 	amr.lastSeq = 0
+	amr.interleaved = nil
+	amr.crcErrors = 0
 }
 
 func (amr *Amr) isWideBand() bool {
@@ -52,14 +86,21 @@ func (amr *Amr) isWideBand() bool {
 }
 
 func (amr Amr) GetFormatMagic() ([]byte, error) {
-	switch amr.sampleRate {
-	case AMR_WB_SAMPLE_RATE:
+	var magic string
+	switch {
+	case amr.sampleRate == AMR_WB_SAMPLE_RATE && amr.channels > 1:
+		magic = AMR_WB_MC_MAGIC
+	case amr.sampleRate == AMR_NB_SAMPLE_RATE && amr.channels > 1:
+		magic = AMR_NB_MC_MAGIC
+	case amr.sampleRate == AMR_WB_SAMPLE_RATE:
 		return []byte(AMR_WB_MAGIC), nil
-	case AMR_NB_SAMPLE_RATE:
+	case amr.sampleRate == AMR_NB_SAMPLE_RATE:
 		return []byte(AMR_NB_MAGIC), nil
 	default:
 		return nil, amr.invalidState()
 	}
+	// multi-channel magic is followed by 28 reserved bits and the number of channels, RFC 4867 section 5.2
+	return append([]byte(magic), 0, 0, 0, byte(amr.channels)), nil
 }
 
 func (amr *Amr) invalidState() error {
@@ -86,6 +127,24 @@ func (amr *Amr) SetOptions(options map[string]string) error {
 		amr.sampleRate, amr.sampleRateSet = AMR_WB_SAMPLE_RATE, true
 	}
 
+	amr.channels = 1
+	if v, ok := options["channels"]; ok {
+		channels, err := strconv.Atoi(v)
+		if err != nil || channels < 1 || channels > AMR_MAX_CHANNELS {
+			return fmt.Errorf("invalid number of channels '%s'", v)
+		}
+		amr.channels = channels
+	}
+	amr.interleaving = options["interleaving"] == "1"
+	amr.crc = options["crc"] == "1"
+	amr.robustSorting = options["robust-sorting"] == "1"
+	if amr.interleaving || amr.crc || amr.robustSorting {
+		if amr.alignmentSet && !amr.octetAligned {
+			return errors.New("interleaving, crc and robust-sorting require octet-aligned mode")
+		}
+		amr.octetAligned, amr.alignmentSet = true, true
+	}
+
 	amr.configured = true
 	return nil
 }
@@ -107,21 +166,40 @@ func (amr *Amr) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error
 		}
 	}
 
-	result = append(result, amr.handleMissingSamples(packet.Timestamp)...)
+	if len(packet.Payload) == 4 { // RFC 2833 RTP Event has a length of 4 bytes
+		printRTPEvent(packet.Payload)
+		return nil, nil
+	}
 
-	var speechFrame []byte
+	var frames []amrFrame
+	var ill, ilp int
 	if amr.octetAligned {
-		speechFrame, err = amr.handleOaMode(packet.Timestamp, packet.Payload)
+		frames, ill, ilp, _, err = amr.handleOaMode(packet.Payload)
 	} else {
-		speechFrame, err = amr.handleBeMode(packet.Timestamp, packet.Payload)
+		frames, _, err = amr.handleBeMode(packet.Payload)
 	}
-
 	if err != nil {
 		return nil, err
 	}
+	return amr.writeFrameBlocks(packet.Timestamp, frames, ill, ilp), nil
+}
 
-	result = append(result, speechFrame...)
-	return result, nil
+//Flush returns frames of an incomplete interleaving group
+func (amr *Amr) Flush() []byte {
+	return amr.writeInterleaved()
+}
+
+// AMR payload modes in the order they are tried in, octet-aligned payloads have a few bits less
+// likely to match by chance
+var amrModes = []struct {
+	octetAligned bool
+	sampleRate   int
+	description  string
+}{
+	{true, AMR_NB_SAMPLE_RATE, "AMR-NB octet-aligned"},
+	{true, AMR_WB_SAMPLE_RATE, "AMR-WB octet-aligned"},
+	{false, AMR_NB_SAMPLE_RATE, "AMR-NB bandwidth-efficient"},
+	{false, AMR_WB_SAMPLE_RATE, "AMR-WB bandwidth-efficient"},
 }
 
 func (amr *Amr) detectParameters(packet *rtp.RtpPacket) error {
@@ -129,62 +207,76 @@ func (amr *Amr) detectParameters(packet *rtp.RtpPacket) error {
 		return errors.New("payload is too short")
 	}
 
-	oaFrameType := (packet.Payload[1] & 0x78) >> 3
-	beFrameType := (packet.Payload[0]&0x07)<<1 | (packet.Payload[1]&0x80)>>7
-	log.Sdebug(fmt.Sprintf("expected OA type %d NB frame size: %d, WB: %d, actual: %d", oaFrameType, AMR_NB_FRAME_SIZE[oaFrameType], AMR_WB_FRAME_SIZE[oaFrameType], len(packet.Payload)))
-	log.Sdebug(fmt.Sprintf("expected BE type %d NB frame size: %d, WB: %d, actual: %d", beFrameType, AMR_NB_FRAME_SIZE[beFrameType], AMR_WB_FRAME_SIZE[beFrameType], len(packet.Payload)))
-
-	checkFrameSize := func(frameSize int) bool {
-		if frameSize > 0 {
-			if d := (len(packet.Payload) - frameSize); d >= 0 && d < 3 {
-				return true
+	// try modes in order until the ToC list describes the payload
+	octetAligned, sampleRate := amr.octetAligned, amr.sampleRate
+	noData := false
+	for _, m := range amrModes {
+		if (amr.alignmentSet && m.octetAligned != octetAligned) || (amr.sampleRateSet && m.sampleRate != sampleRate) {
+			continue
+		}
+		amr.octetAligned, amr.sampleRate = m.octetAligned, m.sampleRate
+		if ok, speech := amr.describes(packet.Payload); ok {
+			if !speech {
+				noData = true
+				continue
 			}
+			log.Info(fmt.Sprintf("detected %s frame", m.description))
+			amr.alignmentSet, amr.sampleRateSet = true, true
+			return nil
 		}
-		return false
 	}
-	setAMRParameters := func(octetAligned bool, sampleRate int) {
-		amr.alignmentSet, amr.sampleRateSet = true, true
-		amr.octetAligned, amr.sampleRate = octetAligned, sampleRate
+	amr.octetAligned, amr.sampleRate = octetAligned, sampleRate
+	if noData { // frames without speech fit any mode, wait for a packet with speech
+		return errors.New("payload is too short")
 	}
+	return errors.New("unable to detect codec parameters")
+}
 
-	if (packet.Payload[0] << 4) == 0x0 { // check for octet-aligned only if the first byte has reserved bits after 4-bit CMR
-		if checkFrameSize(AMR_NB_FRAME_SIZE[oaFrameType]) {
-			log.Info("detected AMR-NB octet-aligned frame")
-			setAMRParameters(true, AMR_NB_SAMPLE_RATE)
-			return nil
-		}
-		if checkFrameSize(AMR_WB_FRAME_SIZE[oaFrameType]) {
-			log.Info("detected AMR-WB octet-aligned frame")
-			setAMRParameters(true, AMR_WB_SAMPLE_RATE)
-			return nil
+// describes returns true if the ToC list of payload, in the current mode, describes its length allowing a
+// few octets of padding, speech is false if none of its frames has speech
+func (amr *Amr) describes(payload []byte) (ok bool, speech bool) {
+	if len(payload) == 0 {
+		return false, false
+	}
+	var frames []amrFrame
+	var length int
+	var err error
+	if amr.octetAligned {
+		// check for octet-aligned only if the first byte has reserved bits after 4-bit CMR
+		if (payload[0] << 4) != 0x0 {
+			return false, false
 		}
+		frames, _, _, length, err = amr.handleOaMode(payload)
+	} else {
+		frames, length, err = amr.handleBeMode(payload)
 	}
+	d := len(payload) - length
+	return err == nil && d >= 0 && d < 3, hasSpeech(frames)
+}
 
-	if checkFrameSize(AMR_NB_FRAME_SIZE[beFrameType]) {
-		log.Info("detected AMR-NB bandwidth-efficient frame")
-		setAMRParameters(false, AMR_NB_SAMPLE_RATE)
-		return nil
-	}
-	if checkFrameSize(AMR_WB_FRAME_SIZE[beFrameType]) {
-		log.Info("detected AMR-WB bandwidth-efficient frame")
-		setAMRParameters(false, AMR_WB_SAMPLE_RATE)
-		return nil
+func hasSpeech(frames []amrFrame) bool {
+	for _, f := range frames {
+		if len(f.data) > 0 {
+			return true
+		}
 	}
-	return errors.New("unable to detect codec parameters")
+	return false
 }
 
 func (amr *Amr) handleMissingSamples(timestamp uint32) (result []byte) {
 	if amr.timestamp != 0 {
 		lostSamplesFromPrevious := ((timestamp - amr.timestamp) / (uint32(amr.sampleRate) / 50)) - 1
 		log.Sdebug("lostSamplesFromPrevious: %d, time: %d", lostSamplesFromPrevious, lostSamplesFromPrevious*20)
-		if lostSamplesFromPrevious == math.MaxUint32 { // something caused a wrap around
+		if lostSamplesFromPrevious == math.MaxUint32 || int32(timestamp-amr.timestamp) < 0 { // something caused a wrap around
 			return result
 		}
 		for i := lostSamplesFromPrevious; i > 0; i-- {
-			if amr.isWideBand() {
-				result = append(result, 0xFC)
-			} else {
-				result = append(result, 0x7C)
+			for c := 0; c < amr.channels; c++ {
+				if amr.isWideBand() {
+					result = append(result, 0xFC)
+				} else {
+					result = append(result, 0x7C)
+				}
 			}
 		}
 	}
@@ -198,101 +290,238 @@ func (amr *Amr) getSpeechFrameByteSize(frameType int) (size int) {
 	return AMR_NB_FRAME_SIZE[frameType]
 }
 
-func (amr *Amr) handleOaMode(timestamp uint32, payload []byte) ([]byte, error) {
-	var result []byte
-	var currentTimestamp uint32
+func (amr *Amr) getSpeechFrameBits(frameType int) int {
+	if amr.isWideBand() {
+		return AMR_WB_FRAME_BITS[frameType]
+	}
+	return AMR_NB_FRAME_BITS[frameType]
+}
+
+func (amr *Amr) getClassABits(frameType int) int {
+	if amr.isWideBand() {
+		return AMR_WB_CLASS_A_BITS[frameType]
+	}
+	return AMR_NB_CLASS_A_BITS[frameType]
+}
 
-	frame := 0
-	rtpFrameHeader := payload[0:]
+// handleOaMode parses octet-aligned payload, returns its frames, interleaving length and index, and
+// payload length described by the ToC list
+func (amr *Amr) handleOaMode(payload []byte) (frames []amrFrame, ill int, ilp int, length int, err error) {
 	// payload header := [CMR(4bit)[R(4bit)][ILL(4bit)(opt)][ILP(4bit)(opt)]
 	// TOC := [F][FT(4bit)][Q][P][P]
+	// CRC := [CRC(8bit)] for each frame with speech bits (opt)
 	// storage := [0][FT(4bit)][Q][0][0]
-	cmr := (rtpFrameHeader[0] & 0xF0) >> 4
-
-	if len(rtpFrameHeader) == 4 { // RFC 2833 RTP Event has a length of 4 bytes
-		printRTPEvent(rtpFrameHeader)
-		return nil, nil
+	cmr := (payload[0] & 0xF0) >> 4
+	pos := 1
+	if amr.interleaving {
+		if len(payload) < 2 {
+			return nil, 0, 0, 0, errors.New("AMR interleaving header truncated")
+		}
+		ill, ilp = int(payload[1]>>4), int(payload[1]&0x0F)
+		if ilp > ill {
+			return nil, 0, 0, 0, fmt.Errorf("AMR interleaving index %d exceeds length %d", ilp, ill)
+		}
+		pos++
 	}
 
-	isLastFrame := (rtpFrameHeader[1]&0x80)&0x80 == 0x00
-	frameType := (rtpFrameHeader[1] & 0x78) >> 3
-	quality := (rtpFrameHeader[1]&0x04)&0x04 == 0x04
-
-	log.Sdebug("octet-aligned, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
-		isLastFrame, cmr, frameType, quality)
-
-	speechFrameHeader := frameType << 3
-	speechFrameHeader = speechFrameHeader | (rtpFrameHeader[1] & 0x04)
-
-	speechFrameSize := amr.getSpeechFrameByteSize(int(frameType))
-
-	currentTimestamp = timestamp + uint32((amr.sampleRate/50)*frame)
+	for last := false; !last; pos++ {
+		if pos >= len(payload) {
+			return nil, 0, 0, 0, errors.New("AMR ToC truncated")
+		}
+		toc := payload[pos]
+		last = toc&0x80 == 0
+		frames = append(frames, amrFrame{frameType: int(toc&0x78) >> 3, quality: toc&0x04 == 0x04})
+	}
+	if len(frames)%amr.channels != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("AMR ToC has %d entries for %d channels", len(frames), amr.channels)
+	}
+	log.Sdebug("octet-aligned, cmr:%d, frames:%d, ill:%d, ilp:%d", cmr, len(frames), ill, ilp)
+
+	var crcs []int
+	if amr.crc {
+		crcs = make([]int, len(frames))
+		for i := range frames {
+			crcs[i] = -1
+			if amr.getSpeechFrameBits(frames[i].frameType) > 0 {
+				if pos >= len(payload) {
+					return nil, 0, 0, 0, errors.New("AMR CRC list truncated")
+				}
+				crcs[i] = int(payload[pos])
+				pos++
+			}
+		}
+	}
 
-	if !isLastFrame {
-		log.Warn("Amr does not suport more than one frame per payload - discarted")
-		return nil, errors.New("Amr does not suport more than one frame per payload")
+	if amr.robustSorting {
+		if length, err = amr.unsortFrames(frames, payload[pos:]); err != nil {
+			return nil, 0, 0, 0, err
+		}
+		length += pos
+	} else {
+		for i := range frames {
+			size := amr.getSpeechFrameByteSize(frames[i].frameType)
+			if pos+size > len(payload) {
+				return nil, 0, 0, 0, errors.New("AMR speech frame truncated")
+			}
+			frames[i].data = payload[pos : pos+size]
+			pos += size
+		}
+		length = pos
 	}
 
-	result = append(result, speechFrameHeader)
+	for i := range crcs {
+		if crcs[i] < 0 {
+			continue
+		}
+		if crc := amrCrc(frames[i].data, amr.getClassABits(frames[i].frameType)); int(crc) != crcs[i] {
+			// the frame is kept but marked as damaged, so decoders conceal it
+			amr.crcErrors++
+			log.Sdebug("AMR frame %d CRC mismatch: 0x%02x, expected 0x%02x, %d errors so far", i, crc, crcs[i], amr.crcErrors)
+			frames[i].quality = false
+		}
+	}
+	return frames, ill, ilp, length, nil
+}
 
-	if speechFrameSize != 0 {
-		speechPayload := rtpFrameHeader[2 : 2+speechFrameSize]
-		result = append(result, speechPayload...)
+// unsortFrames restores frames of a robust sorted payload, where bits are taken from each frame in
+// turn, RFC 4867 section 4.4.5.1, returns length of speech data
+func (amr *Amr) unsortFrames(frames []amrFrame, speech []byte) (int, error) {
+	bits := make([]int, len(frames))
+	maxBits := 0
+	for i := range frames {
+		bits[i] = amr.getSpeechFrameBits(frames[i].frameType)
+		frames[i].data = make([]byte, (bits[i]+7)/8)
+		if bits[i] > maxBits {
+			maxBits = bits[i]
+		}
 	}
-	amr.timestamp = currentTimestamp
-	return result, nil
+	r := bitReader{data: speech}
+	for b := 0; b < maxBits; b++ {
+		for i := range frames {
+			if b >= bits[i] {
+				continue
+			}
+			bit, err := r.read(1)
+			if err != nil {
+				return 0, errors.New("AMR speech frame truncated")
+			}
+			setBit(frames[i].data, b, byte(bit))
+		}
+	}
+	return r.octets(), nil
 }
 
-func (amr *Amr) handleBeMode(timestamp uint32, payload []byte) ([]byte, error) {
-	var result []byte
-	var currentTimestamp uint32
+// amrCrc calculates CRC over class A bits of a speech frame, with generator polynomial
+// D^8 + D^6 + D^5 + D^4 + 1
+func amrCrc(data []byte, bits int) byte {
+	var crc byte
+	for i := 0; i < bits; i++ {
+		feedback := crc>>7 ^ getBit(data, i)
+		crc <<= 1
+		if feedback != 0 {
+			crc ^= 0x71
+		}
+	}
+	return crc
+}
 
-	frame := 0
-	rtpFrameHeader := payload[0:]
+// handleBeMode parses bandwidth-efficient payload, returns its frames and payload length described
+// by the ToC list
+func (amr *Amr) handleBeMode(payload []byte) ([]amrFrame, int, error) {
 	// packing frame with TOC: frame type and quality bit
-	// RTP=[CMR(4bit)[F][FT(4bit)][Q][..speechFrame]] -> storage=[0][FT(4bit)][Q][0][0]
-	cmr := (rtpFrameHeader[0] & 0xF0) >> 4
-
-	if len(rtpFrameHeader) == 4 { // RFC 2833 RTP Event has a length of 4 bytes
-		printRTPEvent(rtpFrameHeader)
-		return nil, nil
+	// RTP=[CMR(4bit)[F][FT(4bit)][Q]...[speech frames]] -> storage=[0][FT(4bit)][Q][0][0]
+	r := bitReader{data: payload}
+	cmr, err := r.read(4)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	isLastFrame := (rtpFrameHeader[0]&0x08)>>3 == 0x00
-	frameType := (rtpFrameHeader[0]&0x07)<<1 | (rtpFrameHeader[1]&0x80)>>7
-	quality := (rtpFrameHeader[1] & 0x40) == 0x40
-
-	log.Sdebug("bandwidth-efficient, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
-		isLastFrame, cmr, frameType, quality)
-
-	speechFrameHeader := (rtpFrameHeader[0]&0x07)<<4 | (rtpFrameHeader[1]&0x80)>>4
-	speechFrameHeader = speechFrameHeader | (rtpFrameHeader[1]&0x40)>>4
+	var frames []amrFrame
+	for more := uint32(1); more == 1; {
+		toc, err := r.read(6)
+		if err != nil {
+			return nil, 0, errors.New("AMR ToC truncated")
+		}
+		more = toc >> 5
+		frames = append(frames, amrFrame{frameType: int(toc>>1) & 0x0F, quality: toc&0x01 == 0x01})
+	}
+	if len(frames)%amr.channels != 0 {
+		return nil, 0, fmt.Errorf("AMR ToC has %d entries for %d channels", len(frames), amr.channels)
+	}
+	log.Sdebug("bandwidth-efficient, cmr:%d, frames:%d", cmr, len(frames))
 
-	speechFrameSize := amr.getSpeechFrameByteSize(int(frameType))
+	for i := range frames {
+		if bits := amr.getSpeechFrameBits(frames[i].frameType); bits > 0 {
+			if frames[i].data, err = r.readBits(bits); err != nil {
+				return nil, 0, errors.New("AMR speech frame truncated")
+			}
+		}
+	}
+	return frames, r.octets(), nil
+}
 
-	currentTimestamp = timestamp + uint32((amr.sampleRate/50)*frame)
+// writeFrameBlocks returns frame-blocks of a payload in storage format, each block holds a frame of every
+// channel, interleaved blocks are held back until their group is complete
+func (amr *Amr) writeFrameBlocks(timestamp uint32, frames []amrFrame, ill int, ilp int) (result []byte) {
+	samplesPerFrame := uint32(amr.sampleRate / 50)
+	if !amr.interleaving {
+		for i := 0; i*amr.channels < len(frames); i++ {
+			result = append(result, amr.writeFrameBlock(timestamp+uint32(i)*samplesPerFrame, frames[i*amr.channels:(i+1)*amr.channels])...)
+		}
+		return result
+	}
 
-	if !isLastFrame {
-		log.Warn("Amr does not suport more than one frame per payload - discarted")
-		return nil, errors.New("Amr does not suport more than one frame per payload")
+	// a packet with the first index after the held blocks starts a new group, RFC 4867 section 4.4.1
+	if ilp == 0 {
+		newGroup := true
+		for t := range amr.interleaved {
+			if int32(timestamp-t) <= 0 {
+				newGroup = false
+			}
+		}
+		if newGroup {
+			result = amr.writeInterleaved()
+		}
+	}
+	if amr.interleaved == nil {
+		amr.interleaved = make(map[uint32][]amrFrame)
+	}
+	// frame-blocks of a packet are ILL+1 frame-blocks apart
+	step := uint32(ill+1) * samplesPerFrame
+	for i := 0; i*amr.channels < len(frames); i++ {
+		amr.interleaved[timestamp+uint32(i)*step] = frames[i*amr.channels : (i+1)*amr.channels]
 	}
+	return result
+}
 
-	result = append(result, speechFrameHeader)
+// writeInterleaved returns held frame-blocks in timestamp order
+func (amr *Amr) writeInterleaved() (result []byte) {
+	timestamps := make([]uint32, 0, len(amr.interleaved))
+	for t := range amr.interleaved {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return int32(timestamps[i]-timestamps[j]) < 0
+	})
+	for _, t := range timestamps {
+		result = append(result, amr.writeFrameBlock(t, amr.interleaved[t])...)
+	}
+	amr.interleaved = nil
+	return result
+}
 
-	if speechFrameSize != 0 {
-		speechPayload := rtpFrameHeader[1:]
-		speechFrame := make([]byte, speechFrameSize)
-		// shift 2 bits left in speechFrame
-		for k := 0; k < speechFrameSize; k++ {
-			speechFrame[k] = (speechPayload[k] & 0x3F) << 2
-			if k+1 < speechFrameSize {
-				speechFrame[k] = speechFrame[k] | (speechPayload[k+1]&0xC0)>>6
-			}
+func (amr *Amr) writeFrameBlock(timestamp uint32, block []amrFrame) []byte {
+	result := amr.handleMissingSamples(timestamp)
+	for _, f := range block {
+		speechFrameHeader := byte(f.frameType) << 3
+		if f.quality {
+			speechFrameHeader |= 0x04
 		}
-		result = append(result, speechFrame...)
+		result = append(result, speechFrameHeader)
+		result = append(result, f.data...)
 	}
-	amr.timestamp = currentTimestamp
-	return result, nil
+	amr.timestamp = timestamp
+	return result
 }
 
 func printRTPEvent(frameHeader []byte) {
@@ -309,6 +538,10 @@ var AmrMetadata = CodecMetadata{
 	Options: []CodecOption{
 		amrSampleRateOption,
 		amrOctetAlignedOption,
+		amrChannelsOption,
+		amrInterleavingOption,
+		amrCrcOption,
+		amrRobustSortingOption,
 	},
 	Init: NewAmr,
 }
@@ -330,3 +563,39 @@ var amrSampleRateOption = CodecOption{
 	ValueDescription: []string{"Narrow Band (8000)", "Wide Band (16000)", "Detect automatically"},
 	RestrictValues:   true,
 }
+
+var amrChannelsOption = CodecOption{
+	Required:         false,
+	Name:             "channels",
+	Description:      "number of audio channels, frame-blocks of several channels are stored in multi-channel format",
+	ValidValues:      []string{"1", "2", "3", "4", "5", "6"},
+	ValueDescription: []string{"mono", "stereo", "3 channels", "4 channels", "5 channels", "6 channels"},
+	RestrictValues:   true,
+}
+
+var amrInterleavingOption = CodecOption{
+	Required:         false,
+	Name:             "interleaving",
+	Description:      "whether frame-blocks are interleaved, octet-aligned only",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"no interleaving", "interleaving"},
+	RestrictValues:   true,
+}
+
+var amrCrcOption = CodecOption{
+	Required:         false,
+	Name:             "crc",
+	Description:      "whether frames are protected by CRC, octet-aligned only",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"no CRC", "CRC"},
+	RestrictValues:   true,
+}
+
+var amrRobustSortingOption = CodecOption{
+	Required:         false,
+	Name:             "robust-sorting",
+	Description:      "whether speech bits of frames are robust sorted, octet-aligned only",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"frames in order", "robust sorting"},
+	RestrictValues:   true,
+}
@@ -0,0 +1,367 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/david-biro/rtpdump/rtp"
+)
+
+// bitWriter packs payload fields most significant bit first, as laid out in RFC 4867 figures
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.pos%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[w.pos/8] |= bit << (7 - uint(w.pos%8))
+	w.pos++
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(byte(v>>uint(i)) & 1)
+	}
+}
+
+func (w *bitWriter) writeFrame(data []byte, bits int) {
+	for i := 0; i < bits; i++ {
+		w.writeBit(data[i/8] >> (7 - uint(i%8)) & 1)
+	}
+}
+
+type testFrame struct {
+	frameType int
+	quality   bool
+	data      []byte
+}
+
+// nbFrame returns AMR-NB frame with arbitrary speech bits d(0)... left aligned and padded with zeros
+func nbFrame(frameType int, quality bool, seed byte) testFrame {
+	bits := AMR_NB_FRAME_BITS[frameType]
+	data := make([]byte, (bits+7)/8)
+	for i := range data {
+		data[i] = seed + byte(i)*37
+	}
+	if bits%8 != 0 {
+		data[len(data)-1] &= 0xFF << uint(8-bits%8)
+	}
+	return testFrame{frameType, quality, data}
+}
+
+// storage returns frames in storage format, ToC octet with frame type and quality followed by speech
+func storage(frames ...testFrame) []byte {
+	var result []byte
+	for _, f := range frames {
+		header := byte(f.frameType) << 3
+		if f.quality {
+			header |= 0x04
+		}
+		result = append(append(result, header), f.data...)
+	}
+	return result
+}
+
+// bePayload builds bandwidth-efficient payload of frames, CMR 15 (no mode request)
+func bePayload(frames ...testFrame) []byte {
+	w := &bitWriter{}
+	w.write(15, 4)
+	for i, f := range frames {
+		more, quality := uint32(0), uint32(0)
+		if i < len(frames)-1 {
+			more = 1
+		}
+		if f.quality {
+			quality = 1
+		}
+		w.write(more, 1)
+		w.write(uint32(f.frameType), 4)
+		w.write(quality, 1)
+	}
+	for _, f := range frames {
+		w.writeFrame(f.data, AMR_NB_FRAME_BITS[f.frameType])
+	}
+	return w.data
+}
+
+// crcByDivision returns the remainder of class A bits times D^8 divided by D^8 + D^6 + D^5 + D^4 + 1,
+// as frame CRCs of octet-aligned payloads are defined in RFC 4867 section 4.4.2
+func crcByDivision(data []byte, bits int) byte {
+	generator := []byte{1, 0, 1, 1, 1, 0, 0, 0, 1}
+	r := make([]byte, bits+8)
+	for i := 0; i < bits; i++ {
+		r[i] = getBit(data, i)
+	}
+	for i := 0; i < bits; i++ {
+		if r[i] == 1 {
+			for j, g := range generator {
+				r[i+j] ^= g
+			}
+		}
+	}
+	var crc byte
+	for _, bit := range r[bits:] {
+		crc = crc<<1 | bit
+	}
+	return crc
+}
+
+type oaOptions struct {
+	interleaving bool
+	ill, ilp     int
+	crc          bool
+	sorted       bool
+}
+
+// oaPayload builds octet-aligned payload of frames, CMR 15 (no mode request)
+func oaPayload(o oaOptions, frames ...testFrame) []byte {
+	payload := []byte{0xF0}
+	if o.interleaving {
+		payload = append(payload, byte(o.ill<<4|o.ilp))
+	}
+	for i, f := range frames {
+		toc := byte(f.frameType) << 3
+		if i < len(frames)-1 {
+			toc |= 0x80
+		}
+		if f.quality {
+			toc |= 0x04
+		}
+		payload = append(payload, toc)
+	}
+	if o.crc {
+		for _, f := range frames {
+			if AMR_NB_FRAME_BITS[f.frameType] > 0 {
+				payload = append(payload, crcByDivision(f.data, AMR_NB_CLASS_A_BITS[f.frameType]))
+			}
+		}
+	}
+	if !o.sorted {
+		for _, f := range frames {
+			payload = append(payload, f.data...)
+		}
+		return payload
+	}
+	// robust sorting takes bit i of every frame in turn, frames out of bits are skipped
+	w := &bitWriter{}
+	for i := 0; i < AMR_NB_FRAME_BITS[7]; i++ {
+		for _, f := range frames {
+			if i < AMR_NB_FRAME_BITS[f.frameType] {
+				w.writeBit(getBit(f.data, i))
+			}
+		}
+	}
+	return append(payload, w.data...)
+}
+
+func newTestAmr(t *testing.T, options map[string]string) *Amr {
+	t.Helper()
+	amr := NewAmr().(*Amr)
+	if err := amr.SetOptions(options); err != nil {
+		t.Fatal(err)
+	}
+	return amr
+}
+
+func handle(t *testing.T, amr *Amr, seq uint16, timestamp uint32, payload []byte) []byte {
+	t.Helper()
+	result, err := amr.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: seq, Timestamp: timestamp, Payload: payload})
+	if err != nil {
+		t.Fatalf("packet %d: %s", seq, err)
+	}
+	return result
+}
+
+func TestHandleBeModeSingleFrame(t *testing.T) {
+	// RFC 4867 section 4.3.5.1, a 7.95 kbit/s frame, 169 bits padded to 22 octets
+	frame := nbFrame(5, true, 0x5A)
+	payload := bePayload(frame)
+	if len(payload) != 22 {
+		t.Fatalf("payload of %d octets, want 22", len(payload))
+	}
+
+	amr := newTestAmr(t, map[string]string{"octet-aligned": "0", "sample-rate": "nb"})
+	frames, length, err := amr.handleBeMode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 22 || len(frames) != 1 || frames[0].frameType != 5 || !frames[0].quality || !bytes.Equal(frames[0].data, frame.data) {
+		t.Errorf("got %d octets, frames %+v", length, frames)
+	}
+	if got, want := handle(t, amr, 1, 160, payload), storage(frame); !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+
+	if _, _, err := amr.handleBeMode(payload[:21]); err == nil {
+		t.Errorf("truncated payload: expected error")
+	}
+}
+
+func TestHandleBeModeMultipleFrames(t *testing.T) {
+	// RFC 4867 section 4.3.5.2, consecutive 12.2 kbit/s frames, the second one damaged
+	frames := []testFrame{nbFrame(7, true, 1), nbFrame(7, false, 2), nbFrame(7, true, 3)}
+	amr := newTestAmr(t, map[string]string{"octet-aligned": "0", "sample-rate": "nb"})
+	if got, want := handle(t, amr, 1, 160, bePayload(frames...)), storage(frames...); !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+}
+
+func TestHandleBeModeMultiChannel(t *testing.T) {
+	// RFC 4867 section 4.3.5.3, two frame-blocks of left and right channel, right one has no data in the second
+	frames := []testFrame{nbFrame(7, true, 1), nbFrame(7, true, 2), nbFrame(7, true, 3), {frameType: 15, quality: true}}
+	amr := newTestAmr(t, map[string]string{"octet-aligned": "0", "sample-rate": "nb", "channels": "2"})
+	magic, err := amr.GetFormatMagic()
+	if want := []byte("#!AMR_MC1.0\n\x00\x00\x00\x02"); err != nil || !bytes.Equal(magic, want) {
+		t.Errorf("magic: got %q, want %q", magic, want)
+	}
+	if got, want := handle(t, amr, 1, 160, bePayload(frames...)), storage(frames...); !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+
+	// a lost frame-block is a NO_DATA frame for each channel
+	next := []testFrame{nbFrame(5, true, 4), nbFrame(5, true, 5)}
+	want := append([]byte{0x7C, 0x7C}, storage(next...)...)
+	if got := handle(t, amr, 3, 160+3*160, bePayload(next...)); !bytes.Equal(got, want) {
+		t.Errorf("after loss: got %X, want %X", got, want)
+	}
+
+	if _, _, err := amr.handleBeMode(bePayload(frames[:3]...)); err == nil {
+		t.Errorf("ToC entries not a multiple of channels: expected error")
+	}
+}
+
+func TestHandleOaMode(t *testing.T) {
+	// RFC 4867 section 4.4.5.1, frames octet-aligned one after the other
+	frames := []testFrame{nbFrame(5, true, 1), nbFrame(4, true, 2), nbFrame(8, false, 3)}
+	payload := oaPayload(oaOptions{}, frames...)
+	amr := newTestAmr(t, map[string]string{"octet-aligned": "1", "sample-rate": "nb"})
+	if got, want := handle(t, amr, 1, 160, payload), storage(frames...); !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+	if _, _, _, _, err := amr.handleOaMode(payload[:len(payload)-1]); err == nil {
+		t.Errorf("truncated payload: expected error")
+	}
+}
+
+func TestAmrCrc(t *testing.T) {
+	tests := []struct {
+		data []byte
+		bits int
+		want byte
+	}{
+		{[]byte{0x00}, 8, 0x00},
+		{[]byte{0x80}, 1, 0x71}, // D^8 mod generator
+		{[]byte{0x80}, 2, 0xE2},
+		{[]byte{0x80}, 3, 0xB5},
+	}
+	for _, tt := range tests {
+		if got := amrCrc(tt.data, tt.bits); got != tt.want {
+			t.Errorf("%X, %d bits: got 0x%02X, want 0x%02X", tt.data, tt.bits, got, tt.want)
+		}
+	}
+
+	// class A bits of every frame type, class B and C bits after them don't change the CRC
+	for frameType := 0; frameType <= 8; frameType++ {
+		frame := nbFrame(frameType, true, byte(frameType*11+5))
+		bits := AMR_NB_CLASS_A_BITS[frameType]
+		crc := amrCrc(frame.data, bits)
+		if want := crcByDivision(frame.data, bits); crc != want {
+			t.Errorf("frame type %d: got 0x%02X, want 0x%02X", frameType, crc, want)
+		}
+		if last := AMR_NB_FRAME_BITS[frameType] - 1; last >= bits {
+			frame.data[last/8] ^= 0x80 >> uint(last%8)
+			if got := amrCrc(frame.data, bits); got != crc {
+				t.Errorf("frame type %d: bit %d changed CRC", frameType, last)
+			}
+		}
+	}
+}
+
+func TestHandleOaModeCrc(t *testing.T) {
+	// NO_DATA frames have no CRC
+	frames := []testFrame{nbFrame(7, true, 1), {frameType: 15, quality: true}, nbFrame(8, true, 2)}
+	payload := oaPayload(oaOptions{crc: true}, frames...)
+	if len(payload) != 1+3+2+31+5 {
+		t.Fatalf("payload of %d octets", len(payload))
+	}
+	amr := newTestAmr(t, map[string]string{"sample-rate": "nb", "crc": "1"})
+	if got, want := handle(t, amr, 1, 160, payload), storage(frames...); !bytes.Equal(got, want) || amr.crcErrors != 0 {
+		t.Errorf("got %X, want %X, %d CRC errors", got, want, amr.crcErrors)
+	}
+
+	// a class A bit error is caught, the frame is kept but marked as damaged
+	payload[6] ^= 0x01
+	damaged := []testFrame{frames[0], frames[1], frames[2]}
+	damaged[0].quality = false
+	damaged[0].data = append([]byte{}, frames[0].data...)
+	damaged[0].data[0] ^= 0x01
+	if got, want := handle(t, amr, 2, 320, payload), storage(damaged...); !bytes.Equal(got, want) || amr.crcErrors != 1 {
+		t.Errorf("got %X, want %X, %d CRC errors", got, want, amr.crcErrors)
+	}
+}
+
+func TestUnsortFrames(t *testing.T) {
+	// a SID frame runs out of bits before the 4.75 kbit/s frame
+	frames := []testFrame{nbFrame(8, true, 1), nbFrame(0, true, 2)}
+	sorted := oaPayload(oaOptions{sorted: true}, frames...)[3:]
+	if len(sorted) != (39+95+7)/8 {
+		t.Fatalf("sorted speech of %d octets", len(sorted))
+	}
+	amr := newTestAmr(t, map[string]string{"sample-rate": "nb", "robust-sorting": "1"})
+	unsorted := []amrFrame{{frameType: 8}, {frameType: 0}}
+	length, err := amr.unsortFrames(unsorted, sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != len(sorted) {
+		t.Errorf("got length %d, want %d", length, len(sorted))
+	}
+	for i := range frames {
+		if !bytes.Equal(unsorted[i].data, frames[i].data) {
+			t.Errorf("frame %d: got %X, want %X", i, unsorted[i].data, frames[i].data)
+		}
+	}
+	if _, err := amr.unsortFrames(unsorted, sorted[:len(sorted)-1]); err == nil {
+		t.Errorf("truncated speech: expected error")
+	}
+}
+
+func TestInterleavingCrcRobustSorting(t *testing.T) {
+	// RFC 4867 section 4.4.5.2, two channels with CRC, robust sorting and interleaving length 1, so a group
+	// is two packets of frame-blocks 0 and 2, and 1 and 3
+	amr := newTestAmr(t, map[string]string{"sample-rate": "nb", "channels": "2", "interleaving": "1", "crc": "1", "robust-sorting": "1"})
+	block := func(seed byte) []testFrame {
+		return []testFrame{nbFrame(7, true, seed), nbFrame(5, true, seed+1)}
+	}
+	packet := func(ilp int, blocks ...[]testFrame) []byte {
+		var frames []testFrame
+		for _, b := range blocks {
+			frames = append(frames, b...)
+		}
+		return oaPayload(oaOptions{interleaving: true, ill: 1, ilp: ilp, crc: true, sorted: true}, frames...)
+	}
+	b0, b1, b2, b3, b4, b6 := block(10), block(20), block(30), block(40), block(50), block(70)
+
+	if got := handle(t, amr, 1, 1000, packet(0, b0, b2)); len(got) != 0 {
+		t.Errorf("first packet of the group: got %X", got)
+	}
+	if got := handle(t, amr, 2, 1160, packet(1, b1, b3)); len(got) != 0 {
+		t.Errorf("second packet of the group: got %X", got)
+	}
+	// the next group starts, the complete one is written in timestamp order
+	want := storage(append(append(append(b0, b1...), b2...), b3...)...)
+	if got := handle(t, amr, 3, 1640, packet(0, b4, b6)); !bytes.Equal(got, want) {
+		t.Errorf("first group: got %X, want %X", got, want)
+	}
+	if amr.crcErrors != 0 {
+		t.Errorf("%d CRC errors", amr.crcErrors)
+	}
+	// the second packet of the last group is missing, its frame-block is lost
+	want = append(append(storage(b4...), 0x7C, 0x7C), storage(b6...)...)
+	if got := amr.Flush(); !bytes.Equal(got, want) {
+		t.Errorf("flushed group: got %X, want %X", got, want)
+	}
+}
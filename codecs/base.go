@@ -14,11 +14,32 @@ type Codec interface {
 	GetFormatMagic() ([]byte, error)
 }
 
+//Flusher is implemented by codecs holding back frames, e.g. to reorder them, Flush returns frames
+//still held at the end of the stream
+type Flusher interface {
+	Flush() []byte
+}
+
+//HeaderUpdater is implemented by codecs whose format magic holds length of the data after it,
+//UpdateHeader returns the magic rewritten at the start of the file once all data was written
+type HeaderUpdater interface {
+	UpdateHeader(dataLength int64) []byte
+}
+
 type CodecMetadata struct {
-	Name     string
-	LongName string
-	Options  []CodecOption
-	Init     func() Codec
+	Name      string
+	LongName  string
+	Extension string // of output files if it isn't the codec name
+	Options   []CodecOption
+	Init      func() Codec
+}
+
+//FileExtension returns extension of files the codec writes
+func (m CodecMetadata) FileExtension() string {
+	if m.Extension != "" {
+		return m.Extension
+	}
+	return m.Name
 }
 
 type CodecOption struct {
@@ -0,0 +1,54 @@
+package codecs
+
+import "errors"
+
+var errBitsTruncated = errors.New("payload truncated")
+
+// bitReader reads payload fields not aligned to octets, most significant bit first
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.data)*8 - r.pos
+}
+
+// read returns next n bits, n is 32 at most
+func (r *bitReader) read(n int) (uint32, error) {
+	if r.remaining() < n {
+		return 0, errBitsTruncated
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v, nil
+}
+
+// readBits returns next n bits left aligned in octets, last octet padded with zeros
+func (r *bitReader) readBits(n int) ([]byte, error) {
+	if r.remaining() < n {
+		return nil, errBitsTruncated
+	}
+	out := make([]byte, (n+7)/8)
+	for i := 0; i < n; i++ {
+		setBit(out, i, r.data[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return out, nil
+}
+
+// octets returns number of octets started so far
+func (r *bitReader) octets() int {
+	return (r.pos + 7) / 8
+}
+
+func setBit(data []byte, i int, bit byte) {
+	data[i/8] |= bit << (7 - uint(i%8))
+}
+
+func getBit(data []byte, i int) byte {
+	return data[i/8] >> (7 - uint(i%8)) & 1
+}
@@ -0,0 +1,71 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitReaderRead(t *testing.T) {
+	r := bitReader{data: []byte{0xA5, 0x3C}} // 1010 0101 0011 1100
+	tests := []struct {
+		n    int
+		want uint32
+	}{
+		{4, 0xA},
+		{6, 0x14},
+		{0, 0},
+		{6, 0x3C},
+	}
+	for _, tt := range tests {
+		got, err := r.read(tt.n)
+		if err != nil || got != tt.want {
+			t.Errorf("read(%d): got 0x%X, %v, want 0x%X", tt.n, got, err, tt.want)
+		}
+	}
+	if r.remaining() != 0 || r.octets() != 2 {
+		t.Errorf("got %d bits remaining, %d octets, want 0 and 2", r.remaining(), r.octets())
+	}
+	if _, err := r.read(1); err != errBitsTruncated {
+		t.Errorf("read past end: got %v, want %v", err, errBitsTruncated)
+	}
+}
+
+func TestBitReaderReadBits(t *testing.T) {
+	r := bitReader{data: []byte{0xA5, 0x3C, 0xFF}}
+	if _, err := r.read(4); err != nil {
+		t.Fatal(err)
+	}
+	// 9 bits starting in the middle of an octet, left aligned and padded with zeros
+	got, err := r.readBits(9)
+	if want := []byte{0x53, 0x80}; err != nil || !bytes.Equal(got, want) {
+		t.Errorf("got %X, %v, want %X", got, err, want)
+	}
+	if r.octets() != 2 {
+		t.Errorf("got %d octets started, want 2", r.octets())
+	}
+	if _, err := r.readBits(12); err != errBitsTruncated {
+		t.Errorf("read past end: got %v, want %v", err, errBitsTruncated)
+	}
+	if r.remaining() != 11 {
+		t.Errorf("failed read moved position, %d bits remaining", r.remaining())
+	}
+}
+
+func TestSetGetBit(t *testing.T) {
+	data := make([]byte, 2)
+	for _, i := range []int{0, 7, 9, 15} {
+		setBit(data, i, 1)
+	}
+	if want := []byte{0x81, 0x41}; !bytes.Equal(data, want) {
+		t.Errorf("got %X, want %X", data, want)
+	}
+	for i := 0; i < 16; i++ {
+		want := byte(0)
+		if i == 0 || i == 7 || i == 9 || i == 15 {
+			want = 1
+		}
+		if got := getBit(data, i); got != want {
+			t.Errorf("bit %d: got %d, want %d", i, got, want)
+		}
+	}
+}
@@ -1,7 +1,60 @@
 package codecs
 
+import (
+	"strconv"
+	"strings"
+
+	"github.com/david-biro/rtpdump/rtp"
+)
+
 var CodecList = []CodecMetadata{
 	AmrMetadata,
 	H264Metadata,
 	EvsMetadata,
+	G711Metadata,
+}
+
+//FindByFormat returns codec and options matching payload format negotiated in SDP
+func FindByFormat(format *rtp.MediaFormat) (CodecMetadata, map[string]string, bool) {
+	switch strings.ToUpper(format.Encoding) {
+	case "AMR", "AMR-WB":
+		// RFC 4867, bandwidth-efficient unless octet-align=1
+		options := map[string]string{"sample-rate": "nb", "octet-aligned": "0"}
+		if strings.ToUpper(format.Encoding) == "AMR-WB" {
+			options["sample-rate"] = "wb"
+		}
+		if format.Fmtp["octet-align"] == "1" {
+			options["octet-aligned"] = "1"
+		}
+		if format.Channels > 1 {
+			options["channels"] = strconv.Itoa(format.Channels)
+		}
+		// these are only allowed in octet-aligned mode
+		for _, name := range []string{"interleaving", "crc", "robust-sorting"} {
+			if v := format.Fmtp[name]; v != "" && v != "0" {
+				options[name], options["octet-aligned"] = "1", "1"
+			}
+		}
+		return AmrMetadata, options, true
+	case "EVS":
+		// TS 26.445 A.3, compact format is used for its payload sizes unless hf-only=1, detected from payloads
+		options := map[string]string{"header-format": "auto"}
+		if format.Fmtp["hf-only"] == "1" {
+			options["header-format"] = "1"
+		}
+		return EvsMetadata, options, true
+	case "PCMU":
+		return G711Metadata, map[string]string{"law": "mu"}, true
+	case "PCMA":
+		return G711Metadata, map[string]string{"law": "a"}, true
+	case "H264":
+		// RFC 6184, single NAL unit mode unless packetization-mode says otherwise
+		options := map[string]string{"packetization-mode": "0"}
+		switch mode := format.Fmtp["packetization-mode"]; mode {
+		case "1", "2":
+			options["packetization-mode"] = mode
+		}
+		return H264Metadata, options, true
+	}
+	return CodecMetadata{}, nil, false
 }
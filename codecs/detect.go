@@ -0,0 +1,113 @@
+package codecs
+
+import (
+	"github.com/david-biro/rtpdump/rtp"
+)
+
+//DetectPackets is the number of packets of a stream payload formats are detected from
+const DetectPackets = 20
+
+// a payload format has to describe this share of packets to be chosen, some may be e.g. RFC 2833 events
+const detectShare = 0.9
+
+// first dynamic payload type, static ones identify their codec, RFC 3551
+const firstDynamicPayloadType = 96
+
+//Detect chooses codec and options of a stream, from its payload format negotiated in SDP if known,
+//from its payload type if static, from payloads of its first packets otherwise,
+//formats are tried in order: AMR, EVS, H264
+func Detect(format *rtp.MediaFormat, payloadType int, payloads [][]byte) (CodecMetadata, map[string]string, bool) {
+	if format != nil {
+		return FindByFormat(format)
+	}
+	switch {
+	case payloadType == PCMU_PAYLOAD_TYPE:
+		return G711Metadata, map[string]string{"law": "mu"}, true
+	case payloadType == PCMA_PAYLOAD_TYPE:
+		return G711Metadata, map[string]string{"law": "a"}, true
+	case payloadType < firstDynamicPayloadType:
+		return CodecMetadata{}, nil, false
+	}
+	if options, ok := detectAmr(payloads); ok {
+		return AmrMetadata, options, true
+	}
+	if options, ok := detectEvs(payloads); ok {
+		return EvsMetadata, options, true
+	}
+	if options, ok := detectH264(payloads); ok {
+		return H264Metadata, options, true
+	}
+	return CodecMetadata{}, nil, false
+}
+
+func enough(described int, total int) bool {
+	return total > 0 && float64(described) >= detectShare*float64(total)
+}
+
+// detectAmr returns options of the first AMR mode describing payloads, at least one of them with speech
+func detectAmr(payloads [][]byte) (map[string]string, bool) {
+	for _, m := range amrModes {
+		amr := &Amr{octetAligned: m.octetAligned, sampleRate: m.sampleRate, channels: 1}
+		described, speech := 0, false
+		for _, payload := range payloads {
+			if ok, s := amr.describes(payload); ok {
+				described++
+				speech = speech || s
+			}
+		}
+		if speech && enough(described, len(payloads)) {
+			options := map[string]string{"sample-rate": "nb", "octet-aligned": "0"}
+			if m.sampleRate == AMR_WB_SAMPLE_RATE {
+				options["sample-rate"] = "wb"
+			}
+			if m.octetAligned {
+				options["octet-aligned"] = "1"
+			}
+			return options, true
+		}
+	}
+	return nil, false
+}
+
+// detectEvs returns header format describing payloads, Compact Format if both do
+func detectEvs(payloads [][]byte) (map[string]string, bool) {
+	compact, headerFull := 0, 0
+	for _, payload := range payloads {
+		c, f := evsPayloadFormats(payload)
+		if c {
+			compact++
+		}
+		if f {
+			headerFull++
+		}
+	}
+	switch {
+	case enough(compact, len(payloads)) && compact >= headerFull:
+		return map[string]string{"header-format": "0"}, true
+	case enough(headerFull, len(payloads)):
+		return map[string]string{"header-format": "1"}, true
+	}
+	return nil, false
+}
+
+// detectH264 returns packetization mode if payloads start with NAL unit headers, Non-Interleaved Mode
+// if any of them is an aggregation or fragmentation unit
+func detectH264(payloads [][]byte) (map[string]string, bool) {
+	described, mode := 0, "0"
+	for _, payload := range payloads {
+		if len(payload) < 2 || payload[0]&0x80 != 0 { // forbidden zero bit
+			continue
+		}
+		switch nalType := payload[0] & 0x1F; {
+		case nalType >= 1 && nalType <= 23:
+			described++
+		case nalType == 24 || nalType == 28: // STAP-A, FU-A
+			described++
+			mode = "1"
+		}
+	}
+	if !enough(described, len(payloads)) {
+		return nil, false
+	}
+	return map[string]string{"packetization-mode": mode}, true
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/david-biro/rtpdump/log"
 	"github.com/david-biro/rtpdump/rtp"
 )
 
@@ -15,6 +16,28 @@ var EVS_IO_MODES []int = []int{0, 2, 1, 0, 0, 1, 0, 1, 0, 1, 1, 0, 1, 1, 1, 1, 0
 // payload size is in bytes, only for Compact Header!
 var EVS_PAYLOAD_SIZES []int = []int{6, 7, 17, 18, 20, 23, 24, 32, 33, 36, 40, 41, 46, 50, 58, 60, 61, 80, 120, 160, 240, 320}
 
+// frame sizes in bytes by bit rate index of the ToC, SID at 12, SPEECH_LOST at 14 and NO_DATA at 15 (Table A.4)
+var EVS_PRIMARY_FRAME_SIZES []int = []int{7, 18, 20, 24, 33, 41, 61, 80, 120, 160, 240, 320, 6, 0, 0, 0}
+
+// frame sizes in bytes by bit rate index of the ToC, SID at 9, SPEECH_LOST at 14 and NO_DATA at 15 (Table A.5)
+var EVS_AMRWB_IO_FRAME_SIZES []int = []int{17, 23, 32, 36, 40, 46, 50, 58, 60, 5, 0, 0, 0, 0, 0, 0}
+
+const (
+	evsHeaderBit     = 0x80 // set in CMR, clear in ToC
+	evsFollowBit     = 0x40 // another ToC follows
+	evsModeBit       = 0x20 // AMR-WB IO frame
+	evsFrameTypeMask = 0x3F
+)
+
+// bit rate indexes of frames without speech, in both EVS Primary and AMR-WB IO ToC
+const (
+	evsSpeechLost = 14
+	evsNoData     = 15
+)
+
+// EVS RTP clock rate is 16000 for every bandwidth, a frame is 20 ms
+const EVS_SAMPLES_PER_FRAME = 320
+
 const EVS_MAGIC_1 string = "#!EVS_MC1.0\n"
 const EVS_MAGIC_2 string = "\x00\x00\x00\x01"
 
@@ -22,10 +45,14 @@ var evs_payload_sizes = []int{6, 7, 17, 18, 20, 23, 24, 32, 33, 36, 40, 41, 46,
 var toc = []byte{0x0C, 0x00, 0, 0x01, 0x02, 1, 0x03, 0x32, 0x04, 3, 4, 0x05, 5, 6, 7, 8, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B}
 
 type Evs struct {
-	started    bool
-	configured bool // for menu options
-	FullHeader bool
-	timestamp  uint32
+	started         bool
+	configured      bool // for menu options
+	FullHeader      bool
+	headerFormatSet bool
+	held            []*rtp.RtpPacket // packets held until header format is detected
+	timestamp       uint32           // of the last frame written
+	lastSeq         uint16
+	lastToc         byte
 }
 
 func NewEvs() Codec {
@@ -38,6 +65,9 @@ func (evs *Evs) Init() {
 func (evs *Evs) Reset() {
 	evs.started = false
 	evs.timestamp = 0
+	evs.lastSeq = 0
+	evs.lastToc = 0
+	evs.held = nil
 }
 
 func (evs Evs) GetFormatMagic() ([]byte, error) {
@@ -59,6 +89,7 @@ func (evs *Evs) SetOptions(options map[string]string) error {
 	}
 
 	evs.FullHeader = v == "1"
+	evs.headerFormatSet = v != "auto"
 
 	evs.configured = true
 	return nil
@@ -118,99 +149,241 @@ func realignOctet2(octet []byte) []byte {
 //section A.2.1 of 3GPP TS26.445 and section A.2.2 of 3GPP TS26.445
 //Iu Framing is not supported for the EVS codec
 func (evs *Evs) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
-
-	fmt.Println("HandleRtpPacket func started.. ")
+	log.Sdebug("decoding packet with sequence number %d", packet.SequenceNumber)
 
 	if !evs.configured {
 		return nil, evs.invalidState()
 	}
 
-	if !evs.FullHeader {
-		fmt.Println(evs.FullHeader)
-		switch iomode := IsIoMode(evs_payload_sizes, len(packet.Payload)); iomode {
-		case 0: // EVS Primary
-			fmt.Println("EVS")
-			result = append(result, toc[getIndex(evs_payload_sizes, len(packet.Payload))])
-			result = append(result, packet.Payload...)
+	if !evs.headerFormatSet {
+		return evs.detectHeaderFormat(packet)
+	}
 
-			//Debug
-			//fmt.Println("payload length: ", len(packet.Payload))
+	if evs.started && int16(packet.SequenceNumber-evs.lastSeq) <= 0 {
+		return nil, errors.New("ignore out of sequence")
+	}
 
-		case 1: // EVS-AMRWB IO
-			fmt.Println("EVS AMR-WB IO")
-			fmt.Println("payload length: ", len(packet.Payload))
+	var frames, tocs []byte
+	if evs.FullHeader {
+		frames, tocs, err = evs.handleHeaderFull(packet.Payload)
+	} else {
+		frames, err = evs.handleCompact(packet)
+		if len(frames) > 0 {
+			tocs = frames[:1]
+		}
+	}
+	if err != nil || len(tocs) == 0 {
+		return nil, err
+	}
 
-			buf := new(bytes.Buffer)
+	lostPackets := evs.started && packet.SequenceNumber != evs.lastSeq+1
+	result = append(evs.handleMissingFrames(packet.Timestamp, lostPackets), frames...)
+	evs.started = true
+	evs.timestamp = packet.Timestamp + uint32(len(tocs)-1)*EVS_SAMPLES_PER_FRAME
+	evs.lastSeq = packet.SequenceNumber
+	evs.lastToc = tocs[len(tocs)-1]
+
+	// result (evs-mime) can be decoded using 3GPP 26.443 EVS_dec binary
+	return result, nil
+}
 
-			// might be changed to this: https://pkg.go.dev/github.com/go-restruct/restruct#Unpack
+// detectHeaderFormat holds the first packets until the payload format describing most of them is chosen,
+// frames of all of them are returned then
+func (evs *Evs) detectHeaderFormat(packet *rtp.RtpPacket) ([]byte, error) {
+	evs.held = append(evs.held, packet)
+	if len(evs.held) < DetectPackets {
+		return nil, nil
+	}
+	return evs.releaseHeld(), nil
+}
 
-			_ = binary.Write(buf, binary.BigEndian, toc[getIndex(evs_payload_sizes, len(packet.Payload))])
+func (evs *Evs) releaseHeld() (result []byte) {
+	compact, headerFull := 0, 0
+	for _, packet := range evs.held {
+		c, f := evsPayloadFormats(packet.Payload)
+		if c {
+			compact++
+		}
+		if f {
+			headerFull++
+		}
+	}
+	// Compact Format is the default one, TS 26.445 A.3
+	evs.FullHeader, evs.headerFormatSet = headerFull > compact, true
+	if evs.FullHeader {
+		log.Info("detected EVS Header-Full format")
+	} else {
+		log.Info("detected EVS Compact format")
+	}
 
-			result = append(result, buf.Bytes()...)
-			result = append(result, realignOctet2(packet.Payload)...)
-
-			//Debug
-			//fmt.Println("eredeti:", (packet.Payload))
-			//fmt.Println("payload length: ", len(packet.Payload))
-
-			const AMR_WB_MAGIC string = "#!AMR-WB\n"
-			//fmt.Println("dumped to file: ")
-
-			for _, s := range result {
-				fmt.Printf("%x", s)
-				fmt.Print(" ")
-			}
-			fmt.Println()
-
-		case 2: //Ambigous case
-			fmt.Println("Ambigous case")
-			bit0 := (packet.Payload[0] & 0xff) >> 7
-			if bit0 == 0 { //EVS Primary 2.8kbps
-				fmt.Println("EVS Primary 2.8kbps")
-				fmt.Println("payload length: ", len(packet.Payload))
-				result = append(result, toc[1])
-				result = append(result, packet.Payload...)
-			} else { //EVS AMRWB IO SID
-				fmt.Println("EVS AMRWB IO SID Silence Insertion Descriptor in header-full with one CMR byte")
-
-				buf := new(bytes.Buffer)
-
-				result = append(result, 0x39)
-				_ = binary.Write(buf, binary.BigEndian, packet.Payload[2:])
-				result = append(result, buf.Bytes()...)
-
-				for _, s := range result {
-					fmt.Printf("%x", s)
-					fmt.Print(" ")
-				}
-				fmt.Println()
-			}
-		default:
-			fmt.Println("other payload size found than EVS or it is in Header-Full Format")
+	held := evs.held
+	evs.held = nil
+	for _, packet := range held {
+		frames, err := evs.HandleRtpPacket(packet)
+		if err != nil {
+			log.Sdebug("packet with sequence number %d: %s", packet.SequenceNumber, err)
+			continue
 		}
-	} else { // Header-Full Format, ToC + Single Speech Frame
-		bit0 := (packet.Payload[0] & 0xff) >> 7 //CMR?  >0<|1|2|3|4|5|6|7|
-		bit1 := (packet.Payload[0] & 0x40) >> 6 //next speech frame?  0|>1<|2|3|4|5|6|7|
-		buf := new(bytes.Buffer)
-		if bit0 == 1 { //CMR
-			fmt.Println("CMR+ToC single or multiframe, not supported yet")
-			//if nextbyte.bit1 == 1 { //more ToC, more speech frame
-			//} else {
-			//}
-		} else { //ToC
-			if bit1 == 0 { // no more speechframe (ToC+singleframe)
-				fmt.Println("ToC+single frame")
-				result = append(result, packet.Payload[0]&0xf)
-				_ = binary.Write(buf, binary.BigEndian, packet.Payload[1:])
-				result = append(result, buf.Bytes()...)
-			}
+		result = append(result, frames...)
+	}
+	return result
+}
+
+//Flush returns frames of packets held while the header format is detected
+func (evs *Evs) Flush() []byte {
+	if evs.headerFormatSet {
+		return nil
+	}
+	return evs.releaseHeld()
+}
+
+// evsPayloadFormats returns whether payload has a Compact Format size and whether its Header-Full ToC
+// list describes it, Header-Full payloads are padded with zeros if their size is a Compact one
+func evsPayloadFormats(payload []byte) (compact bool, headerFull bool) {
+	compact = getIndex(evs_payload_sizes, len(payload)) >= 0
+	frames, _, err := (&Evs{}).handleHeaderFull(payload)
+	if err != nil {
+		return compact, false
+	}
+	length := len(frames)
+	if payload[0]&evsHeaderBit != 0 {
+		length++
+	}
+	for _, b := range payload[length:] {
+		if b != 0 {
+			return compact, false
 		}
 	}
+	return compact, true
+}
 
-	// result (evs-mime) can be decoded using 3GPP 26.443 EVS_dec binary
+// handleMissingFrames returns a ToC for every frame missing before timestamp, so the decoded audio keeps
+// its duration, frames not sent during DTX are NO_DATA, frames of lost packets are SPEECH_LOST so the
+// decoder conceals them, unless they were lost during DTX
+func (evs *Evs) handleMissingFrames(timestamp uint32, lostPackets bool) (result []byte) {
+	if !evs.started || int32(timestamp-evs.timestamp) <= 0 {
+		return nil
+	}
+	missing := (timestamp-evs.timestamp)/EVS_SAMPLES_PER_FRAME - 1
+	log.Sdebug("missing frames: %d, time: %d, packets lost: %t", missing, missing*20, lostPackets)
+
+	toc := byte(evsNoData)
+	if lostPackets && !evs.inDtx() {
+		toc = evs.lastToc&evsModeBit | evsSpeechLost
+	}
+	for i := uint32(0); i < missing; i++ {
+		result = append(result, toc)
+	}
+	return result
+}
+
+// inDtx returns true if the last frame was SID or NO_DATA
+func (evs *Evs) inDtx() bool {
+	index := evs.lastToc & 0x0F
+	if evs.lastToc&evsModeBit != 0 {
+		return index == 9 || index == evsNoData
+	}
+	return index == 12 || index == evsNoData
+}
+
+// handleCompact converts a Compact Format payload, a single frame without header, section A.2.1
+func (evs *Evs) handleCompact(packet *rtp.RtpPacket) (result []byte, err error) {
+	switch iomode := IsIoMode(evs_payload_sizes, len(packet.Payload)); iomode {
+	case 0: // EVS Primary
+		log.Sdebug("EVS Primary, payload length: %d", len(packet.Payload))
+		result = append(result, toc[getIndex(evs_payload_sizes, len(packet.Payload))])
+		result = append(result, packet.Payload...)
+
+	case 1: // EVS-AMRWB IO
+		log.Sdebug("EVS AMR-WB IO, payload length: %d", len(packet.Payload))
+
+		buf := new(bytes.Buffer)
+
+		// might be changed to this: https://pkg.go.dev/github.com/go-restruct/restruct#Unpack
+
+		_ = binary.Write(buf, binary.BigEndian, toc[getIndex(evs_payload_sizes, len(packet.Payload))])
+
+		result = append(result, buf.Bytes()...)
+		result = append(result, realignOctet2(packet.Payload)...)
+		log.Sdebug("EVS AMR-WB IO frame: % x", result)
+
+	case 2: //Ambigous case
+		bit0 := (packet.Payload[0] & 0xff) >> 7
+		if bit0 == 0 { //EVS Primary 2.8kbps
+			log.Sdebug("EVS Primary 2.8kbps, payload length: %d", len(packet.Payload))
+			result = append(result, toc[1])
+			result = append(result, packet.Payload...)
+		} else { //EVS AMRWB IO SID
+			log.Sdebug("EVS AMR-WB IO SID in Header-Full Format with one CMR byte")
+
+			buf := new(bytes.Buffer)
+
+			result = append(result, 0x39)
+			_ = binary.Write(buf, binary.BigEndian, packet.Payload[2:])
+			result = append(result, buf.Bytes()...)
+			log.Sdebug("EVS AMR-WB IO SID frame: % x", result)
+		}
+	default:
+		log.Sdebug("payload length %d is not of an EVS Compact Format frame", len(packet.Payload))
+	}
 	return result, nil
 }
 
+// handleHeaderFull converts a Header-Full Format payload, an optional CMR byte followed by ToC entries and
+// their frames in the same order, section A.2.2, every frame is written with its ToC as in evs-mime,
+// ToCs are returned as well
+func (evs *Evs) handleHeaderFull(payload []byte) (result []byte, tocs []byte, err error) {
+	// CMR := [H=1][T(3bit)][D(4bit)]
+	// ToC := [H=0][F][EVS mode bit][Q, 0 for EVS Primary][bit rate index(4bit)]
+	// storage := ToC with F=0, followed by the frame
+	pos := 0
+	if len(payload) > 0 && payload[0]&evsHeaderBit != 0 {
+		log.Sdebug("header-full, cmr type:%d, cmr:%d", (payload[0]>>4)&0x07, payload[0]&0x0F)
+		pos++
+	}
+
+	for more := true; more; pos++ {
+		if pos >= len(payload) {
+			return nil, nil, errors.New("EVS ToC truncated")
+		}
+		if payload[pos]&evsHeaderBit != 0 {
+			return nil, nil, errors.New("EVS CMR where ToC is expected")
+		}
+		more = payload[pos]&evsFollowBit != 0
+		tocs = append(tocs, payload[pos]&evsFrameTypeMask)
+	}
+
+	for _, t := range tocs {
+		size, err := evsFrameSize(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pos+size > len(payload) {
+			return nil, nil, errors.New("EVS speech frame truncated")
+		}
+		log.Sdebug("header-full, amr-wb io:%t, bit rate index:%d, frame size:%d", t&evsModeBit != 0, t&0x0F, size)
+		result = append(result, t)
+		result = append(result, payload[pos:pos+size]...)
+		pos += size
+	}
+	return result, tocs, nil
+}
+
+// evsFrameSize returns frame size in bytes of a Header-Full ToC, AMR-WB IO frames are padded to octets
+func evsFrameSize(toc byte) (int, error) {
+	index := toc & 0x0F
+	if toc&evsModeBit != 0 {
+		if index >= 10 && index <= 13 {
+			return 0, fmt.Errorf("reserved EVS AMR-WB IO bit rate index %d", index)
+		}
+		return EVS_AMRWB_IO_FRAME_SIZES[index], nil
+	}
+	if index == 13 {
+		return 0, fmt.Errorf("reserved EVS Primary bit rate index %d", index)
+	}
+	return EVS_PRIMARY_FRAME_SIZES[index], nil
+}
+
 // Options
 var EvsMetadata = CodecMetadata{
 	Name:     "evs",
@@ -225,7 +398,7 @@ var EvsHeaderFormatOption = CodecOption{
 	Required:         true,
 	Name:             "header-format",
 	Description:      "whether the RTP payload consists of exactly one coded frame (Compact Format) or the payload consists of one or more coded frame(s) with EVS RTP payload header(s)",
-	ValidValues:      []string{"0", "1"},
-	ValueDescription: []string{"Compact Format", "Header-Full Format (only single ToC + single frame supported yet)"},
+	ValidValues:      []string{"0", "1", "auto"},
+	ValueDescription: []string{"Compact Format", "Header-Full Format", "Detect automatically"},
 	RestrictValues:   true,
 }
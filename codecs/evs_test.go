@@ -0,0 +1,182 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/david-biro/rtpdump/rtp"
+)
+
+// evsFrame returns frame of size bytes with recognizable content
+func evsFrame(size int, seed byte) []byte {
+	frame := make([]byte, size)
+	for i := range frame {
+		frame[i] = seed + byte(i)
+	}
+	return frame
+}
+
+func join(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func newTestEvs(t *testing.T, headerFormat string) *Evs {
+	t.Helper()
+	evs := NewEvs().(*Evs)
+	if err := evs.SetOptions(map[string]string{"header-format": headerFormat}); err != nil {
+		t.Fatal(err)
+	}
+	return evs
+}
+
+func TestEvsHandleHeaderFull(t *testing.T) {
+	f33, f20, f32, sid := evsFrame(33, 0x10), evsFrame(20, 0x60), evsFrame(32, 0xA0), evsFrame(6, 0xE0)
+	tests := []struct {
+		name    string
+		payload []byte
+		result  []byte
+		tocs    []byte
+		err     bool
+	}{
+		{"single frame", join([]byte{0x04}, f33), join([]byte{0x04}, f33), []byte{0x04}, false},
+		{"cmr", join([]byte{0x84, 0x04}, f33), join([]byte{0x04}, f33), []byte{0x04}, false},
+		{"chained tocs", join([]byte{0x44, 0x42, 0x0C}, f33, f20, sid), join([]byte{0x04}, f33, []byte{0x02}, f20, []byte{0x0C}, sid),
+			[]byte{0x04, 0x02, 0x0C}, false},
+		{"evs primary and amr-wb io", join([]byte{0xF4, 0x44, 0x22}, f33, f32), join([]byte{0x04}, f33, []byte{0x22}, f32),
+			[]byte{0x04, 0x22}, false},
+		{"no data", []byte{0x0F}, []byte{0x0F}, []byte{0x0F}, false},
+		{"amr-wb io speech lost", []byte{0x2E}, []byte{0x2E}, []byte{0x2E}, false},
+		{"reserved evs primary index", join([]byte{0x0D}, f33), nil, nil, true},
+		{"reserved amr-wb io index", join([]byte{0x2A}, f33), nil, nil, true},
+		{"reserved amr-wb io index 13", join([]byte{0x44, 0x2D}, f33), nil, nil, true},
+		{"toc truncated", []byte{0x84, 0x44}, nil, nil, true},
+		{"cmr instead of toc", join([]byte{0x84, 0x84}, f33), nil, nil, true},
+		{"frame truncated", join([]byte{0x04}, f20), nil, nil, true},
+		{"empty", nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		result, tocs, err := (&Evs{}).handleHeaderFull(tt.payload)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(result, tt.result) || !bytes.Equal(tocs, tt.tocs) {
+			t.Errorf("%s: got %x with tocs %x, want %x with tocs %x", tt.name, result, tocs, tt.result, tt.tocs)
+		}
+	}
+}
+
+// frame sizes of Tables A.4 and A.5 of 3GPP TS 26.445, AMR-WB IO frames are padded to octets
+func TestEvsFrameSize(t *testing.T) {
+	tests := []struct {
+		toc  byte
+		size int
+		err  bool
+	}{
+		{0x00, 7, false},  // 2.8 kbps primary
+		{0x04, 33, false}, // 13.2 kbps
+		{0x0B, 320, false},
+		{0x0C, 6, false}, // SID
+		{0x0D, 0, true},
+		{0x0E, 0, false},
+		{0x0F, 0, false},
+		{0x20, 17, false}, // 6.6 kbps AMR-WB IO
+		{0x28, 60, false},
+		{0x29, 5, false}, // AMR-WB IO SID
+		{0x2A, 0, true},
+		{0x2D, 0, true},
+		{0x2E, 0, false},
+		{0x2F, 0, false},
+	}
+	for _, tt := range tests {
+		size, err := evsFrameSize(tt.toc)
+		if size != tt.size || (err != nil) != tt.err {
+			t.Errorf("toc 0x%02X: got %d, %v, want %d, error %t", tt.toc, size, err, tt.size, tt.err)
+		}
+	}
+}
+
+func TestEvsPayloadFormats(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		compact    bool
+		headerFull bool
+	}{
+		{"compact 13.2 kbps", bytes.Repeat([]byte{0xFF}, 33), true, false},
+		{"compact amr-wb io 6.6 kbps", evsFrame(17, 0x90), true, false},
+		{"header-full", join([]byte{0x04}, evsFrame(33, 0x10)), false, true},
+		{"header-full with cmr", join([]byte{0x84, 0x04}, evsFrame(33, 0x10)), false, true},
+		{"header-full padded", join([]byte{0x0C}, evsFrame(6, 0xE0), []byte{0, 0}), false, true},
+		{"trailing data", join([]byte{0x0C}, evsFrame(6, 0xE0), []byte{0, 1}), false, false},
+		// a SID with its ToC has the size of a Compact 2.8 kbps frame
+		{"both", join([]byte{0x0C}, evsFrame(6, 0xE0)), true, true},
+	}
+	for _, tt := range tests {
+		compact, headerFull := evsPayloadFormats(tt.payload)
+		if compact != tt.compact || headerFull != tt.headerFull {
+			t.Errorf("%s: got compact %t, header-full %t, want %t, %t", tt.name, compact, headerFull, tt.compact, tt.headerFull)
+		}
+	}
+}
+
+// frames missing between packets are NO_DATA when not sent during DTX, and SPEECH_LOST when packets
+// carrying speech were lost
+func TestEvsHandleMissingFrames(t *testing.T) {
+	speech, io, sid := join([]byte{0x04}, evsFrame(33, 0x10)), join([]byte{0x22}, evsFrame(32, 0xA0)), join([]byte{0x0C}, evsFrame(6, 0xE0))
+	tests := []struct {
+		name      string
+		first     []byte
+		seq       uint16
+		timestamp uint32
+		missing   []byte
+	}{
+		{"in sequence", speech, 2, 320, nil},
+		{"dtx", sid, 2, 8 * 320, bytes.Repeat([]byte{evsNoData}, 7)},
+		{"lost speech", speech, 4, 3 * 320, []byte{evsSpeechLost, evsSpeechLost}},
+		{"lost amr-wb io speech", io, 3, 2 * 320, []byte{evsModeBit | evsSpeechLost}},
+		{"lost during dtx", sid, 3, 8 * 320, bytes.Repeat([]byte{evsNoData}, 7)},
+		{"timestamp gap without loss", speech, 2, 3 * 320, []byte{evsNoData, evsNoData}},
+		{"two frames per packet", join([]byte{0x44}, speech, evsFrame(33, 0x10)), 2, 2 * 320, nil},
+	}
+	for _, tt := range tests {
+		evs := newTestEvs(t, "1")
+		if _, err := evs.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 1, Payload: tt.first}); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		result, err := evs.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: tt.seq, Timestamp: tt.timestamp, Payload: speech})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if want := join(tt.missing, speech); !bytes.Equal(result, want) {
+			t.Errorf("%s: got %x, want %x", tt.name, result, want)
+		}
+	}
+}
+
+// packets are held until the payload format is detected, then all of them are converted
+func TestEvsDetectHeaderFormat(t *testing.T) {
+	evs := newTestEvs(t, "auto")
+	frame := join([]byte{0x04}, evsFrame(33, 0x10))
+	var result []byte
+	for seq := uint16(1); seq <= DetectPackets; seq++ {
+		out, err := evs.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: seq, Timestamp: uint32(seq) * 320, Payload: frame})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq < DetectPackets && out != nil {
+			t.Fatalf("packet %d: got frames before the format was detected", seq)
+		}
+		result = append(result, out...)
+	}
+	if !evs.FullHeader {
+		t.Error("got Compact Format, want Header-Full")
+	}
+	if want := bytes.Repeat(frame, DetectPackets); !bytes.Equal(result, want) {
+		t.Errorf("got %d bytes, want %d", len(result), len(want))
+	}
+}
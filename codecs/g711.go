@@ -0,0 +1,217 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/rtp"
+)
+
+const G711_SAMPLE_RATE = 8000
+
+// static payload types of G.711, RFC 3551
+const (
+	PCMU_PAYLOAD_TYPE = 0
+	PCMA_PAYLOAD_TYPE = 8
+)
+
+const WAV_HEADER_SIZE = 44
+
+// timestamp gaps longer than this aren't filled with silence, they're rather a timestamp jump than lost packets
+const g711MaxGap = 10 * 60 * G711_SAMPLE_RATE
+
+// linear values of every µ-law and A-law code, ITU-T G.711
+var ulawTable = g711Table(ulawToLinear)
+var alawTable = g711Table(alawToLinear)
+
+type G711 struct {
+	started     bool
+	configured  bool
+	aLaw        bool
+	lawSet      bool
+	payloadType int
+	timestamp   uint32 // expected timestamp of the next packet
+	lastSeq     uint16
+}
+
+func NewG711() Codec {
+	return &G711{started: false, configured: false, timestamp: 0}
+}
+
+func (g *G711) Init() {
+}
+
+func (g *G711) Reset() {
+	g.started = false
+	g.timestamp = 0
+	g.lastSeq = 0
+}
+
+//GetFormatMagic returns WAV header of 16 bit mono PCM with no data, UpdateHeader has the final lengths
+func (g G711) GetFormatMagic() ([]byte, error) {
+	return wavHeader(0), nil
+}
+
+//UpdateHeader returns WAV header of dataLength bytes of samples
+func (g *G711) UpdateHeader(dataLength int64) []byte {
+	return wavHeader(dataLength)
+}
+
+func (g *G711) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (g *G711) SetOptions(options map[string]string) error {
+	if g.started {
+		return g.invalidState()
+	}
+
+	switch options["law"] {
+	case "mu":
+		g.aLaw, g.lawSet = false, true
+	case "a":
+		g.aLaw, g.lawSet = true, true
+	default:
+		g.lawSet = false
+	}
+
+	g.configured = true
+	return nil
+}
+
+func (g *G711) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !g.configured {
+		return nil, g.invalidState()
+	}
+
+	log.Sdebug("decoding packet with sequence number %d", packet.SequenceNumber)
+	if !g.started {
+		if !g.lawSet {
+			// law is known from static payload type, packets before the first G.711 one are skipped
+			switch packet.PayloadType {
+			case PCMU_PAYLOAD_TYPE:
+				g.aLaw = false
+			case PCMA_PAYLOAD_TYPE:
+				g.aLaw = true
+			default:
+				log.Sdebug("skipping payload type %d before G.711", packet.PayloadType)
+				return nil, nil
+			}
+		}
+		g.payloadType = packet.PayloadType
+	} else {
+		// e.g. comfort noise or RFC 2833 events, the timestamp gap they leave is filled with silence
+		if packet.PayloadType != g.payloadType {
+			log.Sdebug("skipping payload type %d", packet.PayloadType)
+			return nil, nil
+		}
+		if int16(packet.SequenceNumber-g.lastSeq) <= 0 {
+			return nil, errors.New("ignore out of sequence")
+		}
+	}
+
+	result = g.handleMissingSamples(packet.Timestamp)
+	table := ulawTable
+	if g.aLaw {
+		table = alawTable
+	}
+	for _, code := range packet.Payload {
+		result = append(result, byte(table[code]), byte(uint16(table[code])>>8))
+	}
+
+	g.started = true
+	g.timestamp = packet.Timestamp + uint32(len(packet.Payload))
+	g.lastSeq = packet.SequenceNumber
+	return result, nil
+}
+
+// handleMissingSamples returns silence for samples missing before timestamp
+func (g *G711) handleMissingSamples(timestamp uint32) []byte {
+	if !g.started {
+		return nil
+	}
+	missing := int32(timestamp - g.timestamp)
+	if missing <= 0 {
+		return nil
+	}
+	if missing > g711MaxGap {
+		log.Swarn("timestamp jumped by %d samples, not filled with silence", missing)
+		return nil
+	}
+	log.Sdebug("missing samples: %d, time: %d", missing, missing/(G711_SAMPLE_RATE/1000))
+	return make([]byte, 2*missing)
+}
+
+func wavHeader(dataLength int64) []byte {
+	header := make([]byte, WAV_HEADER_SIZE)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataLength))
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)                 // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:], 1)                  // PCM
+	binary.LittleEndian.PutUint16(header[22:], 1)                  // channels
+	binary.LittleEndian.PutUint32(header[24:], G711_SAMPLE_RATE)   // sample rate
+	binary.LittleEndian.PutUint32(header[28:], G711_SAMPLE_RATE*2) // byte rate
+	binary.LittleEndian.PutUint16(header[32:], 2)                  // block align
+	binary.LittleEndian.PutUint16(header[34:], 16)                 // bits per sample
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataLength))
+	return header
+}
+
+func g711Table(decode func(code byte) int16) (table [256]int16) {
+	for i := range table {
+		table[i] = decode(byte(i))
+	}
+	return table
+}
+
+func ulawToLinear(code byte) int16 {
+	code = ^code
+	t := (int16(code&0x0F) << 3) + 0x84
+	t <<= (code & 0x70) >> 4
+	if code&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+func alawToLinear(code byte) int16 {
+	code ^= 0x55
+	t := int16(code&0x0F) << 4
+	switch segment := (code & 0x70) >> 4; segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if code&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+// Options
+var G711Metadata = CodecMetadata{
+	Name:      "g711",
+	LongName:  "G.711 PCMU/PCMA, written as 16 bit PCM WAV",
+	Extension: "wav",
+	Options: []CodecOption{
+		g711LawOption,
+	},
+	Init: NewG711,
+}
+
+var g711LawOption = CodecOption{
+	Required:         false,
+	Name:             "law",
+	Description:      "companding law of the samples",
+	ValidValues:      []string{"mu", "a", "auto"},
+	ValueDescription: []string{"µ-law (PCMU)", "A-law (PCMA)", "Detect from payload type 0 or 8"},
+	RestrictValues:   true,
+}
@@ -0,0 +1,120 @@
+package codecs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/david-biro/rtpdump/rtp"
+)
+
+// values of ITU-T G.711 tables 1a and 2a, decoded to 16 bit
+func TestG711ToLinear(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(byte) int16
+		code   byte
+		want   int16
+	}{
+		{"ulaw", ulawToLinear, 0x00, -32124},
+		{"ulaw", ulawToLinear, 0x80, 32124},
+		{"ulaw", ulawToLinear, 0x7F, 0},
+		{"ulaw", ulawToLinear, 0xFF, 0},
+		{"ulaw", ulawToLinear, 0xF0, 120},
+		{"ulaw", ulawToLinear, 0x70, -120},
+		{"alaw", alawToLinear, 0xD5, 8},
+		{"alaw", alawToLinear, 0x55, -8},
+		{"alaw", alawToLinear, 0x2A, -32256},
+		{"alaw", alawToLinear, 0xAA, 32256},
+		{"alaw", alawToLinear, 0xC5, 264},
+	}
+	for _, tt := range tests {
+		if got := tt.decode(tt.code); got != tt.want {
+			t.Errorf("%s 0x%02X: got %d, want %d", tt.name, tt.code, got, tt.want)
+		}
+	}
+	// codes differing in the sign bit only decode to opposite values
+	for code := 0; code < 256; code++ {
+		if ulawTable[code] != -ulawTable[code^0x80] || alawTable[code] != -alawTable[code^0x80] {
+			t.Errorf("0x%02X: got %d and %d, not symmetric", code, ulawTable[code], alawTable[code])
+		}
+	}
+}
+
+func TestWavHeader(t *testing.T) {
+	for _, length := range []int64{0, 320, 1 << 20} {
+		header := wavHeader(length)
+		if len(header) != WAV_HEADER_SIZE || string(header[0:4]) != "RIFF" || string(header[36:40]) != "data" {
+			t.Fatalf("got header %x", header)
+		}
+		if riff, data := binary.LittleEndian.Uint32(header[4:]), binary.LittleEndian.Uint32(header[40:]); riff != uint32(36+length) || data != uint32(length) {
+			t.Errorf("data length %d: got RIFF length %d, data length %d", length, riff, data)
+		}
+	}
+}
+
+// samples missing before a packet are filled with silence, also those of packets of other payload types
+func TestG711MissingSamples(t *testing.T) {
+	tests := []struct {
+		name        string
+		seq         uint16
+		timestamp   uint32
+		payloadType int
+		silence     int // bytes
+	}{
+		{"in sequence", 2, 160, 0, 0},
+		{"lost packet", 3, 320, 0, 320},
+		{"lost packets", 5, 640, 0, 960},
+		{"telephone event skipped", 3, 320, 101, -1},
+		{"timestamp jump", 3, 160 + g711MaxGap + 1, 0, 0},
+	}
+	payload := bytes.Repeat([]byte{0xFF}, 160)
+	for _, tt := range tests {
+		g := NewG711().(*G711)
+		if err := g.SetOptions(map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 1, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := g.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: tt.seq, Timestamp: tt.timestamp, PayloadType: tt.payloadType, Payload: payload})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if tt.silence < 0 {
+			if result != nil {
+				t.Errorf("%s: got %d bytes, want none", tt.name, len(result))
+			}
+			continue
+		}
+		if want := make([]byte, tt.silence+2*len(payload)); !bytes.Equal(result, want) {
+			t.Errorf("%s: got %d bytes, want %d bytes of silence and %d of samples", tt.name, len(result), tt.silence, 2*len(payload))
+		}
+	}
+}
+
+// law comes from the static payload type unless configured, packets before the first G.711 one are skipped
+func TestG711Law(t *testing.T) {
+	tests := []struct {
+		law         string
+		payloadType int
+		code        byte
+		want        []byte
+	}{
+		{"", PCMU_PAYLOAD_TYPE, 0x80, []byte{0x7C, 0x7D}},
+		{"", PCMA_PAYLOAD_TYPE, 0xD5, []byte{0x08, 0x00}},
+		{"", 13, 0xD5, nil},
+		{"a", 96, 0x2A, []byte{0x00, 0x82}},
+		{"mu", 96, 0x00, []byte{0x84, 0x82}},
+	}
+	for _, tt := range tests {
+		g := NewG711().(*G711)
+		if err := g.SetOptions(map[string]string{"law": tt.law}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := g.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 1, PayloadType: tt.payloadType, Payload: []byte{tt.code}})
+		if err != nil || !bytes.Equal(result, tt.want) {
+			t.Errorf("law %q payload type %d: got %x, %v, want %x", tt.law, tt.payloadType, result, err, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/david-biro/rtpdump/codecs"
 	"github.com/david-biro/rtpdump/log"
@@ -13,26 +14,96 @@ import (
 	"github.com/urfave/cli"
 )
 
-type dumpOptions struct {
-	codecMetadata codecs.CodecMetadata
-	rtpStreams    []*rtp.RtpStream
-	streamIndex   int
-	options       map[string]string
-	outputFile    string
-}
-
 var dumpCmd = func(c *cli.Context) error {
 	loadKeyFile(c)
 
-	inputFile := c.Args().First()
-	if inputFile == "" {
+	inputFiles := captureFiles(c)
+	if len(inputFiles) == 0 {
 		cli.ShowCommandHelp(c, "dump")
 		return cli.NewExitError("wrong usage for dump", 1)
 	}
 
+	codecMetadata, optionsMap, err := parseCodecFlags(c)
+	if err != nil {
+		return err
+	}
+
+	// get and validate stream index
+	streamIndex := c.Int("stream")
+	if streamIndex < 1 && streamIndex != -1 {
+		return cli.NewExitError("invalid stream index", 1)
+	}
+
+	// streams of a call are only known once the whole capture was read
+	var callStreams []int
+	if c.IsSet("call") {
+		if streamIndex != -1 {
+			return cli.NewExitError("stream and call can't be selected together", 1)
+		}
+		if callStreams, err = callStreamIndexes(c, inputFiles, c.Int("call")); err != nil {
+			return err
+		}
+	}
+
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+	}
+	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
+
+	// packets are decoded and written while the file is read, streams don't keep them
+	rtpReader.KeepPackets(false)
+	pipeline := newDumpPipeline(codecMetadata, optionsMap, c.String("output"), streamIndex)
+	if !c.IsSet("codec") {
+		pipeline.useSdpFormats(!c.IsSet("output"))
+	} else if codecMetadata.Name == autoCodec {
+		pipeline.detectCodecs(!c.IsSet("output"))
+	}
+	if callStreams != nil {
+		pipeline.selectStreams(callStreams)
+	}
+	pipeline.attach(rtpReader, func(index int, stream *rtp.RtpStream) {
+		log.Info(fmt.Sprintf("dumping %d", index))
+	})
+	rtpStreams := rtpReader.GetStreams()
+	pipeline.close()
+
+	if len(rtpStreams) <= 0 {
+		fmt.Println("no streams found")
+		return nil
+	}
+	if streamIndex > len(rtpStreams) {
+		return cli.NewExitError("stream with specified index doesn't exist", 1)
+	}
+	if callStreams != nil {
+		log.Info(fmt.Sprintf("dumped %d streams of call %d", len(callStreams), c.Int("call")))
+	} else if streamIndex == -1 {
+		log.Info(fmt.Sprintf("dumped %d streams", len(rtpStreams)))
+	} else if pipeline.failed() {
+		return cli.NewExitError("failed to decode stream", 1)
+	}
+	return nil
+}
+
+// autoCodec is the "codec" flag value choosing codec of every stream from SDP, payload type and payloads
+const autoCodec = "auto"
+
+// parseCodecFlags finds codec selected by "codec" flag and validates options from "flags" flag,
+// codec is only named if it's detected per stream
+func parseCodecFlags(c *cli.Context) (codecs.CodecMetadata, map[string]string, error) {
+	codecName := c.String("codec")
+	if codecName == autoCodec {
+		if c.IsSet("flags") {
+			return codecs.CodecMetadata{}, nil, cli.NewExitError("codec options can't be set when codec is detected", 1)
+		}
+		return codecs.CodecMetadata{Name: autoCodec}, nil, nil
+	}
+
 	// find codec in codecs.CodecList and get CodecMetadata
 	codecIndex := -1
-	codecName := c.String("codec")
 	for index, codec := range codecs.CodecList {
 		if codec.Name == codecName {
 			codecIndex = index
@@ -40,7 +111,7 @@ var dumpCmd = func(c *cli.Context) error {
 		}
 	}
 	if codecIndex == -1 {
-		return cli.NewExitError("invalid codec name, see available codecs using \"codecs list\" command", 1)
+		return codecs.CodecMetadata{}, nil, cli.NewExitError("invalid codec name, see available codecs using \"codecs list\" command", 1)
 	}
 	codecMetadata := codecs.CodecList[codecIndex]
 
@@ -57,8 +128,8 @@ var dumpCmd = func(c *cli.Context) error {
 	for _, option := range options {
 		values := strings.Split(option, ":")
 		if len(values) != 2 {
-			cli.ShowCommandHelp(c, "dump")
-			return cli.NewExitError("invalid flag value", 1)
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return codecMetadata, nil, cli.NewExitError("invalid flag value", 1)
 		}
 		if validValues, ok := codecOptions[values[0]]; ok {
 			for _, validValue := range validValues { // validate option value
@@ -67,113 +138,336 @@ var dumpCmd = func(c *cli.Context) error {
 					goto next
 				}
 			}
-			return cli.NewExitError("invalid value '"+values[1]+"' for option '"+values[0]+"', valid values: ["+strings.Join(validValues, ", ")+"]", 1)
+			return codecMetadata, nil, cli.NewExitError("invalid value '"+values[1]+"' for option '"+values[0]+"', valid values: ["+strings.Join(validValues, ", ")+"]", 1)
 		}
-		return cli.NewExitError("unknown option '"+values[0]+"', see available options and valid values using \"codecs list\" command", 1)
+		return codecMetadata, nil, cli.NewExitError("unknown option '"+values[0]+"', see available options and valid values using \"codecs list\" command", 1)
 	next:
 	}
+	if err := codecMetadata.Init().SetOptions(optionsMap); err != nil {
+		return codecMetadata, nil, err
+	}
+	return codecMetadata, optionsMap, nil
+}
 
-	// get and validate stream index
-	streamIndex := c.Int("stream")
-	if streamIndex < 1 && streamIndex != -1 {
-		return cli.NewExitError("invalid stream index", 1)
+// streams not receiving packets for this long (in capture time) get their output file closed
+const streamIdleTimeout = 30 * time.Second
+
+// dumpPipeline dumps streams while packets are read, holding only codec state
+// and an output file per active stream, instead of every packet in memory
+type dumpPipeline struct {
+	codecMetadata codecs.CodecMetadata
+	options       map[string]string
+	outputFile    string
+	streamIndex   int
+	streams       map[*rtp.RtpStream]*pipelineStream
+	count         int
+	lastIdleCheck time.Time
+	errors        int
+	// codec and options come from SDP of streams linked to a call
+	sdpFormats      bool
+	codecExtensions bool
+	// codec and options are detected from the first packets of streams without SDP
+	detect bool
+	// indexes of streams dumped when not all streams are
+	selected map[int]bool
+}
+
+type pipelineStream struct {
+	index    int
+	stream   *rtp.RtpStream
+	dumper   *streamDumper
+	lastSeen time.Time
+	// packets held until codec is detected
+	detecting bool
+	pending   []*rtp.RtpPacket
+}
+
+// newDumpPipeline dumps only the stream with given index or all streams if index is -1,
+// using output file as a base name
+func newDumpPipeline(codecMetadata codecs.CodecMetadata, options map[string]string, outputFile string, streamIndex int) *dumpPipeline {
+	return &dumpPipeline{
+		codecMetadata: codecMetadata,
+		options:       options,
+		outputFile:    outputFile,
+		streamIndex:   streamIndex,
+		streams:       make(map[*rtp.RtpStream]*pipelineStream),
 	}
+}
 
-	// read RTP packets and find streams
-	rtpReader, err := rtp.NewRtpReader(inputFile)
-	if err != nil {
-		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+// useSdpFormats makes streams with payload format known from SDP use the matching codec and options,
+// streams with formats no codec handles are skipped, output extension is changed to codec name if set
+func (p *dumpPipeline) useSdpFormats(codecExtensions bool) {
+	p.sdpFormats = true
+	p.codecExtensions = codecExtensions
+}
+
+// detectCodecs makes streams use codec and options chosen by codecs.Detect, from SDP if known, or from
+// payload type and payloads of their first packets, streams no codec is found for are skipped
+func (p *dumpPipeline) detectCodecs(codecExtensions bool) {
+	p.useSdpFormats(codecExtensions)
+	p.detect = true
+}
+
+// selectStreams dumps only streams with given indexes, each to its own file
+func (p *dumpPipeline) selectStreams(indexes []int) {
+	p.selected = make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		p.selected[index] = true
 	}
-	defer rtpReader.Close()
+}
 
-	rtpStreams := rtpReader.GetStreams()
-	if len(rtpStreams) <= 0 {
-		fmt.Println("no streams found")
-		return nil
+func (p *dumpPipeline) fileName(index int, codecMetadata codecs.CodecMetadata) string {
+	extension := filepath.Ext(p.outputFile)
+	baseName := p.outputFile[:len(p.outputFile)-len(extension)]
+	if p.codecExtensions {
+		extension = "." + codecMetadata.FileExtension()
 	}
-	if streamIndex > len(rtpStreams) {
-		return cli.NewExitError("stream with specified index doesn't exist", 1)
+	if p.streamIndex != -1 {
+		return baseName + extension
 	}
+	return baseName + "_s" + strconv.Itoa(index) + extension
+}
 
-	return doDump(dumpOptions{
-		codecMetadata: codecMetadata,
-		rtpStreams:    rtpStreams,
-		streamIndex:   streamIndex,
-		options:       optionsMap,
-		outputFile:    c.String("output"),
+// attach registers reader handlers, onStream is called with index of every new stream
+func (p *dumpPipeline) attach(reader *rtp.RtpReader, onStream func(index int, stream *rtp.RtpStream)) {
+	reader.OnStream(func(stream *rtp.RtpStream) {
+		p.count++
+		s := &pipelineStream{index: p.count, stream: stream}
+		p.streams[stream] = s
+		if p.streamIndex != -1 && p.streamIndex != s.index {
+			return
+		}
+		if p.selected != nil && !p.selected[s.index] {
+			return
+		}
+		if onStream != nil {
+			onStream(s.index, stream)
+		}
+
+		if p.detect {
+			s.detecting = true
+			return
+		}
+		codecMetadata, options := p.codecMetadata, p.options
+		if p.sdpFormats && stream.Format != nil {
+			var ok bool
+			if codecMetadata, options, ok = codecs.FindByFormat(stream.Format); !ok {
+				log.Info(fmt.Sprintf("skipping stream %d, no codec for %s", s.index, stream.Format))
+				return
+			}
+			log.Sinfo("stream %d is %s, using codec %s with %v", s.index, stream.Format, codecMetadata.Name, options)
+		}
+		p.start(s, codecMetadata, options)
+	})
+
+	reader.OnPacket(func(stream *rtp.RtpStream, packet *rtp.RtpPacket) {
+		s, ok := p.streams[stream]
+		if !ok {
+			return
+		}
+		if s.detecting {
+			s.pending = append(s.pending, packet)
+			if len(s.pending) >= codecs.DetectPackets || stream.Format != nil {
+				p.detectCodec(s)
+			}
+			return
+		}
+		if s.dumper == nil {
+			return
+		}
+		s.lastSeen = packet.ReceivedAt
+		p.write(s, packet)
+		p.closeIdle(packet.ReceivedAt)
 	})
 }
 
-func doDump(options dumpOptions) error {
-	codec := options.codecMetadata.Init()
-	if err := codec.SetOptions(options.options); err != nil {
-		return err
+// start creates codec and output file of a stream
+func (p *dumpPipeline) start(s *pipelineStream, codecMetadata codecs.CodecMetadata, options map[string]string) {
+	codec := codecMetadata.Init()
+	if err := codec.SetOptions(options); err != nil {
+		p.fail(s, err)
+		return
 	}
 	codec.Init()
+	d, err := newStreamDumper(codec, p.fileName(s.index, codecMetadata))
+	if err != nil {
+		p.fail(s, err)
+		return
+	}
+	s.dumper = d
+}
 
-	if options.streamIndex != -1 { // dump single stream
-		if err := dumpStream(codec, options.outputFile, options.rtpStreams[options.streamIndex-1]); err != nil {
-			return cli.NewExitError(fmt.Sprintf("failed to decode stream: %s", err), 1)
+// detectCodec starts dumping a stream with codec detected from its held packets and writes them
+func (p *dumpPipeline) detectCodec(s *pipelineStream) {
+	pending := s.pending
+	s.detecting, s.pending = false, nil
+	payloads := make([][]byte, len(pending))
+	for i, packet := range pending {
+		payloads[i] = packet.Payload
+	}
+	codecMetadata, options, ok := codecs.Detect(s.stream.Format, s.stream.PayloadType, payloads)
+	if !ok {
+		log.Info(fmt.Sprintf("skipping stream %d, no codec detected for payload type %d", s.index, s.stream.PayloadType))
+		return
+	}
+	log.Sinfo("stream %d detected as codec %s with %v", s.index, codecMetadata.Name, options)
+	p.start(s, codecMetadata, options)
+	for _, packet := range pending {
+		if s.dumper == nil {
+			return
 		}
-		return nil
+		s.lastSeen = packet.ReceivedAt
+		p.write(s, packet)
 	}
+}
+
+// write decodes a packet to the output file, the file is removed if decoding fails
+func (p *dumpPipeline) write(s *pipelineStream, packet *rtp.RtpPacket) {
+	if err := s.dumper.writePacketSafe(packet); err != nil {
+		p.fail(s, err)
+		s.dumper.close()
+		os.Remove(s.dumper.fileName)
+		s.dumper = nil
+	}
+}
 
-	extension := filepath.Ext(options.outputFile) // dump all streams
-	baseName := options.outputFile[:len(options.outputFile)-len(extension)] + "_s"
-	log.Info(fmt.Sprintf("dumping %d streams", len(options.rtpStreams)))
-	for streamIndex, stream := range options.rtpStreams {
-		log.Info(fmt.Sprintf("dumping %d", streamIndex+1))
-		fileName := baseName + strconv.Itoa(streamIndex+1) + extension
+func (p *dumpPipeline) fail(s *pipelineStream, err error) {
+	p.errors++
+	log.Error("failed to decode stream " + strconv.Itoa(s.index) + ": " + err.Error())
+}
+
+func (p *dumpPipeline) failed() bool {
+	return p.errors > 0
+}
 
-		if err := dumpStream(codec, fileName, stream); err != nil {
-			log.Error("failed to decode stream " + strconv.Itoa(streamIndex+1) + ": " + err.Error())
+// closeIdle closes output files of streams that stopped, they're reopened if the stream resumes
+func (p *dumpPipeline) closeIdle(now time.Time) {
+	if now.Sub(p.lastIdleCheck) < streamIdleTimeout {
+		return
+	}
+	p.lastIdleCheck = now
+	for _, s := range p.streams {
+		if s.dumper != nil && now.Sub(s.lastSeen) >= streamIdleTimeout {
+			s.dumper.close()
 		}
 	}
-	return nil
-
 }
 
-func dumpStream(codec codecs.Codec, fileName string, stream *rtp.RtpStream) (err error) {
-	defer func() {
-		codec.Reset()
-		if p := recover(); p != nil {
-			err = fmt.Errorf("%s", p)
+func (p *dumpPipeline) close() {
+	for _, s := range p.streams {
+		if s.detecting && len(s.pending) > 0 { // fewer packets than needed for detection
+			p.detectCodec(s)
 		}
-		if err != nil {
-			os.Remove(fileName)
+		if s.dumper != nil {
+			if err := s.dumper.flush(); err != nil {
+				p.fail(s, err)
+			}
+			s.dumper.close()
+			if err := s.dumper.updateHeader(); err != nil {
+				p.fail(s, err)
+			}
 		}
-	}()
+	}
+}
 
-	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0655)
+// streamDumper writes decoded frames of a single stream to a file packet by packet
+type streamDumper struct {
+	codec          codecs.Codec
+	fileName       string
+	file           *os.File
+	gotFormatMagic bool
+	written        int64 // after format magic
+}
+
+func newStreamDumper(codec codecs.Codec, fileName string) (*streamDumper, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0655)
 	if err != nil {
-		return cli.NewMultiError(cli.NewExitError("failed to create file", 1), err)
+		return nil, cli.NewMultiError(cli.NewExitError("failed to create file", 1), err)
 	}
-	defer f.Close()
 
-	gotFormatMagic := false
+	d := &streamDumper{codec: codec, fileName: fileName, file: f}
 	if magic, err := codec.GetFormatMagic(); err == nil {
-		gotFormatMagic = true
+		d.gotFormatMagic = true
 		f.Write(magic)
 	}
-	for _, r := range stream.RtpPackets {
-		frames, err := codec.HandleRtpPacket(r)
-		if err != nil {
-			if (err.Error() == "ignore out of sequence") || (err.Error() == "payload is too short") {
-				continue
-			}
-			return cli.NewMultiError(cli.NewExitError("failed to handle RTP packet", 1), err)
+	return d, nil
+}
+
+func (d *streamDumper) writePacket(r *rtp.RtpPacket) error {
+	frames, err := d.codec.HandleRtpPacket(r)
+	if err != nil {
+		if (err.Error() == "ignore out of sequence") || (err.Error() == "payload is too short") {
+			return nil
 		}
+		return cli.NewMultiError(cli.NewExitError("failed to handle RTP packet", 1), err)
+	}
 
-		if !gotFormatMagic {
-			magic, err := codec.GetFormatMagic()
-			if err != nil {
-				return cli.NewMultiError(cli.NewExitError("failed to get format magic", 1), err)
-			}
-			f.Write(magic)
-			gotFormatMagic = true
+	return d.write(frames)
+}
+
+// flush writes frames the codec still holds at the end of the stream
+func (d *streamDumper) flush() error {
+	flusher, ok := d.codec.(codecs.Flusher)
+	if !ok {
+		return nil
+	}
+	if frames := flusher.Flush(); len(frames) > 0 {
+		return d.write(frames)
+	}
+	return nil
+}
+
+func (d *streamDumper) write(frames []byte) (err error) {
+	if d.file == nil { // closed while the stream was idle
+		if d.file, err = os.OpenFile(d.fileName, os.O_WRONLY|os.O_APPEND, 0655); err != nil {
+			return cli.NewMultiError(cli.NewExitError("failed to reopen file", 1), err)
+		}
+	}
+	if !d.gotFormatMagic {
+		magic, err := d.codec.GetFormatMagic()
+		if err != nil {
+			return cli.NewMultiError(cli.NewExitError("failed to get format magic", 1), err)
 		}
-		f.Write(frames)
+		d.file.Write(magic)
+		d.gotFormatMagic = true
+	}
+	d.file.Write(frames)
+	d.written += int64(len(frames))
+	return nil
+}
+
+// updateHeader rewrites format magic of codecs keeping data length in it, the file has to be closed
+func (d *streamDumper) updateHeader() error {
+	updater, ok := d.codec.(codecs.HeaderUpdater)
+	if !ok || !d.gotFormatMagic {
+		return nil
+	}
+	f, err := os.OpenFile(d.fileName, os.O_WRONLY, 0655)
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to reopen file", 1), err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(updater.UpdateHeader(d.written), 0); err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to update format magic", 1), err)
 	}
-	f.Sync()
 	return nil
 }
+
+// writePacketSafe recovers from codec panics so a malformed stream doesn't terminate reading
+func (d *streamDumper) writePacketSafe(r *rtp.RtpPacket) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s", p)
+		}
+	}()
+	return d.writePacket(r)
+}
+
+func (d *streamDumper) close() {
+	if d.file == nil {
+		return
+	}
+	d.file.Sync()
+	d.file.Close()
+	d.file = nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/david-biro/rtpdump/esp"
+	"github.com/david-biro/rtpdump/rtp"
+	"github.com/urfave/cli"
+)
+
+var espCmd = func(c *cli.Context) error {
+	loadKeyFile(c)
+
+	inputFiles := captureFiles(c)
+
+	if len(inputFiles) == 0 {
+		cli.ShowCommandHelp(c, "esp")
+		return cli.NewExitError("wrong usage for esp", 1)
+	}
+
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
+
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+	}
+
+	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
+
+	// single pass, packets are only decoded to collect ESP statistics
+	rtpReader.KeepPackets(false)
+	rtpStreams := rtpReader.ReadStreams()
+
+	securityAssociations := esp.SecurityAssociations()
+	if len(securityAssociations) <= 0 {
+		fmt.Println("No ESP packets found")
+		return nil
+	}
+
+	missingKeys := 0
+	for i, sa := range securityAssociations {
+		fmt.Printf("%d: %s\n", i+1, sa)
+		if !sa.KeyAvailable {
+			missingKeys++
+		}
+	}
+	fmt.Printf("total: %d SPIs, %d rtp streams decrypted\n", len(securityAssociations), len(rtpStreams))
+	if missingKeys > 0 {
+		fmt.Printf("warning: no key for %d SPIs\n", missingKeys)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package esp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// encAlgorithm describes ESP encryption transform, saltLen bytes at the end of the key
+// are the nonce salt (RFC 3686, RFC 4106), icvLen is set for combined mode algorithms
+type encAlgorithm struct {
+	ivLen   int
+	block   int
+	saltLen int
+	icvLen  int
+	decrypt func(key, salt, header, iv, data, icv []byte) ([]byte, error)
+}
+
+var encAlgorithms = map[string]*encAlgorithm{
+	"null":      {ivLen: 0, block: 4, decrypt: decryptNull},
+	"des3_cbc":  {ivLen: des.BlockSize, block: des.BlockSize, decrypt: decryptDes3Cbc},
+	"aes_cbc":   {ivLen: aes.BlockSize, block: aes.BlockSize, decrypt: decryptAesCbc},
+	"aes_ctr":   {ivLen: 8, block: 4, saltLen: 4, decrypt: decryptAesCtr},
+	"aes_gcm8":  {ivLen: 8, block: 4, saltLen: 4, icvLen: 8, decrypt: decryptAesGcm},
+	"aes_gcm12": {ivLen: 8, block: 4, saltLen: 4, icvLen: 12, decrypt: decryptAesGcm},
+	"aes_gcm16": {ivLen: 8, block: 4, saltLen: 4, icvLen: 16, decrypt: decryptAesGcm},
+	"aes_gcm":   {ivLen: 8, block: 4, saltLen: 4, icvLen: 16, decrypt: decryptAesGcm},
+}
+
+// authAlgorithm describes integrity algorithm used with non combined mode encryption
+type authAlgorithm struct {
+	icvLen int
+	mac    func(key, data []byte) []byte
+}
+
+var authAlgorithms = map[string]*authAlgorithm{
+	"none":            {icvLen: 0},
+	"hmac_md5_96":     {icvLen: 12, mac: hmacFunc(md5.New)},
+	"hmac_sha1_96":    {icvLen: 12, mac: hmacFunc(sha1.New)},
+	"aes_xcbc_96":     {icvLen: 12, mac: aesXcbcMac},
+	"hmac_sha256_96":  {icvLen: 12, mac: hmacFunc(sha256.New)},
+	"hmac_sha256_128": {icvLen: 16, mac: hmacFunc(sha256.New)},
+	"hmac_sha384_192": {icvLen: 24, mac: hmacFunc(sha512.New384)},
+	"hmac_sha512_256": {icvLen: 32, mac: hmacFunc(sha512.New)},
+	// ICV is stripped without verification
+	"any_64":  {icvLen: 8},
+	"any_96":  {icvLen: 12},
+	"any_128": {icvLen: 16},
+	"any_192": {icvLen: 24},
+	"any_256": {icvLen: 32},
+}
+
+var errAuthentication = errors.New("esp icv verification failed")
+
+func decryptNull(key, salt, header, iv, data, icv []byte) ([]byte, error) {
+	return data, nil
+}
+
+func decryptCbc(block cipher.Block, iv, data []byte) ([]byte, error) {
+	if len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("cipher text length %d is not a multiple of block size", len(data))
+	}
+	clearData := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(clearData, data)
+	return clearData, nil
+}
+
+func decryptDes3Cbc(key, salt, header, iv, data, icv []byte) ([]byte, error) {
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCbc(block, iv, data)
+}
+
+func decryptAesCbc(key, salt, header, iv, data, icv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCbc(block, iv, data)
+}
+
+// counterBlock is nonce || IV || block counter, RFC 3686 section 4 and RFC 4106 section 4
+func counterBlock(salt, iv []byte, counter uint32) []byte {
+	block := make([]byte, aes.BlockSize)
+	copy(block, salt)
+	copy(block[4:], iv)
+	binary.BigEndian.PutUint32(block[12:], counter)
+	return block
+}
+
+func decryptAesCtr(key, salt, header, iv, data, icv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	clearData := make([]byte, len(data))
+	cipher.NewCTR(block, counterBlock(salt, iv, 1)).XORKeyStream(clearData, data)
+	return clearData, nil
+}
+
+// decryptAesGcm decrypts with the counter starting after J0 and verifies the ICV as the leftmost
+// octets of the full tag, Go AEAD does not accept 8 octet tags
+func decryptAesGcm(key, salt, header, iv, data, icv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	clearData := make([]byte, len(data))
+	cipher.NewCTR(block, counterBlock(salt, iv, 2)).XORKeyStream(clearData, data)
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append(append([]byte(nil), salt...), iv...)
+	sealed := aead.Seal(nil, nonce, clearData, header)
+	tag := sealed[len(clearData) : len(clearData)+len(icv)]
+	if subtle.ConstantTimeCompare(tag, icv) != 1 {
+		return nil, errAuthentication
+	}
+	return clearData, nil
+}
+
+func hmacFunc(h func() hash.Hash) func(key, data []byte) []byte {
+	return func(key, data []byte) []byte {
+		mac := hmac.New(h, key)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+}
+
+// aesXcbcMac implements AES-XCBC-MAC, RFC 3566 section 4
+func aesXcbcMac(key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	derive := func(b byte) []byte {
+		k := make([]byte, aes.BlockSize)
+		for i := range k {
+			k[i] = b
+		}
+		block.Encrypt(k, k)
+		return k
+	}
+	k1, k2, k3 := derive(0x01), derive(0x02), derive(0x03)
+	c1, err := aes.NewCipher(k1)
+	if err != nil {
+		return nil
+	}
+
+	e := make([]byte, aes.BlockSize)
+	for len(data) > aes.BlockSize {
+		for i := range e {
+			e[i] ^= data[i]
+		}
+		c1.Encrypt(e, e)
+		data = data[aes.BlockSize:]
+	}
+	last := make([]byte, aes.BlockSize)
+	copy(last, data)
+	finalKey := k2
+	if len(data) < aes.BlockSize {
+		last[len(data)] = 0x80
+		finalKey = k3
+	}
+	for i := range e {
+		e[i] ^= last[i] ^ finalKey[i]
+	}
+	c1.Encrypt(e, e)
+	return e
+}
+
+// verifyIcv checks ICV over ESP header, IV and cipher text
+func verifyIcv(auth *authAlgorithm, key, authenticated, icv []byte) error {
+	expected := auth.mac(key, authenticated)
+	if len(expected) < len(icv) || subtle.ConstantTimeCompare(expected[:len(icv)], icv) != 1 {
+		return errAuthentication
+	}
+	return nil
+}
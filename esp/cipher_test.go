@@ -0,0 +1,149 @@
+package esp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
+
+func TestDecryptAesCbc(t *testing.T) {
+	// RFC 3602 section 4, cases 1 and 2
+	tests := []struct {
+		key, iv, cipherText, plainText string
+	}{
+		{
+			key:        "06a9214036b8a15b512e03d534120006",
+			iv:         "3dafba429d9eb430b422da802c9fac41",
+			cipherText: "e353779c1079aeb82708942dbe77181a",
+			plainText:  hex.EncodeToString([]byte("Single block msg")),
+		},
+		{
+			key:        "c286696d887c9aa0611bbb3e2025a45a",
+			iv:         "562e17996d093d28ddb3ba695a2e6f58",
+			cipherText: "d296cd94c2cccf8a3a863028b5e1dc0a7586602d253cfff91b8266bea6d61ab1",
+			plainText:  "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		},
+	}
+	for i, tt := range tests {
+		got, err := decryptAesCbc(unhex(t, tt.key), nil, nil, unhex(t, tt.iv), unhex(t, tt.cipherText), nil)
+		if err != nil {
+			t.Errorf("case %d: %s", i+1, err)
+			continue
+		}
+		if want := unhex(t, tt.plainText); !bytes.Equal(got, want) {
+			t.Errorf("case %d: got %x, want %x", i+1, got, want)
+		}
+	}
+
+	if _, err := decryptAesCbc(unhex(t, tests[0].key), nil, nil, unhex(t, tests[0].iv), make([]byte, 15), nil); err == nil {
+		t.Errorf("unaligned cipher text: expected error")
+	}
+}
+
+func TestDecryptAesCtr(t *testing.T) {
+	// RFC 3686 section 6, test vectors 1 and 2
+	tests := []struct {
+		key, nonce, iv, cipherText, plainText string
+	}{
+		{
+			key:        "ae6852f8121067cc4bf7a5765577f39e",
+			nonce:      "00000030",
+			iv:         "0000000000000000",
+			cipherText: "e4095d4fb7a7b3792d6175a3261311b8",
+			plainText:  hex.EncodeToString([]byte("Single block msg")),
+		},
+		{
+			key:        "7e24067817fae0d743d6ce1f32539163",
+			nonce:      "006cb6db",
+			iv:         "c0543b59da48d90b",
+			cipherText: "5104a106168a72d9790d41ee8edad388eb2e1efc46da57c8fce630df9141be28",
+			plainText:  "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		},
+	}
+	for i, tt := range tests {
+		got, err := decryptAesCtr(unhex(t, tt.key), unhex(t, tt.nonce), nil, unhex(t, tt.iv), unhex(t, tt.cipherText), nil)
+		if err != nil {
+			t.Errorf("vector %d: %s", i+1, err)
+			continue
+		}
+		if want := unhex(t, tt.plainText); !bytes.Equal(got, want) {
+			t.Errorf("vector %d: got %x, want %x", i+1, got, want)
+		}
+	}
+}
+
+func TestCounterBlock(t *testing.T) {
+	got := counterBlock(unhex(t, "006cb6db"), unhex(t, "c0543b59da48d90b"), 1)
+	if want := unhex(t, "006cb6dbc0543b59da48d90b00000001"); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDecryptAesGcm(t *testing.T) {
+	// GCM specification test case 4, salt and IV split as in RFC 4106 section 4, ICV truncated as in section 8
+	const (
+		key        = "feffe9928665731c6d6a8f9467308308"
+		salt       = "cafebabe"
+		iv         = "facedbaddecaf888"
+		aad        = "feedfacedeadbeeffeedfacedeadbeefabaddad2"
+		plainText  = "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39"
+		cipherText = "42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091"
+		tag        = "5bc94fbc3221a5db94fae95ae7121a47"
+	)
+	tests := []struct {
+		name string
+		icv  string
+		aad  string
+		err  error
+	}{
+		{"icv 16", tag, aad, nil},
+		{"icv 12", tag[:24], aad, nil},
+		{"icv 8", tag[:16], aad, nil},
+		{"modified icv", "5bc94fbc3221a5db94fae95ae7121a48", aad, errAuthentication},
+		{"modified header", tag, "feedfacedeadbeeffeedfacedeadbeefabaddad3", errAuthentication},
+	}
+	for _, tt := range tests {
+		got, err := decryptAesGcm(unhex(t, key), unhex(t, salt), unhex(t, tt.aad), unhex(t, iv), unhex(t, cipherText), unhex(t, tt.icv))
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if want := unhex(t, plainText); err == nil && !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestAesXcbcMac(t *testing.T) {
+	// RFC 3566 section 4.6, test cases 1 to 4 and 6
+	const key = "000102030405060708090a0b0c0d0e0f"
+	tests := []struct {
+		length int
+		mac    string
+	}{
+		{0, "75f0251d528ac01c4573dfd584d79f29"},
+		{3, "5b376580ae2f19afe7219ceef172756f"},
+		{16, "d2a246fa349b68a79998a4394ff7a263"},
+		{20, "47f51b4564966215b8985c63055ed308"},
+		{34, "becbb3bccdb518a30677d5481fb6b4d8"},
+	}
+	for _, tt := range tests {
+		data := make([]byte, tt.length)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if got, want := aesXcbcMac(unhex(t, key), data), unhex(t, tt.mac); !bytes.Equal(got, want) {
+			t.Errorf("%d bytes: got %x, want %x", tt.length, got, want)
+		}
+	}
+}
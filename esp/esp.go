@@ -2,10 +2,10 @@ package esp
 
 import (
 	"bufio"
-	"crypto/cipher"
-	"crypto/des"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -20,39 +20,42 @@ type EncKey struct {
 	algorithm string
 	spi       uint32
 	key       []byte
+	salt      []byte
+	icvLen    int
+	enc       *encAlgorithm
+	auth      *authAlgorithm
+	authKey   []byte
+	// outer addresses the key applies to, nil matches any
+	src, dst *net.IPNet
 }
 
-var keyList map[uint32]*EncKey
+// several keys may share SPI, selected by addresses or by trying them when imported keys are ambiguous
+var keyList map[uint32][]*EncKey
 
-//LoadKeyFile load key file
+//LoadKeyFile load key file, Wireshark esp_sa files and charon logs are detected automatically
 func LoadKeyFile(path string) error {
-	keyList = make(map[uint32]*EncKey)
+	keyList = make(map[uint32][]*EncKey)
 	// open a file
 	if file, err := os.Open(path); err == nil {
 
 		// make sure it gets closed
 		defer file.Close()
 
-		// create a new scanner and read the file line by line
+		var lines []string
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			var spiStr, algStr, keyStr string
-			n, err2 := fmt.Sscanf(scanner.Text(), "%s %s %s", &spiStr, &algStr, &keyStr)
-			if err2 != nil || n != 3 {
-				continue
-			}
-			spi, err3 := spiHexToInt(spiStr)
-			if err3 != nil {
-				continue
-			}
-			key := bytesFromHex(keyStr)
-			if key == nil {
-				continue
-			}
-			keyList[spi] = &EncKey{
-				algorithm: algStr,
-				key:       key,
-			}
+			lines = append(lines, scanner.Text())
+		}
+
+		switch {
+		case isWiresharkSaFile(lines):
+			log.Sdebug("loading esp keys from wireshark esp_sa file %s", path)
+			loadWiresharkSa(lines)
+		case isCharonLog(lines):
+			log.Sdebug("loading esp keys from charon log %s", path)
+			loadCharonLog(lines)
+		default:
+			loadKeyLines(lines)
 		}
 
 	} else {
@@ -61,42 +64,243 @@ func LoadKeyFile(path string) error {
 	return nil
 }
 
-//DecodeESPLayer decrypts and returns payload
+// loadKeyLines parses native format
+// [SPI] [Encryption Algorithm] [Key] [optional Integrity Algorithm] [optional Integrity Key]
+func loadKeyLines(lines []string) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		spi, err3 := spiHexToInt(fields[0])
+		if err3 != nil {
+			continue
+		}
+		key := bytesFromHex(fields[2])
+		if key == nil {
+			continue
+		}
+		entry, err4 := newEncKey(spi, fields[1], key, fields[3:])
+		if err4 != nil {
+			log.Serror("esp key 0x%08x: %s", spi, err4)
+			continue
+		}
+		addKey(entry)
+	}
+}
+
+func addKey(entry *EncKey) {
+	for _, k := range keyList[entry.spi] {
+		if k.algorithm == entry.algorithm && string(k.key) == string(entry.key) && string(k.authKey) == string(entry.authKey) {
+			return
+		}
+	}
+	keyList[entry.spi] = append(keyList[entry.spi], entry)
+}
+
+func newEncKey(spi uint32, algorithm string, key []byte, options []string) (*EncKey, error) {
+	enc, ok := encAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("esp algorithm %s not supported", algorithm)
+	}
+	if len(key) <= enc.saltLen && algorithm != "null" {
+		return nil, fmt.Errorf("key too short for %s", algorithm)
+	}
+	entry := &EncKey{
+		algorithm: algorithm,
+		spi:       spi,
+		key:       key[:len(key)-enc.saltLen],
+		salt:      key[len(key)-enc.saltLen:],
+		icvLen:    enc.icvLen,
+		enc:       enc,
+	}
+	// combined mode algorithms carry their own ICV, without integrity algorithm
+	// the ICV length is unknown and the trailer isn't stripped
+	if enc.icvLen == 0 && len(options) > 0 {
+		auth := options[0]
+		if entry.auth, ok = authAlgorithms[auth]; !ok {
+			return nil, fmt.Errorf("esp integrity algorithm %s not supported", auth)
+		}
+		entry.icvLen = entry.auth.icvLen
+		if len(options) > 1 && entry.auth.mac != nil {
+			if entry.authKey = bytesFromHex(options[1]); entry.authKey == nil {
+				return nil, errors.New("invalid integrity key")
+			}
+		}
+	}
+	return entry, nil
+}
+
+// matches returns true if key applies to packet between src and dst
+func (k *EncKey) matches(src, dst net.IP) bool {
+	return (k.src == nil || src == nil || k.src.Contains(src)) &&
+		(k.dst == nil || dst == nil || k.dst.Contains(dst))
+}
+
+//DecodeESPLayer verifies, decrypts and returns payload
 func DecodeESPLayer(packet gopacket.Packet, esp *layers.IPSecESP) gopacket.Packet {
 
-	entry := getKeyEntry(esp.SPI)
-	if entry == nil {
+	sa := getSecurityAssociation(esp.SPI, packet)
+	sa.updateSeq(esp.Seq)
+
+	src, dst := outerAddresses(packet)
+	entries := getKeyEntries(esp.SPI, src, dst)
+	if len(entries) == 0 {
 		return nil
 	}
-	key := entry.key
-	algorithm := entry.algorithm
 
-	var clearData []byte
+	var firstErr error
+	for i, entry := range entries {
+		payload, nextHeader, authenticated, err := decrypt(entry, esp)
+		if err != nil {
+			if firstErr == nil || err == errAuthentication {
+				firstErr = err
+			}
+			continue
+		}
+		if i > 0 { // keep the key that worked first for the following packets
+			promoteKey(entry)
+		}
+		sa.Algorithm = entry.algorithm
+		if authenticated {
+			sa.Authenticated++
+		}
+		sa.Decrypted++
+		return makePacket(packet, payload, nextHeader)
+	}
+
+	log.Sdebug("esp spi 0x%08x seq %d: %s", esp.SPI, esp.Seq, firstErr)
+	if firstErr == errAuthentication {
+		sa.AuthFailures++
+	} else {
+		sa.DecryptFailures++
+	}
+	return nil
+}
+
+// decrypt verifies ICV when possible, decrypts and strips the trailer
+func decrypt(entry *EncKey, esp *layers.IPSecESP) ([]byte, byte, bool, error) {
+	if entry.enc.icvLen == 0 && entry.auth == nil {
+		payload, nextHeader, err := decryptTunnel(entry, esp)
+		return payload, nextHeader, false, err
+	}
+	// IV, cipher text including trailer, ICV
+	data := esp.Encrypted
+	if len(data) < entry.enc.ivLen+entry.icvLen+2 {
+		return nil, 0, false, fmt.Errorf("esp packet too short for %s", entry.algorithm)
+	}
+	iv := data[:entry.enc.ivLen]
+	icv := data[len(data)-entry.icvLen:]
+	cipherData := data[entry.enc.ivLen : len(data)-entry.icvLen]
+	if len(cipherData)%entry.enc.block != 0 {
+		return nil, 0, false, fmt.Errorf("esp cipher text length %d is not aligned, wrong integrity algorithm?", len(cipherData))
+	}
 
-	if algorithm == "des3_cbc" {
-		payloadLen := len(esp.Encrypted[8:])
-		cipherData := make([]byte, payloadLen+payloadLen%8)
-		copy(cipherData, esp.Encrypted[8:])
+	authenticated := false
+	if entry.authKey != nil {
+		if err := verifyIcv(entry.auth, entry.authKey, esp.Contents[:len(esp.Contents)-entry.icvLen], icv); err != nil {
+			return nil, 0, false, err
+		}
+		authenticated = true
+	}
 
-		iv := esp.Encrypted[:8]
-		blockCipher, _ := des.NewTripleDESCipher(key)
-		mode := cipher.NewCBCDecrypter(blockCipher, iv)
+	clearData, err := entry.enc.decrypt(entry.key, entry.salt, esp.Contents[:8], iv, cipherData, icv)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if entry.enc.icvLen > 0 {
+		authenticated = true
+	}
+	payload, nextHeader, err := stripTrailer(clearData)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	log.Strace("esp spi 0x%08x seq %d next header %d", esp.SPI, esp.Seq, nextHeader)
+	return payload, nextHeader, authenticated, nil
+}
 
-		clearData = make([]byte, len(cipherData)+1)
-		mode.CryptBlocks(clearData, cipherData)
-	} else {
-		log.Serror("esp algorithm %s not supported", algorithm)
+// decryptTunnel decrypts everything after the IV when integrity algorithm is unknown, ICV can't be
+// told from cipher text so the trailer is left in place, inner IP header tells where the packet ends
+func decryptTunnel(entry *EncKey, esp *layers.IPSecESP) ([]byte, byte, error) {
+	data := esp.Encrypted
+	if len(data) < entry.enc.ivLen+entry.enc.block {
+		return nil, 0, fmt.Errorf("esp packet too short for %s", entry.algorithm)
+	}
+	iv := data[:entry.enc.ivLen]
+	cipherData := data[entry.enc.ivLen:]
+	cipherData = cipherData[:len(cipherData)-len(cipherData)%entry.enc.block]
+	clearData, err := entry.enc.decrypt(entry.key, entry.salt, esp.Contents[:8], iv, cipherData, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch clearData[0] >> 4 {
+	case 4:
+		return clearData, byte(layers.IPProtocolIPv4), nil
+	case 6:
+		return clearData, byte(layers.IPProtocolIPv6), nil
+	}
+	return nil, 0, errors.New("esp payload is not an IP packet, integrity algorithm is needed for transport mode")
+}
+
+// stripTrailer removes padding, pad length and next header, see RFC 4303 section 2.4
+func stripTrailer(clearData []byte) ([]byte, byte, error) {
+	if len(clearData) < 2 {
+		return nil, 0, errors.New("esp trailer missing")
+	}
+	padLength := int(clearData[len(clearData)-2])
+	nextHeader := clearData[len(clearData)-1]
+	if padLength+2 > len(clearData) {
+		return nil, 0, fmt.Errorf("invalid esp pad length %d", padLength)
+	}
+	// default padding is 1, 2, 3, ..., anything else hints at a wrong key
+	padding := clearData[len(clearData)-2-padLength : len(clearData)-2]
+	for i, b := range padding {
+		if int(b) != i+1 {
+			return nil, 0, errors.New("unexpected esp padding, wrong key?")
+		}
+	}
+	return clearData[:len(clearData)-2-padLength], nextHeader, nil
+}
+
+// makePacket decodes payload according to next header, tunnel mode carries IP packet
+// while transport mode payload follows outer IP header
+func makePacket(packet gopacket.Packet, d []byte, nextHeader byte) gopacket.Packet {
+	switch layers.IPProtocol(nextHeader) {
+	case layers.IPProtocolIPv4:
+		return gopacket.NewPacket(d, layers.LayerTypeIPv4, gopacket.Default)
+	case layers.IPProtocolIPv6:
+		return gopacket.NewPacket(d, layers.LayerTypeIPv6, gopacket.Default)
+	case layers.IPProtocolNoNextHeader:
+		log.Strace("esp dummy packet")
 		return nil
 	}
-	return makePacket(packet, clearData)
+	return transportPacket(packet, d, layers.IPProtocol(nextHeader))
 }
 
-func makePacket(packet gopacket.Packet, d []byte) gopacket.Packet {
-	espPacket := gopacket.NewPacket(d, layers.LayerTypeIPv4, gopacket.Default)
-	if espPacket.ErrorLayer() != nil {
-		espPacket = gopacket.NewPacket(d, layers.LayerTypeIPv6, gopacket.Default)
+// transportPacket rebuilds transport mode packet from outer IP header and decrypted payload
+func transportPacket(packet gopacket.Packet, d []byte, protocol layers.IPProtocol) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		header := *ip
+		header.Protocol = protocol
+		if err := gopacket.SerializeLayers(buf, opts, &header, gopacket.Payload(d)); err != nil {
+			log.Sdebug("failed to rebuild esp transport mode packet: %s", err)
+			return nil
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	case *layers.IPv6:
+		header := *ip
+		header.NextHeader = protocol
+		header.HopByHop = nil
+		if err := gopacket.SerializeLayers(buf, opts, &header, gopacket.Payload(d)); err != nil {
+			log.Sdebug("failed to rebuild esp transport mode packet: %s", err)
+			return nil
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
 	}
-	return espPacket
+	return nil
 }
 
 func bytesFromHex(s string) []byte {
@@ -114,6 +318,33 @@ func spiHexToInt(s string) (uint32, error) {
 	return uint32(n), err
 }
 
-func getKeyEntry(spi uint32) *EncKey {
-	return keyList[spi]
+func outerAddresses(packet gopacket.Packet) (net.IP, net.IP) {
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		return ip.SrcIP, ip.DstIP
+	}
+	return nil, nil
+}
+
+func getKeyEntries(spi uint32, src, dst net.IP) []*EncKey {
+	var entries []*EncKey
+	for _, k := range keyList[spi] {
+		if k.matches(src, dst) {
+			entries = append(entries, k)
+		}
+	}
+	return entries
+}
+
+func promoteKey(entry *EncKey) {
+	keys := keyList[entry.spi]
+	for i, k := range keys {
+		if k == entry {
+			copy(keys[1:i+1], keys[:i])
+			keys[0] = entry
+			return
+		}
+	}
 }
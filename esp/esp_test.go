@@ -0,0 +1,125 @@
+package esp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestStripTrailer(t *testing.T) {
+	tests := []struct {
+		name       string
+		clearData  []byte
+		payload    []byte
+		nextHeader byte
+		ok         bool
+	}{
+		{"no padding", []byte{0xAA, 0xBB, 0, 4}, []byte{0xAA, 0xBB}, 4, true},
+		{"default padding", []byte{0xAA, 1, 2, 3, 3, 17}, []byte{0xAA}, 17, true},
+		{"empty payload", []byte{1, 2, 2, 59}, []byte{}, 59, true},
+		{"zero padding", []byte{0xAA, 0, 0, 2, 4}, nil, 0, false},
+		{"reversed padding", []byte{0xAA, 2, 1, 2, 4}, nil, 0, false},
+		{"pad length beyond data", []byte{1, 2, 3, 4}, nil, 0, false},
+		{"trailer missing", []byte{4}, nil, 0, false},
+	}
+	for _, tt := range tests {
+		payload, nextHeader, err := stripTrailer(tt.clearData)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (!bytes.Equal(payload, tt.payload) || nextHeader != tt.nextHeader) {
+			t.Errorf("%s: got %x next header %d, want %x next header %d", tt.name, payload, nextHeader, tt.payload, tt.nextHeader)
+		}
+	}
+}
+
+// sealCbc builds ESP packet carrying inner packet with AES-CBC and a dummy 12 octet ICV
+func sealCbc(t *testing.T, key []byte, inner []byte, nextHeader byte) *layers.IPSecESP {
+	padLength := (aes.BlockSize - (len(inner)+2)%aes.BlockSize) % aes.BlockSize
+	plain := append([]byte(nil), inner...)
+	for i := 1; i <= padLength; i++ {
+		plain = append(plain, byte(i))
+	}
+	plain = append(plain, byte(padLength), nextHeader)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{0x5A}, aes.BlockSize)
+	sealed := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(sealed, plain)
+
+	contents := []byte{0, 0, 0x10, 0x01, 0, 0, 0, 1} // SPI and sequence number
+	contents = append(append(contents, iv...), sealed...)
+	contents = append(contents, bytes.Repeat([]byte{0xEE}, 12)...)
+	esp := &layers.IPSecESP{SPI: 0x1001, Seq: 1, Encrypted: contents[8:]}
+	esp.Contents = contents
+	return esp
+}
+
+func innerIPv4(t *testing.T) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: 4000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, udp, gopacket.Payload([]byte("rtp payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecryptWithoutIntegrityAlgorithm(t *testing.T) {
+	key := unhex(t, "06a9214036b8a15b512e03d534120006")
+	entry, err := newEncKey(0x1001, "aes_cbc", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.auth != nil || entry.icvLen != 0 {
+		t.Fatalf("integrity algorithm should be unknown, got icv length %d", entry.icvLen)
+	}
+
+	inner := innerIPv4(t)
+	payload, nextHeader, authenticated, err := decrypt(entry, sealCbc(t, key, inner, byte(layers.IPProtocolIPv4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextHeader != byte(layers.IPProtocolIPv4) || authenticated {
+		t.Errorf("got next header %d, authenticated %t", nextHeader, authenticated)
+	}
+	// trailer and ICV are left after the inner packet
+	if !bytes.HasPrefix(payload, inner) {
+		t.Errorf("got %x, want prefix %x", payload, inner)
+	}
+	packet := gopacket.NewPacket(payload, layers.LayerTypeIPv4, gopacket.Default)
+	if app := packet.ApplicationLayer(); app == nil || string(app.Payload()) != "rtp payload" {
+		t.Errorf("inner packet not decoded: %s", packet)
+	}
+
+	// transport mode can't be decoded without knowing where the trailer starts
+	if _, _, _, err := decrypt(entry, sealCbc(t, key, []byte("udp header and payload"), byte(layers.IPProtocolUDP))); err == nil {
+		t.Errorf("transport mode: expected error")
+	}
+}
+
+func TestDecryptWithIntegrityAlgorithm(t *testing.T) {
+	key := unhex(t, "06a9214036b8a15b512e03d534120006")
+	entry, err := newEncKey(0x1001, "aes_cbc", key, []string{"hmac_sha1_96"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := []byte("udp header and payload")
+	payload, nextHeader, authenticated, err := decrypt(entry, sealCbc(t, key, inner, byte(layers.IPProtocolUDP)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, inner) || nextHeader != byte(layers.IPProtocolUDP) || authenticated {
+		t.Errorf("got %q next header %d authenticated %t", payload, nextHeader, authenticated)
+	}
+}
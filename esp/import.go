@@ -0,0 +1,328 @@
+package esp
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/david-biro/rtpdump/log"
+)
+
+// Wireshark esp_sa UAT algorithm names
+var wiresharkEncAlgorithms = map[string]string{
+	"NULL":                                "null",
+	"TripleDES-CBC [RFC2451]":             "des3_cbc",
+	"AES-CBC [RFC3602]":                   "aes_cbc",
+	"AES-CTR [RFC3686]":                   "aes_ctr",
+	"AES-GCM with 8 octet ICV [RFC4106]":  "aes_gcm8",
+	"AES-GCM with 12 octet ICV [RFC4106]": "aes_gcm12",
+	"AES-GCM with 16 octet ICV [RFC4106]": "aes_gcm16",
+}
+
+var wiresharkAuthAlgorithms = map[string]string{
+	"NULL":                    "none",
+	"HMAC-SHA-1-96 [RFC2404]": "hmac_sha1_96",
+	"HMAC-SHA-256-96 [draft-ietf-ipsec-ciph-sha-256-00]": "hmac_sha256_96",
+	"HMAC-SHA-256-128 [RFC4868]":                         "hmac_sha256_128",
+	"HMAC-SHA-384-192 [RFC4868]":                         "hmac_sha384_192",
+	"HMAC-SHA-512-256 [RFC4868]":                         "hmac_sha512_256",
+	"HMAC-MD5-96 [RFC2403]":                              "hmac_md5_96",
+	"MAC-RIPEMD-160-96 [RFC2857]":                        "any_96",
+	"ANY 64 bit authentication [no checking]":            "any_64",
+	"ANY 96 bit authentication [no checking]":            "any_96",
+	"ANY 128 bit authentication [no checking]":           "any_128",
+	"ANY 192 bit authentication [no checking]":           "any_192",
+	"ANY 256 bit authentication [no checking]":           "any_256",
+}
+
+// strongSwan algorithm names, as in proposals and kernel interface logs
+var charonEncAlgorithms = map[string]string{
+	"NULL":       "null",
+	"3DES_CBC":   "des3_cbc",
+	"AES_CBC":    "aes_cbc",
+	"AES_CTR":    "aes_ctr",
+	"AES_GCM_8":  "aes_gcm8",
+	"AES_GCM_12": "aes_gcm12",
+	"AES_GCM_16": "aes_gcm16",
+}
+
+var charonIntegAlgorithms = map[string]string{
+	"HMAC_MD5_96":       "hmac_md5_96",
+	"HMAC_SHA1_96":      "hmac_sha1_96",
+	"AES_XCBC_96":       "aes_xcbc_96",
+	"HMAC_SHA2_256_96":  "hmac_sha256_96",
+	"HMAC_SHA2_256_128": "hmac_sha256_128",
+	"HMAC_SHA2_384_192": "hmac_sha384_192",
+	"HMAC_SHA2_512_256": "hmac_sha512_256",
+}
+
+var (
+	charonLogRe      = regexp.MustCompile(`\d+\[(CHD|KNL|IKE|CFG|ENC|NET|MGR|LIB)\] `)
+	charonProposalRe = regexp.MustCompile(`selected proposal: ESP:(\S+)`)
+	charonEncRe      = regexp.MustCompile(`using encryption algorithm (\S+)`)
+	charonIntegRe    = regexp.MustCompile(`using integrity algorithm (\S+)`)
+	charonKeyRe      = regexp.MustCompile(`(encryption|integrity) (initiator|responder) key => (\d+) bytes`)
+	charonHexRe      = regexp.MustCompile(`\]\s+\d+: (.*)$`)
+	charonSaRe       = regexp.MustCompile(`adding (inbound|outbound) ESP SA`)
+	// addresses are followed by port when NAT-T is used, e.g. 192.0.2.1[4500]
+	charonSpiRe     = regexp.MustCompile(`SPI 0x([0-9a-fA-F]+), src ([^\s\[]+)(?:\[\d+\])? dst ([^\s\[]+)`)
+	charonMessageRe = regexp.MustCompile(`(generating|parsed) (IKE_AUTH|CREATE_CHILD_SA) (request|response)`)
+)
+
+const charonHexPerLine = 16
+
+// parseSelector parses address selector, "*" or empty matches any address
+func parseSelector(s string) *net.IPNet {
+	if s == "" || s == "*" {
+		return nil
+	}
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		log.Sdebug("esp address selector %s not supported, matching any address", s)
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func isWiresharkSaFile(lines []string) bool {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, `"IPv4"`) || strings.HasPrefix(line, `"IPv6"`) || strings.HasPrefix(line, `"Any`)
+	}
+	return false
+}
+
+// loadWiresharkSa parses esp_sa UAT lines:
+// "protocol","src ip","dst ip","spi","encryption","encryption key","authentication","authentication key"
+func loadWiresharkSa(lines []string) {
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.LazyQuotes = true
+		fields, err := reader.Read()
+		if err != nil || len(fields) < 8 {
+			continue
+		}
+		spi, err := spiHexToInt(fields[3])
+		if err != nil {
+			log.Sdebug("esp_sa: invalid spi %s", fields[3])
+			continue
+		}
+		algorithm, ok := wiresharkEncAlgorithms[fields[4]]
+		if !ok {
+			log.Serror("esp_sa 0x%08x: esp algorithm %s not supported", spi, fields[4])
+			continue
+		}
+		auth, ok := wiresharkAuthAlgorithms[fields[6]]
+		if !ok {
+			log.Serror("esp_sa 0x%08x: esp integrity algorithm %s not supported", spi, fields[6])
+			continue
+		}
+		key := bytesFromHex(fields[5])
+		if key == nil {
+			continue
+		}
+		options := []string{auth}
+		if fields[7] != "" {
+			options = append(options, fields[7])
+		}
+		entry, err := newEncKey(spi, algorithm, key, options)
+		if err != nil {
+			log.Serror("esp_sa 0x%08x: %s", spi, err)
+			continue
+		}
+		entry.src, entry.dst = parseSelector(fields[1]), parseSelector(fields[2])
+		addKey(entry)
+	}
+}
+
+func isCharonLog(lines []string) bool {
+	for _, line := range lines {
+		if charonLogRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// charonChildSa collects keys and SPIs of a CHILD_SA from charon log lines
+type charonChildSa struct {
+	encAlgorithm, integAlgorithm string
+	keys                         map[string][]byte
+	spis                         []charonSpi
+	role                         charonRole
+}
+
+type charonSpi struct {
+	spi       uint32
+	src, dst  string
+	direction string // "inbound", "outbound" or empty if not logged
+}
+
+// charonRole tells whether the logging host initiated the exchange creating the CHILD_SA
+type charonRole int
+
+const (
+	roleUnknown charonRole = iota
+	roleInitiator
+	roleResponder
+)
+
+func charonAlgorithm(names map[string]string, name string) string {
+	// proposals append key size, e.g. AES_CBC_128 or AES_GCM_16_256
+	for n := name; n != ""; {
+		if algorithm, ok := names[n]; ok {
+			return algorithm
+		}
+		i := strings.LastIndex(n, "_")
+		if i < 0 {
+			break
+		}
+		n = n[:i]
+	}
+	return ""
+}
+
+// keyRoles returns whose keys protect SA, RFC 7296 section 2.17: initiator keys protect traffic
+// sent by the initiator, so the initiator's inbound SA uses responder keys and vice versa.
+// Keys of both are returned when either direction or role is unknown, the wrong ones never pass verification
+func (c *charonChildSa) keyRoles(s charonSpi) []string {
+	switch {
+	case s.direction == "" || c.role == roleUnknown:
+		log.Sdebug("charon log 0x%08x: direction unknown, trying keys of both", s.spi)
+		return []string{"initiator", "responder"}
+	case (s.direction == "inbound") == (c.role == roleInitiator):
+		return []string{"responder"}
+	}
+	return []string{"initiator"}
+}
+
+// register adds keys of every SPI of the CHILD_SA
+func (c *charonChildSa) register() {
+	if c.encAlgorithm == "" {
+		if len(c.spis) > 0 {
+			log.Serror("charon log: no encryption algorithm found for CHILD_SA")
+		}
+		return
+	}
+	for _, s := range c.spis {
+		for _, role := range c.keyRoles(s) {
+			key := c.keys["encryption "+role]
+			if key == nil {
+				continue
+			}
+			var options []string
+			if c.integAlgorithm != "" {
+				options = []string{c.integAlgorithm}
+				if integKey := c.keys["integrity "+role]; integKey != nil {
+					options = append(options, hex.EncodeToString(integKey))
+				}
+			}
+			entry, err := newEncKey(s.spi, c.encAlgorithm, key, options)
+			if err != nil {
+				log.Serror("charon log 0x%08x: %s", s.spi, err)
+				continue
+			}
+			entry.src, entry.dst = parseSelector(s.src), parseSelector(s.dst)
+			addKey(entry)
+		}
+	}
+}
+
+// loadCharonLog parses strongSwan logs with "chd" level 4 showing derived keys
+func loadCharonLog(lines []string) {
+	current := &charonChildSa{keys: make(map[string][]byte)}
+	next := func() {
+		current.register()
+		current = &charonChildSa{
+			encAlgorithm:   current.encAlgorithm,
+			integAlgorithm: current.integAlgorithm,
+			keys:           make(map[string][]byte),
+			role:           current.role,
+		}
+	}
+
+	var hexKey, direction string
+	var hexRemaining int
+	for _, line := range lines {
+		if hexRemaining > 0 {
+			if m := charonHexRe.FindStringSubmatch(line); m != nil {
+				// 16 octets per line followed by their ASCII, which may look like hex as well
+				for i, token := range strings.Fields(m[1]) {
+					b, err := hex.DecodeString(token)
+					if err != nil || len(b) != 1 || hexRemaining == 0 || i == charonHexPerLine {
+						break
+					}
+					current.keys[hexKey] = append(current.keys[hexKey], b[0])
+					hexRemaining--
+				}
+				continue
+			}
+			hexRemaining = 0
+		}
+
+		if m := charonMessageRe.FindStringSubmatch(line); m != nil {
+			if len(current.spis) > 0 {
+				next()
+			}
+			// requests are generated and responses parsed by the initiator
+			if (m[1] == "generating") == (m[3] == "request") {
+				current.role = roleInitiator
+			} else {
+				current.role = roleResponder
+			}
+		} else if m := charonKeyRe.FindStringSubmatch(line); m != nil {
+			if len(current.spis) > 0 {
+				next()
+			}
+			hexKey = m[1] + " " + m[2]
+			hexRemaining, _ = strconv.Atoi(m[3])
+			current.keys[hexKey] = nil
+		} else if m := charonProposalRe.FindStringSubmatch(line); m != nil {
+			if len(current.spis) > 0 {
+				next()
+			}
+			current.integAlgorithm = ""
+			for _, name := range strings.Split(m[1], "/") {
+				if algorithm := charonAlgorithm(charonEncAlgorithms, name); algorithm != "" {
+					current.encAlgorithm = algorithm
+				} else if algorithm := charonAlgorithm(charonIntegAlgorithms, name); algorithm != "" {
+					current.integAlgorithm = algorithm
+				}
+			}
+		} else if m := charonEncRe.FindStringSubmatch(line); m != nil {
+			if algorithm := charonAlgorithm(charonEncAlgorithms, m[1]); algorithm != "" {
+				current.encAlgorithm = algorithm
+			}
+		} else if m := charonIntegRe.FindStringSubmatch(line); m != nil {
+			if algorithm := charonAlgorithm(charonIntegAlgorithms, m[1]); algorithm != "" {
+				current.integAlgorithm = algorithm
+			}
+		} else if m := charonSaRe.FindStringSubmatch(line); m != nil {
+			direction = m[1]
+		} else if m := charonSpiRe.FindStringSubmatch(line); m != nil {
+			spi, err := spiHexToInt(m[1])
+			if err != nil {
+				continue
+			}
+			current.spis = append(current.spis, charonSpi{spi: spi, src: m[2], dst: m[3], direction: direction})
+			direction = ""
+		}
+	}
+	current.register()
+}
@@ -0,0 +1,82 @@
+package esp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func octets(first byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+// testdata/charon.log has IKE_AUTH initiated by the logging host and a CHILD_SA rekey initiated by its peer
+func TestLoadCharonLog(t *testing.T) {
+	if err := LoadKeyFile("testdata/charon.log"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spi      uint32
+		key      []byte
+		authKey  []byte
+		src, dst string
+	}{
+		// initiator's inbound SA is protected with responder keys
+		{0xc1a5e270, octets(0x10, 16), octets(0x40, 20), "203.0.113.5", "192.168.1.10"},
+		{0xcb97da43, octets(0x00, 16), octets(0x20, 20), "192.168.1.10", "203.0.113.5"},
+		// responder's inbound SA is protected with initiator keys
+		{0xc3f0a1b2, octets(0xa0, 16), octets(0xc0, 20), "203.0.113.5", "192.168.1.10"},
+		{0x0a0b0c0d, octets(0xb0, 16), octets(0xe0, 20), "192.168.1.10", "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		entries := keyList[tt.spi]
+		if len(entries) != 1 {
+			t.Errorf("0x%08x: got %d keys, want 1", tt.spi, len(entries))
+			continue
+		}
+		k := entries[0]
+		if k.algorithm != "aes_cbc" || k.auth != authAlgorithms["hmac_sha1_96"] {
+			t.Errorf("0x%08x: got algorithm %s", tt.spi, k.algorithm)
+		}
+		if !bytes.Equal(k.key, tt.key) || !bytes.Equal(k.authKey, tt.authKey) {
+			t.Errorf("0x%08x: got key %x integrity key %x, want %x %x", tt.spi, k.key, k.authKey, tt.key, tt.authKey)
+		}
+		if k.src == nil || k.src.IP.String() != tt.src || k.dst == nil || k.dst.IP.String() != tt.dst {
+			t.Errorf("0x%08x: got selectors %s -> %s, want %s -> %s", tt.spi, k.src, k.dst, tt.src, tt.dst)
+		}
+	}
+	if len(keyList) != len(tests) {
+		t.Errorf("got %d SPIs, want %d", len(keyList), len(tests))
+	}
+}
+
+// without SA direction or exchange role in the log both keys are tried
+func TestLoadCharonLogUnknownRole(t *testing.T) {
+	keyList = make(map[uint32][]*EncKey)
+	loadCharonLog([]string{
+		"11[CFG] selected proposal: ESP:AES_GCM_16_128/NO_EXT_SEQ",
+		"11[CHD] encryption initiator key => 20 bytes @ 0x7f4c34003cd0",
+		"11[CHD]    0: 00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E 0F  ................",
+		"11[CHD]   16: 10 11 12 13                                      ....",
+		"11[CHD] encryption responder key => 20 bytes @ 0x7f4c34003cd0",
+		"11[CHD]    0: 20 20 41 42 20 20 41 42 20 20 41 42 20 20 41 42    AB  AB  AB  AB",
+		"11[CHD]   16: 20 20 41 42                                        AB",
+		"11[CHD]   SPI 0xc1a5e270, src 2001:db8::1 dst 2001:db8::2",
+	})
+	entries := keyList[0xc1a5e270]
+	if len(entries) != 2 {
+		t.Fatalf("got %d keys, want 2", len(entries))
+	}
+	if !bytes.Equal(entries[0].key, octets(0, 16)) || !bytes.Equal(entries[0].salt, octets(16, 4)) {
+		t.Errorf("initiator key: got %x salt %x", entries[0].key, entries[0].salt)
+	}
+	if want := bytes.Repeat([]byte{0x20, 0x20, 0x41, 0x42}, 4); !bytes.Equal(entries[1].key, want) {
+		t.Errorf("responder key: got %x, want %x", entries[1].key, want)
+	}
+	if entries[0].dst == nil || entries[0].dst.IP.String() != "2001:db8::2" {
+		t.Errorf("got destination selector %s", entries[0].dst)
+	}
+}
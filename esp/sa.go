@@ -0,0 +1,109 @@
+package esp
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+// size of the window of sequence numbers used to tell replayed packets from reordered ones
+const replayWindow = 64
+
+//SecurityAssociation keeps statistics of packets seen with one SPI
+type SecurityAssociation struct {
+	Spi                 uint32
+	Src, Dst            string
+	Algorithm           string
+	KeyAvailable        bool
+	Packets             uint
+	FirstSeq, LastSeq   uint32
+	Lost, Gaps          uint
+	Replayed, Reordered uint
+	Decrypted           uint
+	DecryptFailures     uint
+	Authenticated       uint
+	AuthFailures        uint
+
+	window uint64
+}
+
+var saList = make(map[uint32]*SecurityAssociation)
+var saSorted []*SecurityAssociation
+
+//SecurityAssociations returns SPIs seen so far in order of appearance
+func SecurityAssociations() []*SecurityAssociation {
+	return saSorted
+}
+
+//ResetSecurityAssociations drops the statistics of every SPI, so a capture can be read again from the start
+func ResetSecurityAssociations() {
+	saList = make(map[uint32]*SecurityAssociation)
+	saSorted = nil
+}
+
+func getSecurityAssociation(spi uint32, packet gopacket.Packet) *SecurityAssociation {
+	sa, ok := saList[spi]
+	if !ok {
+		sa = &SecurityAssociation{Spi: spi}
+		src, dst := outerAddresses(packet)
+		if src != nil {
+			sa.Src, sa.Dst = src.String(), dst.String()
+		}
+		if entries := getKeyEntries(spi, src, dst); len(entries) > 0 {
+			sa.KeyAvailable = true
+			sa.Algorithm = entries[0].algorithm
+		}
+		saList[spi] = sa
+		saSorted = append(saSorted, sa)
+	}
+	return sa
+}
+
+// updateSeq accounts for gaps, replays and reordering of ESP sequence numbers
+func (sa *SecurityAssociation) updateSeq(seq uint32) {
+	sa.Packets++
+	if sa.Packets == 1 {
+		sa.FirstSeq, sa.LastSeq, sa.window = seq, seq, 1
+		return
+	}
+	if seq > sa.LastSeq {
+		if diff := seq - sa.LastSeq; diff > 1 {
+			sa.Gaps++
+			sa.Lost += uint(diff - 1)
+		}
+		if diff := seq - sa.LastSeq; diff < replayWindow {
+			sa.window = sa.window<<diff | 1
+		} else {
+			sa.window = 1
+		}
+		sa.LastSeq = seq
+		return
+	}
+
+	diff := sa.LastSeq - seq
+	if diff >= replayWindow { // too old to tell, RFC 4303 receivers drop it
+		sa.Reordered++
+		return
+	}
+	if sa.window&(1<<diff) != 0 {
+		sa.Replayed++
+		return
+	}
+	sa.window |= 1 << diff
+	sa.Reordered++
+	if sa.Lost > 0 {
+		sa.Lost--
+	}
+}
+
+func (sa SecurityAssociation) String() string {
+	key := "no key"
+	if sa.KeyAvailable {
+		key = sa.Algorithm
+	}
+	return fmt.Sprintf("0x%08x   %s -> %s   %s   packets:%d seq:%d-%d lost:%d gaps:%d replayed:%d reordered:%d "+
+		"decrypted:%d failed:%d authenticated:%d auth failed:%d",
+		sa.Spi, sa.Src, sa.Dst, key,
+		sa.Packets, sa.FirstSeq, sa.LastSeq, sa.Lost, sa.Gaps, sa.Replayed, sa.Reordered,
+		sa.Decrypted, sa.DecryptFailures, sa.Authenticated, sa.AuthFailures)
+}
@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
 	github.com/google/gopacket v1.1.19
+	github.com/klauspost/compress v1.14.4
 	github.com/urfave/cli v1.22.5
 	golang.org/x/sys v0.0.0-20211006194710-c8a6f5223071 // indirect
 )
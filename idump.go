@@ -13,20 +13,23 @@ import (
 var interactiveDumpCmd = func(c *cli.Context) error {
 	loadKeyFile(c)
 
-	inputFile := c.Args().First()
+	inputFiles := captureFiles(c)
 
-	if inputFile == "" {
+	if len(inputFiles) == 0 {
 		cli.ShowCommandHelp(c, "dump")
 		return cli.NewExitError("wrong usage for dump", 1)
 	}
 
-	rtpReader, err := rtp.NewRtpReader(inputFile)
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
 
 	if err != nil {
 		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
 	}
 
 	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
 
 	return doInteractiveDump(c, rtpReader)
 }
@@ -119,14 +122,24 @@ func doInteractiveDump(c *cli.Context, rtpReader *rtp.RtpReader) error {
 		return cli.NewMultiError(cli.NewExitError("failed to get format magic", 1), err)
 	}
 	f.Write(magic)
+	var written int64
 	for _, r := range rtpStreams[streamIndex-1].RtpPackets {
 		frames, err := codec.HandleRtpPacket(r)
 		if err == nil {
 			f.Write(frames)
+			written += int64(len(frames))
 			// rtpnum = rtpnum + 1
 			// fmt.Println(rtpnum)
 		}
 	}
+	if flusher, ok := codec.(codecs.Flusher); ok {
+		frames := flusher.Flush()
+		f.Write(frames)
+		written += int64(len(frames))
+	}
+	if updater, ok := codec.(codecs.HeaderUpdater); ok {
+		f.WriteAt(updater.UpdateHeader(written), 0)
+	}
 	f.Sync()
 
 	return nil
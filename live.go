@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/rtp"
+	"github.com/urfave/cli"
+)
+
+var liveCmd = func(c *cli.Context) error {
+	loadKeyFile(c)
+
+	var rtpReader *rtp.RtpReader
+	var err error
+	switch {
+	case c.String("interface") != "":
+		rtpReader, err = rtp.NewLiveRtpReader(c.String("interface"))
+	case c.String("udp") != "":
+		rtpReader, err = rtp.NewUDPRtpReader(c.String("udp"))
+	case c.String("pipe") != "":
+		rtpReader, err = rtp.NewPipeRtpReader(c.String("pipe"))
+	default:
+		cli.ShowCommandHelp(c, "live")
+		return cli.NewExitError("wrong usage for live, specify interface, udp address or pipe", 1)
+	}
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to open capture", 1), err)
+	}
+	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
+
+	// capture may run for hours, packets are never kept in memory
+	rtpReader.KeepPackets(false)
+	printStream := func(index int, stream *rtp.RtpStream) {
+		fmt.Printf("%d: %s\n", index, stream)
+	}
+	if c.String("codec") != "" {
+		codecMetadata, optionsMap, err := parseCodecFlags(c)
+		if err != nil {
+			return err
+		}
+		pipeline := newDumpPipeline(codecMetadata, optionsMap, c.String("output"), -1)
+		if codecMetadata.Name == autoCodec {
+			pipeline.detectCodecs(!c.IsSet("output"))
+		}
+		pipeline.attach(rtpReader, printStream)
+		defer pipeline.close()
+	} else {
+		index := 0
+		rtpReader.OnStream(func(stream *rtp.RtpStream) {
+			index++
+			printStream(index, stream)
+		})
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		rtpReader.Stop()
+	}()
+
+	log.Info("capturing, press Ctrl+C to stop")
+	rtpStreams := rtpReader.ReadStreams()
+	fmt.Printf("total: %d streams\n", len(rtpStreams))
+	return nil
+}
@@ -2,18 +2,182 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/david-biro/rtpdump/esp"
 	"github.com/david-biro/rtpdump/log"
 	"github.com/david-biro/rtpdump/rtp"
+	"github.com/david-biro/rtpdump/srtp"
 	"github.com/urfave/cli"
 )
 
 func loadKeyFile(c *cli.Context) error {
+	if path := c.GlobalString("srtp-key-file"); path != "" {
+		if err := srtp.LoadKeyFile(path); err != nil {
+			log.Serror("failed to load srtp key file: %s", err)
+		}
+	}
 	return esp.LoadKeyFile(c.GlobalString("key-file"))
 }
 
+// capture file extensions looked for in directories given as input, optionally compressed
+var captureExtensions = []string{".pcap", ".pcapng", ".cap", ".dmp"}
+
+// captureFiles expands globs and directories in command arguments, captures of a directory are sorted by name
+func captureFiles(c *cli.Context) []string {
+	var files []string
+	for _, arg := range c.Args() {
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			matches = []string{arg} // opening it reports the error
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				files = append(files, match)
+				continue
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && isCaptureFile(entry.Name()) {
+					files = append(files, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	return files
+}
+
+func isCaptureFile(name string) bool {
+	name = strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(name), ".gz"), ".zst")
+	for _, extension := range captureExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePorts parses comma separated UDP ports of given protocol
+func parsePorts(ports string, protocol string) ([]uint16, error) {
+	var parsed []uint16
+	for _, port := range strings.Split(ports, ",") {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, cli.NewExitError("invalid "+protocol+" port '"+port+"'", 1)
+		}
+		parsed = append(parsed, uint16(p))
+	}
+	return parsed, nil
+}
+
+// configureReader applies global flags affecting stream identification and statistics
+func configureReader(c *cli.Context, r *rtp.RtpReader) error {
+	r.MergeBySsrc(c.GlobalBool("merge-ssrc"))
+
+	if ports := c.GlobalString("esp-ports"); ports != "" {
+		espPorts, err := parsePorts(ports, "esp")
+		if err != nil {
+			return err
+		}
+		r.SetEspPorts(espPorts)
+	}
+	if ports := c.GlobalString("vxlan-ports"); ports != "" {
+		vxlanPorts, err := parsePorts(ports, "vxlan")
+		if err != nil {
+			return err
+		}
+		r.SetVxlanPorts(vxlanPorts)
+	}
+	if ports := c.GlobalString("geneve-ports"); ports != "" {
+		genevePorts, err := parsePorts(ports, "geneve")
+		if err != nil {
+			return err
+		}
+		r.SetGenevePorts(genevePorts)
+	}
+	pseudowire, err := rtp.ParseMplsPseudowire(c.GlobalString("mpls-pw"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	r.SetMplsPseudowire(pseudowire)
+
+	var allowedPorts, deniedPorts []rtp.PortRange
+	if ports := c.GlobalString("rtp-ports"); ports != "" {
+		if allowedPorts, err = rtp.ParsePortRanges(ports); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if ports := c.GlobalString("ignore-ports"); ports != "" {
+		if deniedPorts, err = rtp.ParsePortRanges(ports); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	r.SetPortFilter(allowedPorts, deniedPorts)
+	if c.GlobalInt("min-sequential") < 1 {
+		return cli.NewExitError("min-sequential must be at least 1", 1)
+	}
+	r.SetMinSequential(c.GlobalInt("min-sequential"))
+
+	var start, end rtp.TimeBound
+	if t := c.GlobalString("start"); t != "" {
+		if start, err = rtp.ParseTimeBound(t); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if t := c.GlobalString("end"); t != "" {
+		if end, err = rtp.ParseTimeBound(t); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	r.SetTimeWindow(start, end)
+
+	if hosts := c.GlobalString("host"); hosts != "" {
+		hostFilter, err := rtp.ParseHosts(hosts)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		r.SetHostFilter(hostFilter)
+	}
+	if ports := c.GlobalString("port"); ports != "" {
+		portFilter, err := rtp.ParsePortRanges(ports)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		r.SetSelectedPorts(portFilter)
+	}
+	if ssrcs := c.GlobalString("ssrc"); ssrcs != "" {
+		ssrcFilter, err := rtp.ParseSsrcs(ssrcs)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		r.SetSsrcFilter(ssrcFilter)
+	}
+
+	if rates := c.GlobalString("clock-rate"); rates != "" {
+		for _, rate := range strings.Split(rates, ",") {
+			values := strings.Split(rate, ":")
+			if len(values) != 2 {
+				return cli.NewExitError("invalid clock rate '"+rate+"', expected \"payload-type:rate\"", 1)
+			}
+			payloadType, err1 := strconv.Atoi(values[0])
+			clockRate, err2 := strconv.Atoi(values[1])
+			if err1 != nil || err2 != nil || payloadType < 0 || payloadType > 127 || clockRate <= 0 {
+				return cli.NewExitError("invalid clock rate '"+rate+"', expected \"payload-type:rate\"", 1)
+			}
+			r.SetClockRate(payloadType, clockRate)
+		}
+	}
+	return nil
+}
+
 func main() {
 	log.SetLevel(log.INFO)
 
@@ -31,27 +195,47 @@ func main() {
 			Name:      "streams",
 			Aliases:   []string{"s"},
 			Usage:     "display rtp streams in pcap file",
-			ArgsUsage: "[pcap-file]",
+			ArgsUsage: "[pcap-file...]",
 			Action:    streamsCmd,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "stats",
+					Usage: "Display loss, jitter, delta and bitrate statistics of every stream",
+				},
+			},
+		},
+		{
+			Name:      "calls",
+			Aliases:   []string{"ca"},
+			Usage:     "display rtp streams grouped into calls with direction, duration, codecs and quality",
+			ArgsUsage: "[pcap-file...]",
+			Action:    callsCmd,
+		},
+		{
+			Name:      "esp",
+			Aliases:   []string{"e"},
+			Usage:     "display ipsec security associations in pcap file with sequence, decryption and authentication statistics",
+			ArgsUsage: "[pcap-file...]",
+			Action:    espCmd,
 		},
 		{
 			Name:      "interactive-dump",
 			Aliases:   []string{"id"},
 			Usage:     "dumps rtp payload to file",
-			ArgsUsage: "[pcap-file]",
+			ArgsUsage: "[pcap-file...]",
 			Action:    interactiveDumpCmd,
 		},
 		{
 			Name:      "dump",
 			Aliases:   []string{"d"},
 			Usage:     "dumps rtp payload to file using parameters from arguments",
-			ArgsUsage: "[pcap-file]",
+			ArgsUsage: "[pcap-file...]",
 			Action:    dumpCmd,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "codec, c",
 					Value: "amr",
-					Usage: "Codec to use for stream decoding",
+					Usage: "Codec to use for stream decoding, \"auto\" detects codec of every stream",
 				},
 				cli.StringFlag{
 					Name:  "flags, f",
@@ -68,17 +252,57 @@ func main() {
 					Value: -1,
 					Usage: "Stream index to decode. By default dumps all streams using output filename as a base name",
 				},
+				cli.IntFlag{
+					Name:  "call",
+					Usage: "Call index, as listed by \"calls\" command, to decode all streams of",
+				},
+			},
+		},
+		{
+			Name:      "live",
+			Aliases:   []string{"l"},
+			Usage:     "displays rtp streams as they appear on an interface, udp socket or pipe, optionally dumping them",
+			ArgsUsage: " ",
+			Action:    liveCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "interface, i",
+					Usage: "Network interface to capture on",
+				},
+				cli.StringFlag{
+					Name:  "udp, u",
+					Usage: "Local address to receive RTP on, e.g. \":5004\"",
+				},
+				cli.StringFlag{
+					Name:  "pipe, r",
+					Usage: "Named pipe with pcap or pcapng data (e.g. from tcpdump -w -), \"-\" reads stdin",
+				},
+				cli.StringFlag{
+					Name:  "codec, c",
+					Usage: "Codec to dump streams with as packets arrive, \"auto\" detects codec of every stream, streams are only displayed if empty",
+				},
+				cli.StringFlag{
+					Name:  "flags, f",
+					Value: "sample-rate:auto,octet-aligned:auto",
+					Usage: "Codec options in \"option:value\" format, separated by comma",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "out.amr",
+					Usage: "Output filename used as a base name for dumped streams",
+				},
 			},
 		},
 		{
 			Name:      "play",
 			Aliases:   []string{"p"},
 			Usage:     "replays the selected rtp stream ;)",
-			ArgsUsage: "[pcap-file]",
+			ArgsUsage: "[pcap-file...]",
 			Action:    playCmd,
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "host", Value: "localhost", Usage: "destination host for replayed RTP packets"},
 				cli.IntFlag{Name: "port", Value: 1234, Usage: "destination port for replayed RTP packets"},
+				cli.IntFlag{Name: "call", Usage: "call index, as listed by \"calls\" command, to replay all streams of"},
 			},
 		},
 		{
@@ -101,6 +325,84 @@ func main() {
 			Value: "esp-keys.txt",
 			Usage: "Load ipsec keys from `FILE`",
 		},
+		cli.StringFlag{
+			Name:  "esp-ports",
+			Value: "4500",
+			Usage: "UDP ports carrying encapsulated ESP, separated by comma",
+		},
+		cli.StringFlag{
+			Name:  "vxlan-ports",
+			Value: "4789",
+			Usage: "UDP ports carrying VXLAN, separated by comma",
+		},
+		cli.StringFlag{
+			Name:  "geneve-ports",
+			Value: "6081",
+			Usage: "UDP ports carrying Geneve, separated by comma",
+		},
+		cli.StringFlag{
+			Name:  "mpls-pw",
+			Value: "auto",
+			Usage: "Payload of MPLS label stacks: \"auto\" for IP, or Ethernet after a control word, \"ethernet\" or \"ethernet-cw\" for Ethernet pseudowires without or with control word",
+		},
+		cli.StringFlag{
+			Name:  "srtp-key-file",
+			Usage: "Load srtp master keys from `FILE`, keys in SDP a=crypto attributes of the capture are used as well",
+		},
+		cli.StringFlag{
+			Name:  "clock-rate",
+			Usage: "Clock rates of dynamic payload types in \"payload-type:rate\" format, separated by comma, 8000 by default",
+		},
+		cli.BoolFlag{
+			Name:  "merge-ssrc",
+			Usage: "Identify streams by SSRC only, merging packets with the same SSRC on different addresses",
+		},
+		cli.StringFlag{
+			Name:  "rtp-ports",
+			Usage: "Only look for RTP and RTCP on these UDP and TCP ports and port ranges, e.g. \"5004,10000-20000\"",
+		},
+		cli.StringFlag{
+			Name:  "ignore-ports",
+			Usage: "Never look for RTP and RTCP on these UDP and TCP ports and port ranges",
+		},
+		cli.StringFlag{
+			Name:  "filter",
+			Usage: "BPF filter applied when reading captures, replacing the default one: " + rtp.RtpCapureFilter,
+		},
+		cli.StringFlag{
+			Name:  "start",
+			Usage: "Skip packets captured before `TIME`, \"dd-mm-yyyy hh:mm:ss\" or ISO 8601 in UTC, or offset from capture start like \"+90s\"",
+		},
+		cli.StringFlag{
+			Name:  "end",
+			Usage: "Skip packets captured after `TIME`, in the same formats as start",
+		},
+		cli.StringFlag{
+			Name:  "host",
+			Usage: "Only look for RTP and RTCP from or to these addresses and networks, separated by comma",
+		},
+		cli.StringFlag{
+			Name:  "port",
+			Usage: "Only look for RTP and RTCP from or to these ports and port ranges, e.g. \"5004,10000-20000\"",
+		},
+		cli.StringFlag{
+			Name:  "ssrc",
+			Usage: "Only report streams with these SSRCs, in hex with 0x prefix or decimal, separated by comma",
+		},
+		cli.IntFlag{
+			Name:  "min-sequential",
+			Value: rtp.MinSequential,
+			Usage: "Packets in sequence, with the same SSRC and payload type, needed to report a stream, 1 disables validation",
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if filter := c.GlobalString("filter"); filter != "" {
+			if err := rtp.SetCaptureFilter(filter); err != nil {
+				return cli.NewExitError("invalid filter: "+err.Error(), 1)
+			}
+		}
+		return nil
 	}
 
 	app.Run(os.Args)
@@ -109,20 +411,23 @@ func main() {
 var streamsCmd = func(c *cli.Context) error {
 	loadKeyFile(c)
 
-	inputFile := c.Args().First()
+	inputFiles := captureFiles(c)
 
-	if len(c.Args()) <= 0 {
+	if len(inputFiles) == 0 {
 		cli.ShowCommandHelp(c, "streams")
 		return cli.NewExitError("wrong usage for streams", 1)
 	}
 
-	rtpReader, err := rtp.NewRtpReader(inputFile)
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
 
 	if err != nil {
 		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
 	}
 
 	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
 
 	rtpStreams := rtpReader.GetStreams()
 
@@ -131,10 +436,35 @@ var streamsCmd = func(c *cli.Context) error {
 		return nil
 	}
 
+	collisions := rtp.SsrcCollisions(rtpStreams)
 	for i, v := range rtpStreams {
-		fmt.Printf("%d: %s\n", i+1, v)
+		if _, ok := collisions[v.Ssrc]; ok {
+			fmt.Printf("%d: %s   [ssrc collision]\n", i+1, v)
+		} else {
+			fmt.Printf("%d: %s\n", i+1, v)
+		}
+		if v.Call != nil {
+			fmt.Printf("   call: %s\n", v.Call)
+		}
+		if c.Bool("stats") {
+			fmt.Printf("   %s\n", v.Stats())
+			if rtcp := v.RtcpStats(); rtcp != "" {
+				fmt.Printf("   rtcp: %s\n", rtcp)
+			}
+		}
 	}
 	fmt.Printf("total: %d streams\n", len(rtpStreams))
+	if len(collisions) > 0 {
+		fmt.Printf("warning: %d SSRCs are used by more than one stream\n", len(collisions))
+	}
+	for _, ctx := range srtp.Contexts() {
+		if ctx.AuthFailures > 0 {
+			fmt.Printf("warning: srtp %s\n", ctx)
+		}
+	}
+	if frags := rtpReader.FragmentStats(); frags.Sets > 0 {
+		fmt.Printf("ip fragments: %s\n", frags)
+	}
 
 	return nil
 }
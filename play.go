@@ -15,9 +15,9 @@ var playCmd = func(c *cli.Context) error {
 
 	loadKeyFile(c)
 
-	inputFile := c.Args().First()
+	inputFiles := captureFiles(c)
 
-	if inputFile == "" {
+	if len(inputFiles) == 0 {
 		cli.ShowCommandHelp(c, "play")
 		return cli.NewExitError("wrong usage for play", 1)
 	}
@@ -25,13 +25,16 @@ var playCmd = func(c *cli.Context) error {
 	host := c.String("host")
 	port := c.Int("port")
 
-	rtpReader, err := rtp.NewRtpReader(inputFile)
+	rtpReader, err := rtp.NewRtpReader(inputFiles...)
 
 	if err != nil {
 		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
 	}
 
 	defer rtpReader.Close()
+	if err := configureReader(c, rtpReader); err != nil {
+		return err
+	}
 
 	rtpStreams := rtpReader.GetStreams()
 
@@ -40,6 +43,17 @@ var playCmd = func(c *cli.Context) error {
 		return nil
 	}
 
+	if c.IsSet("call") {
+		calls := rtp.GroupCalls(rtpStreams)
+		callIndex := c.Int("call")
+		if callIndex < 1 || callIndex > len(calls) {
+			return cli.NewExitError("call with specified index doesn't exist", 1)
+		}
+		fmt.Printf("Playing call %d: %s\n\n", callIndex, calls[callIndex-1])
+		playStreams(calls[callIndex-1].Streams, calls[callIndex-1].StreamIndexes, host, port)
+		return nil
+	}
+
 	var rtpStreamsOptions []string
 	for _, v := range rtpStreams {
 		rtpStreamsOptions = append(rtpStreamsOptions, v.String())
@@ -55,24 +69,11 @@ var playCmd = func(c *cli.Context) error {
 	}
 	if streamIndex == 0 {
 		fmt.Print("Playing all streams\n\n")
-		// Locate the start time of first stream
-		var baseTime time.Time = rtpStreams[0].StartTime
-		for _, v := range rtpStreams {
-			if v.StartTime.Before(baseTime) {
-				baseTime = v.StartTime
-			}
-		}
-		var waitGroup sync.WaitGroup
-		for i, stream := range rtpStreams {
-			// Compute delay start w/respect to start of initial stream
-			first := stream.RtpPackets[0]
-			delay := first.ReceivedAt.Sub(baseTime)
-			waitGroup.Add(1)
-			go playStream(&waitGroup, i+1, stream, host, port+(2*i), delay)
+		indexes := make([]int, len(rtpStreams))
+		for i := range rtpStreams {
+			indexes[i] = i + 1
 		}
-		// wait for all streams players to complete
-		waitGroup.Wait()
-		fmt.Printf("All streams completed\n\n")
+		playStreams(rtpStreams, indexes, host, port)
 	} else {
 		stream := rtpStreams[streamIndex-1]
 		return playStream(nil, streamIndex, stream, host, port, 0)
@@ -81,6 +82,29 @@ var playCmd = func(c *cli.Context) error {
 	return nil
 }
 
+// playStreams replays streams simultaneously, keeping their relative start times,
+// each one to the next even port
+func playStreams(rtpStreams []*rtp.RtpStream, indexes []int, host string, port int) {
+	// Locate the start time of first stream
+	var baseTime time.Time = rtpStreams[0].StartTime
+	for _, v := range rtpStreams {
+		if v.StartTime.Before(baseTime) {
+			baseTime = v.StartTime
+		}
+	}
+	var waitGroup sync.WaitGroup
+	for i, stream := range rtpStreams {
+		// Compute delay start w/respect to start of initial stream
+		first := stream.RtpPackets[0]
+		delay := first.ReceivedAt.Sub(baseTime)
+		waitGroup.Add(1)
+		go playStream(&waitGroup, indexes[i], stream, host, port+(2*i), delay)
+	}
+	// wait for all streams players to complete
+	waitGroup.Wait()
+	fmt.Printf("All streams completed\n\n")
+}
+
 func playStream(wg *sync.WaitGroup, streamIndex int, stream *rtp.RtpStream, host string, port int, delay time.Duration) error {
 
 	// if run as part of a waitgroup, notify done at the completion
@@ -0,0 +1,132 @@
+package rtp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/david-biro/rtpdump/util"
+)
+
+//Call groups streams exchanged between two endpoints, StreamIndexes are 1-based positions of Streams
+//in the list calls were grouped from
+type Call struct {
+	Sip                *SipCall
+	Streams            []*RtpStream
+	StreamIndexes      []int
+	StartTime, EndTime time.Time
+}
+
+// sameEndpoints returns true if streams are sent between the same addresses, in either direction
+func sameEndpoints(a, b *RtpStream) bool {
+	forward := a.SrcIP == b.SrcIP && a.SrcPort == b.SrcPort && a.DstIP == b.DstIP && a.DstPort == b.DstPort
+	reverse := a.SrcIP == b.DstIP && a.SrcPort == b.DstPort && a.DstIP == b.SrcIP && a.DstPort == b.SrcPort
+	return forward || reverse
+}
+
+func overlap(a, b *RtpStream) bool {
+	return !a.StartTime.After(b.EndTime) && !b.StartTime.After(a.EndTime)
+}
+
+// matches returns true if stream belongs to the call by endpoints and time, streams linked
+// to a different SIP dialog never match
+func (c *Call) matches(s *RtpStream) bool {
+	if c.Sip != nil && s.Call != nil && c.Sip.CallID != s.Call.CallID {
+		return false
+	}
+	for _, t := range c.Streams {
+		if sameEndpoints(s, t) && overlap(s, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Call) add(s *RtpStream, index int) {
+	if c.Sip == nil {
+		c.Sip = s.Call
+	}
+	if len(c.Streams) == 0 || s.StartTime.Before(c.StartTime) {
+		c.StartTime = s.StartTime
+	}
+	if s.EndTime.After(c.EndTime) {
+		c.EndTime = s.EndTime
+	}
+	c.Streams = append(c.Streams, s)
+	c.StreamIndexes = append(c.StreamIndexes, index)
+}
+
+//GroupCalls groups streams into calls by SIP Call-ID, streams without one join the call
+//sending media between the same addresses at the same time
+func GroupCalls(streams []*RtpStream) []*Call {
+	var calls []*Call
+	byCallID := make(map[string]*Call)
+	for i, s := range streams {
+		var call *Call
+		if s.Call != nil {
+			call = byCallID[s.Call.CallID]
+		}
+		for j := 0; call == nil && j < len(calls); j++ {
+			if calls[j].matches(s) {
+				call = calls[j]
+			}
+		}
+		if call == nil {
+			call = &Call{}
+			calls = append(calls, call)
+		}
+		call.add(s, i+1)
+		if call.Sip != nil {
+			byCallID[call.Sip.CallID] = call
+		}
+	}
+	sort.SliceStable(calls, func(i, j int) bool {
+		return calls[i].StartTime.Before(calls[j].StartTime)
+	})
+	return calls
+}
+
+//Codecs returns payload formats of the call streams, payload types if not negotiated in SDP
+func (c Call) Codecs() []string {
+	var codecs []string
+	seen := make(map[string]bool)
+	for _, s := range c.Streams {
+		codec := fmt.Sprintf("pt %d", s.PayloadType)
+		if s.Format != nil {
+			codec = s.Format.String()
+		}
+		if !seen[codec] {
+			seen[codec] = true
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+//Direction returns "->" for streams sent in the direction of the first stream of the call, "<-" otherwise
+func (c Call) Direction(s *RtpStream) string {
+	first := c.Streams[0]
+	if s.SrcIP == first.SrcIP && s.SrcPort == first.SrcPort {
+		return "->"
+	}
+	return "<-"
+}
+
+func (c Call) String() string {
+	first := c.Streams[0]
+	s := fmt.Sprintf("%s - %s   %6.1fs   %s:%d <-> %s:%d   %s",
+		util.TimeToStr(c.StartTime),
+		util.TimeToStr(c.EndTime),
+		c.EndTime.Sub(c.StartTime).Seconds(),
+		first.SrcIP,
+		first.SrcPort,
+		first.DstIP,
+		first.DstPort,
+		strings.Join(c.Codecs(), ", "),
+	)
+	if c.Sip != nil {
+		s += "   " + c.Sip.String()
+	}
+	return s
+}
@@ -0,0 +1,235 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fragment sets not completed within this time of their first fragment are dropped, as Linux does
+const fragmentTimeout = 30 * time.Second
+
+// fragment sets being reassembled at most, the oldest one is dropped when exceeded
+const maxFragmentSets = 1024
+
+// fragments of a set at most, an IP packet is 64k at most
+const maxFragments = 128
+
+//FragmentStats counts IP fragments and fragment sets, of outer packets and of packets decapsulated from
+//ESP and GTP-U
+type FragmentStats struct {
+	Fragments   int
+	Sets        int
+	Reassembled int
+	TimedOut    int // sets dropped after fragmentTimeout or when too many sets were pending
+	Incomplete  int // sets missing fragments at the end of the capture
+	Invalid     int // overlapping fragments, or too many or too large
+}
+
+func (s FragmentStats) String() string {
+	return fmt.Sprintf("%d fragments in %d sets, reassembled:%d timed out:%d incomplete:%d invalid:%d",
+		s.Fragments, s.Sets, s.Reassembled, s.TimedOut, s.Incomplete, s.Invalid)
+}
+
+// fragments of a packet have the same addresses, protocol and identification, RFC 791 and RFC 8200
+type fragmentKey struct {
+	src, dst string
+	id       uint32
+	protocol layers.IPProtocol
+	ipv6     bool
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+// fragmentSet collects fragments of a packet, header is the network layer of the first fragment
+type fragmentSet struct {
+	firstSeen time.Time
+	header    gopacket.Layer
+	fragments []ipFragment
+	length    int // payload length known from the last fragment, -1 until received
+	invalid   bool
+}
+
+type defragmenter struct {
+	sets      map[fragmentKey]*fragmentSet
+	lastSweep time.Time
+	stats     FragmentStats
+}
+
+//FragmentStats returns counters of IP fragment reassembly, sets still pending are counted as incomplete
+func (r *RtpReader) FragmentStats() FragmentStats {
+	stats := r.defrag.stats
+	stats.Incomplete = len(r.defrag.sets)
+	return stats
+}
+
+// fragmentOf returns key, offset, payload and more fragments flag of a fragmented IPv4 or IPv6 packet,
+// ok is false for packets that aren't fragments
+func fragmentOf(packet gopacket.Packet) (key fragmentKey, offset int, data []byte, more bool, ok bool) {
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		more = ip.Flags&layers.IPv4MoreFragments != 0
+		if !more && ip.FragOffset == 0 {
+			return
+		}
+		key = fragmentKey{src: ip.SrcIP.String(), dst: ip.DstIP.String(), id: uint32(ip.Id), protocol: ip.Protocol}
+		return key, int(ip.FragOffset) * 8, ip.Payload, more, true
+	case *layers.IPv6:
+		frag, _ := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if frag == nil {
+			return
+		}
+		key = fragmentKey{src: ip.SrcIP.String(), dst: ip.DstIP.String(), id: frag.Identification, protocol: frag.NextHeader, ipv6: true}
+		return key, int(frag.FragmentOffset) * 8, frag.Payload, frag.MoreFragments, true
+	}
+	return
+}
+
+// defragment returns the packet itself if it isn't a fragment, the reassembled packet when its last
+// missing fragment is received, nil otherwise
+func (r *RtpReader) defragment(info *packetInfo, packet gopacket.Packet) gopacket.Packet {
+	key, offset, data, more, ok := fragmentOf(packet)
+	if !ok {
+		return packet
+	}
+	d := &r.defrag
+	d.expire(info.receivedAt)
+	d.stats.Fragments++
+
+	set := d.sets[key]
+	if set == nil {
+		if d.sets == nil {
+			d.sets = make(map[fragmentKey]*fragmentSet)
+		}
+		if len(d.sets) >= maxFragmentSets {
+			d.dropOldest()
+		}
+		set = &fragmentSet{firstSeen: info.receivedAt, length: -1}
+		d.sets[key] = set
+		d.stats.Sets++
+	}
+	if offset == 0 {
+		set.header = packet.NetworkLayer()
+	}
+	if !more {
+		set.length = offset + len(data)
+	}
+	set.add(offset, data)
+	if set.invalid {
+		log.Sdebug("invalid ip fragments of %s -> %s id 0x%x", key.src, key.dst, key.id)
+		delete(d.sets, key)
+		d.stats.Invalid++
+		return nil
+	}
+	payload := set.payload()
+	if payload == nil {
+		return nil
+	}
+	delete(d.sets, key)
+	reassembled, err := rebuildPacket(set.header, key.protocol, payload)
+	if err != nil {
+		log.Sdebug("failed to reassemble ip fragments of %s -> %s id 0x%x: %s", key.src, key.dst, key.id, err)
+		d.stats.Invalid++
+		return nil
+	}
+	d.stats.Reassembled++
+	return reassembled
+}
+
+func (s *fragmentSet) add(offset int, data []byte) {
+	if len(s.fragments) >= maxFragments || offset+len(data) > 65535 || (s.length >= 0 && offset+len(data) > s.length) {
+		s.invalid = true
+		return
+	}
+	for _, f := range s.fragments {
+		if offset < f.offset+len(f.data) && f.offset < offset+len(data) {
+			// retransmitted fragment is fine, overlapping ones are dropped as per RFC 5722
+			if f.offset != offset || len(f.data) != len(data) {
+				s.invalid = true
+			}
+			return
+		}
+	}
+	s.fragments = append(s.fragments, ipFragment{offset: offset, data: append([]byte(nil), data...)})
+}
+
+// payload returns reassembled payload, nil while fragments are missing
+func (s *fragmentSet) payload() []byte {
+	if s.length < 0 || s.header == nil {
+		return nil
+	}
+	sort.Slice(s.fragments, func(i, j int) bool {
+		return s.fragments[i].offset < s.fragments[j].offset
+	})
+	payload := make([]byte, 0, s.length)
+	for _, f := range s.fragments {
+		if f.offset != len(payload) {
+			return nil
+		}
+		payload = append(payload, f.data...)
+	}
+	if len(payload) != s.length {
+		return nil
+	}
+	return payload
+}
+
+// rebuildPacket serializes header of the first fragment, without fragmentation fields, with payload
+func rebuildPacket(header gopacket.Layer, protocol layers.IPProtocol, payload []byte) (gopacket.Packet, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	switch ip := header.(type) {
+	case *layers.IPv4:
+		h := *ip
+		h.Flags &^= layers.IPv4MoreFragments
+		h.FragOffset = 0
+		if err := gopacket.SerializeLayers(buf, opts, &h, gopacket.Payload(payload)); err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default), nil
+	case *layers.IPv6:
+		h := *ip
+		h.NextHeader = protocol
+		h.HopByHop = nil
+		if err := gopacket.SerializeLayers(buf, opts, &h, gopacket.Payload(payload)); err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default), nil
+	}
+	return nil, errors.New("no IP header in first fragment")
+}
+
+// expire drops fragment sets older than fragmentTimeout, checked once a second of capture time
+func (d *defragmenter) expire(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Second {
+		return
+	}
+	d.lastSweep = now
+	for key, set := range d.sets {
+		if now.Sub(set.firstSeen) > fragmentTimeout {
+			log.Sdebug("ip fragments of %s -> %s id 0x%x timed out", key.src, key.dst, key.id)
+			delete(d.sets, key)
+			d.stats.TimedOut++
+		}
+	}
+}
+
+func (d *defragmenter) dropOldest() {
+	var oldest fragmentKey
+	var oldestSeen time.Time
+	for key, set := range d.sets {
+		if oldestSeen.IsZero() || set.firstSeen.Before(oldestSeen) {
+			oldest, oldestSeen = key, set.firstSeen
+		}
+	}
+	delete(d.sets, oldest)
+	d.stats.TimedOut++
+}
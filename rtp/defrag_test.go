@@ -0,0 +1,55 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+type testFragment struct {
+	start, end int // of the datagram, start a multiple of 8
+	at         time.Duration
+}
+
+func TestDefragment(t *testing.T) {
+	datagram := udpDatagram(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 0x1111, make([]byte, 160)))
+	end := len(datagram)
+	tests := []struct {
+		name      string
+		fragments []testFragment
+		streams   int
+		want      FragmentStats
+	}{
+		{"in order", []testFragment{{0, 64, 0}, {64, 128, 0}, {128, end, 0}}, 1,
+			FragmentStats{Fragments: 3, Sets: 1, Reassembled: 1}},
+		{"out of order", []testFragment{{128, end, 0}, {0, 64, 0}, {64, 128, 0}}, 1,
+			FragmentStats{Fragments: 3, Sets: 1, Reassembled: 1}},
+		{"retransmitted", []testFragment{{0, 64, 0}, {0, 64, 0}, {128, end, 0}, {64, 128, 0}}, 1,
+			FragmentStats{Fragments: 4, Sets: 1, Reassembled: 1}},
+		{"overlapping", []testFragment{{0, 64, 0}, {56, 128, 0}, {128, end, 0}}, 0,
+			FragmentStats{Fragments: 3, Sets: 2, Invalid: 1, Incomplete: 1}},
+		{"overlapping same offset", []testFragment{{128, 136, 0}, {128, end, 0}}, 0,
+			FragmentStats{Fragments: 2, Sets: 1, Invalid: 1}},
+		{"missing fragment", []testFragment{{0, 64, 0}, {128, end, 0}}, 0,
+			FragmentStats{Fragments: 2, Sets: 1, Incomplete: 1}},
+		{"timed out", []testFragment{{0, 64, 0}, {64, 128, fragmentTimeout + time.Second}, {128, end, fragmentTimeout + time.Second}}, 0,
+			FragmentStats{Fragments: 3, Sets: 2, TimedOut: 1, Incomplete: 1}},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		r.SetMinSequential(1)
+		for _, f := range tt.fragments {
+			packet := ipv4Packet(t, "192.0.2.1", "192.0.2.2", layers.IPProtocolUDP, 0x4242, f.end < end, uint16(f.start/8), datagram[f.start:f.end])
+			feed(r, packet, f.at)
+		}
+		if got := r.FragmentStats(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if len(r.rtpStreamsSorted) != tt.streams {
+			t.Errorf("%s: got %d streams, want %d", tt.name, len(r.rtpStreamsSorted), tt.streams)
+		} else if tt.streams > 0 && r.rtpStreamsSorted[0].SrcPort != 5000 {
+			t.Errorf("%s: got stream %s", tt.name, r.rtpStreamsSorted[0])
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// VxlanPort is the registered VXLAN port, RFC 7348
+const VxlanPort = 4789
+
+// GenevePort is the registered Geneve port, RFC 8926
+const GenevePort = 6081
+
+const (
+	vxlanHeaderLength      = 8
+	vxlanFlagVni           = 0x08
+	geneveHeaderLength     = 8
+	erspanIIHeaderLength   = 8
+	erspanIIIHeaderLength  = 12
+	erspanIIIFlagSubheader = 0x01
+	erspanSubheaderLength  = 8
+	ethernetTypeERSPANIII  = 0x22EB
+)
+
+// linkTypeLinuxSLL2 is LINKTYPE_LINUX_SLL2, of "any" interface captures of recent libpcap. gopacket link types
+// are 8 bit, so packet sources read it from the capture file and convert its frames to LINKTYPE_LINUX_SLL
+const linkTypeLinuxSLL2 = 276
+
+const (
+	linuxSLL2HeaderLength = 20
+	linuxSLLHeaderLength  = 16
+)
+
+// fromLinuxSLL2 rewrites the Linux SLL2 header of a frame in place as Linux SLL header, which has the same
+// fields but the interface index, frames too short are left to fail decoding
+func fromLinuxSLL2(data []byte, ci gopacket.CaptureInfo) ([]byte, gopacket.CaptureInfo, layers.LinkType) {
+	if len(data) < linuxSLL2HeaderLength {
+		return data, ci, layers.LinkTypeLinuxSLL
+	}
+	var sll [linuxSLLHeaderLength]byte
+	sll[1] = data[10]            // packet type
+	copy(sll[2:4], data[8:10])   // ARPHRD type
+	sll[5] = data[11]            // address length
+	copy(sll[6:14], data[12:20]) // address
+	copy(sll[14:16], data[0:2])  // protocol type
+	data = data[linuxSLL2HeaderLength-linuxSLLHeaderLength:]
+	copy(data, sll[:])
+	shrink := linuxSLL2HeaderLength - linuxSLLHeaderLength
+	ci.CaptureLength -= shrink
+	ci.Length -= shrink
+	return data, ci, layers.LinkTypeLinuxSLL
+}
+
+//EncapID identifies a tag or tunnel a stream was carried in, e.g. VLAN 100 or VXLAN network 5001
+type EncapID struct {
+	Kind string // vlan, mpls, vxlan, geneve, gre or erspan
+	ID   uint32
+}
+
+func (e EncapID) String() string {
+	return fmt.Sprintf("%s:%d", e.Kind, e.ID)
+}
+
+//Encapsulation lists tags and tunnels outside of the IP header of a stream, outermost first
+type Encapsulation []EncapID
+
+func (e Encapsulation) String() string {
+	ids := make([]string, len(e))
+	for i, id := range e {
+		ids[i] = id.String()
+	}
+	return strings.Join(ids, " ")
+}
+
+//Vlans returns VLAN IDs of outer and inner 802.1Q and 802.1ad tags
+func (e Encapsulation) Vlans() []uint16 {
+	var vlans []uint16
+	for _, id := range e {
+		if id.Kind == "vlan" {
+			vlans = append(vlans, uint16(id.ID))
+		}
+	}
+	return vlans
+}
+
+//Vni returns VXLAN or Geneve network identifier of the innermost overlay, false if there is none
+func (e Encapsulation) Vni() (uint32, bool) {
+	for i := len(e) - 1; i >= 0; i-- {
+		if e[i].Kind == "vxlan" || e[i].Kind == "geneve" {
+			return e[i].ID, true
+		}
+	}
+	return 0, false
+}
+
+// with returns a copy with ids appended, packetInfo copies of TCP frames share the slice
+func (e Encapsulation) with(ids ...EncapID) Encapsulation {
+	return append(e[:len(e):len(e)], ids...)
+}
+
+//SetVxlanPorts sets UDP ports carrying VXLAN, VxlanPort by default
+func (r *RtpReader) SetVxlanPorts(ports []uint16) {
+	r.vxlanPorts = make(map[uint16]bool)
+	for _, port := range ports {
+		r.vxlanPorts[port] = true
+	}
+}
+
+//SetGenevePorts sets UDP ports carrying Geneve, GenevePort by default
+func (r *RtpReader) SetGenevePorts(ports []uint16) {
+	r.genevePorts = make(map[uint16]bool)
+	for _, port := range ports {
+		r.genevePorts[port] = true
+	}
+}
+
+func (r *RtpReader) isVxlanPort(port layers.UDPPort) bool {
+	if r.vxlanPorts == nil {
+		return port == VxlanPort
+	}
+	return r.vxlanPorts[uint16(port)]
+}
+
+func (r *RtpReader) isGenevePort(port layers.UDPPort) bool {
+	if r.genevePorts == nil {
+		return port == GenevePort
+	}
+	return r.genevePorts[uint16(port)]
+}
+
+//MplsPseudowire tells what MPLS label stacks carry
+type MplsPseudowire int
+
+const (
+	//MplsAuto is IP told by its version, or Ethernet after a control word (RFC 4448)
+	MplsAuto MplsPseudowire = iota
+	//MplsEthernet is Ethernet without control word
+	MplsEthernet
+	//MplsEthernetCW is Ethernet after a control word
+	MplsEthernetCW
+)
+
+//ParseMplsPseudowire parses "auto", "ethernet" or "ethernet-cw"
+func ParseMplsPseudowire(s string) (MplsPseudowire, error) {
+	switch s {
+	case "auto", "":
+		return MplsAuto, nil
+	case "ethernet":
+		return MplsEthernet, nil
+	case "ethernet-cw":
+		return MplsEthernetCW, nil
+	}
+	return MplsAuto, errors.New("invalid MPLS pseudowire '" + s + "'")
+}
+
+//SetMplsPseudowire sets what MPLS label stacks carry, MplsAuto by default
+func (r *RtpReader) SetMplsPseudowire(pw MplsPseudowire) {
+	r.mplsPseudowire = pw
+}
+
+// addLinkEncapsulation records VLAN tags and MPLS labels of the packet, up to its first IP header
+func addLinkEncapsulation(info *packetInfo, packet gopacket.Packet) {
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Dot1Q:
+			info.encap = info.encap.with(EncapID{"vlan", uint32(l.VLANIdentifier)})
+		case *layers.MPLS:
+			info.encap = info.encap.with(EncapID{"mpls", l.Label})
+		case *layers.IPv4, *layers.IPv6:
+			return
+		}
+	}
+}
+
+// decodeMPLSPayload decodes Ethernet carried in an MPLS pseudowire, RFC 4448. In auto mode only payloads
+// starting with a control word are taken for Ethernet, its flags, fragment and length bits are zero for
+// Ethernet pseudowires; IP directly after the label stack is decoded by gopacket
+func (r *RtpReader) decodeMPLSPayload(info *packetInfo, packet gopacket.Packet) error {
+	var mpls *layers.MPLS
+	for _, layer := range packet.Layers() {
+		if l, ok := layer.(*layers.MPLS); ok && l.StackBottom {
+			mpls = l
+		}
+	}
+	if mpls == nil {
+		return errors.New("Failed to decode packet")
+	}
+	payload := mpls.Payload
+	switch r.mplsPseudowire {
+	case MplsAuto, MplsEthernetCW:
+		if len(payload) < 4 || (r.mplsPseudowire == MplsAuto && (payload[0] != 0 || payload[1] != 0)) {
+			return errors.New("No MPLS pseudowire control word")
+		}
+		payload = payload[4:]
+	}
+	return r.decodePacket(info, gopacket.NewPacket(payload, layers.LayerTypeEthernet, gopacket.Default))
+}
+
+// decodeVXLANLayer decodes Ethernet frame of a VXLAN packet, RFC 7348
+func (r *RtpReader) decodeVXLANLayer(info *packetInfo, payload []byte) error {
+	if len(payload) < vxlanHeaderLength || payload[0]&vxlanFlagVni == 0 {
+		return errors.New("Not VXLAN packet")
+	}
+	vni := binary.BigEndian.Uint32(payload[4:8]) >> 8
+	info.encap = info.encap.with(EncapID{"vxlan", vni})
+	return r.decodePacket(info, gopacket.NewPacket(payload[vxlanHeaderLength:], layers.LayerTypeEthernet, gopacket.Default))
+}
+
+// decodeGeneveLayer decodes Ethernet frame or IP packet of a Geneve packet, RFC 8926
+func (r *RtpReader) decodeGeneveLayer(info *packetInfo, payload []byte) error {
+	if len(payload) < geneveHeaderLength || payload[0]>>6 != 0 {
+		return errors.New("Not Geneve packet")
+	}
+	length := geneveHeaderLength + int(payload[0]&0x3F)*4
+	if len(payload) < length {
+		return errors.New("Geneve options truncated")
+	}
+	protocol := layers.EthernetType(binary.BigEndian.Uint16(payload[2:4]))
+	vni := binary.BigEndian.Uint32(payload[4:8]) >> 8
+	info.encap = info.encap.with(EncapID{"geneve", vni})
+	return r.decodePacket(info, gopacket.NewPacket(payload[length:], protocol, gopacket.Default))
+}
+
+// decodeGRELayer decodes packet carried in GRE, including frames mirrored with ERSPAN type I, II and III
+func (r *RtpReader) decodeGRELayer(info *packetInfo, payload []byte) error {
+	gre := &layers.GRE{}
+	if err := gre.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return err
+	}
+	if gre.KeyPresent {
+		info.encap = info.encap.with(EncapID{"gre", gre.Key})
+	}
+	inner := gre.Payload
+	switch gre.Protocol {
+	case layers.EthernetTypeERSPAN:
+		// type I has no header and no sequence number
+		if gre.SeqPresent {
+			if len(inner) < erspanIIHeaderLength {
+				return errors.New("ERSPAN type II header too short")
+			}
+			info.encap = info.encap.with(EncapID{"erspan", uint32(binary.BigEndian.Uint16(inner[2:4]) & 0x3FF)})
+			inner = inner[erspanIIHeaderLength:]
+		}
+		return r.decodePacket(info, gopacket.NewPacket(inner, layers.LayerTypeEthernet, gopacket.Default))
+	case ethernetTypeERSPANIII:
+		if len(inner) < erspanIIIHeaderLength {
+			return errors.New("ERSPAN type III header too short")
+		}
+		info.encap = info.encap.with(EncapID{"erspan", uint32(binary.BigEndian.Uint16(inner[2:4]) & 0x3FF)})
+		length := erspanIIIHeaderLength
+		if inner[erspanIIIHeaderLength-1]&erspanIIIFlagSubheader != 0 {
+			length += erspanSubheaderLength
+		}
+		if len(inner) < length {
+			return errors.New("ERSPAN type III subheader truncated")
+		}
+		return r.decodePacket(info, gopacket.NewPacket(inner[length:], layers.LayerTypeEthernet, gopacket.Default))
+	}
+	return r.decodePacket(info, gopacket.NewPacket(inner, gre.Protocol, gopacket.Default))
+}
@@ -0,0 +1,99 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testMAC = []byte{0x02, 0, 0, 0, 0, 0x01}
+
+// sll2Frame prefixes packet with Linux SLL2 header of a frame received on interface 3
+func sll2Frame(protocol layers.EthernetType, packet []byte) []byte {
+	header := make([]byte, linuxSLL2HeaderLength, linuxSLL2HeaderLength+len(packet))
+	binary.BigEndian.PutUint16(header, uint16(protocol))
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint16(header[8:], 1) // ARPHRD_ETHER
+	header[10] = byte(layers.LinuxSLLPacketTypeHost)
+	header[11] = byte(len(testMAC))
+	copy(header[12:], testMAC)
+	return append(header, packet...)
+}
+
+// ethernetFrame prefixes packet with Ethernet header sent to dst
+func ethernetFrame(dst []byte, protocol layers.EthernetType, packet []byte) []byte {
+	frame := append(append(append([]byte{}, dst...), testMAC...), 0, 0)
+	binary.BigEndian.PutUint16(frame[12:], uint16(protocol))
+	return append(frame, packet...)
+}
+
+func TestLinuxSLL2(t *testing.T) {
+	ip := udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 0x1111, make([]byte, 160))).Data()
+	frame := sll2Frame(layers.EthernetTypeIPv4, ip)
+	data, ci, linkType := fromLinuxSLL2(frame, gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame) + 10})
+	if linkType != layers.LinkTypeLinuxSLL || ci.CaptureLength != len(ip)+linuxSLLHeaderLength || ci.Length != len(ip)+linuxSLLHeaderLength+10 {
+		t.Fatalf("got link type %s, lengths %d and %d", linkType, ci.CaptureLength, ci.Length)
+	}
+	packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+	sll, ok := packet.Layer(layers.LayerTypeLinuxSLL).(*layers.LinuxSLL)
+	if !ok || packet.Layer(layers.LayerTypeUDP) == nil {
+		t.Fatalf("got %s", packet)
+	}
+	if sll.PacketType != layers.LinuxSLLPacketTypeHost || sll.AddrType != 1 || !bytes.Equal(sll.Addr, testMAC) ||
+		sll.EthernetType != layers.EthernetTypeIPv4 {
+		t.Errorf("got %+v", sll)
+	}
+
+	// too short to convert, left to fail decoding
+	if data, _, _ := fromLinuxSLL2(frame[:10], gopacket.CaptureInfo{}); !bytes.Equal(data, frame[:10]) {
+		t.Errorf("got %x, want %x", data, frame[:10])
+	}
+}
+
+// Ethernet pseudowires are recognized by their control word, or configured
+func TestMplsPseudowire(t *testing.T) {
+	ip := udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 0x1111, make([]byte, 160))).Data()
+	controlWord := []byte{0, 0, 0, 7}
+	// gopacket would take this destination MAC for the start of an IPv4 header
+	ipLikeMAC := []byte{0x46, 0, 0, 0, 0, 0x02}
+	tests := []struct {
+		name       string
+		pseudowire MplsPseudowire
+		payload    []byte
+		streams    int
+	}{
+		{"ip", MplsAuto, ip, 1},
+		{"ethernet with control word", MplsAuto, compound(controlWord, ethernetFrame(testMAC, layers.EthernetTypeIPv4, ip)), 1},
+		{"ethernet without control word", MplsAuto, ethernetFrame(testMAC, layers.EthernetTypeIPv4, ip), 0},
+		{"configured ethernet", MplsEthernet, ethernetFrame(ipLikeMAC, layers.EthernetTypeIPv4, ip), 1},
+		{"configured ethernet with control word", MplsEthernetCW, compound([]byte{0, 0x10, 0, 7}, ethernetFrame(testMAC, layers.EthernetTypeIPv4, ip)), 1},
+		{"configured ethernet, ip", MplsEthernetCW, ip, 0},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		r.SetMinSequential(1)
+		r.SetMplsPseudowire(tt.pseudowire)
+		label := []byte{0, 0x06, 0x41, 64} // label 100, bottom of stack
+		frame := ethernetFrame(testMAC, layers.EthernetTypeMPLSUnicast, compound(label, tt.payload))
+		feed(r, gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default), 0)
+		if len(r.rtpStreamsSorted) != tt.streams {
+			t.Errorf("%s: got %d streams, want %d", tt.name, len(r.rtpStreamsSorted), tt.streams)
+		} else if tt.streams > 0 && r.rtpStreamsSorted[0].Encapsulation.String() != "mpls:100" {
+			t.Errorf("%s: got encapsulation %s", tt.name, r.rtpStreamsSorted[0].Encapsulation)
+		}
+	}
+}
+
+func TestParseMplsPseudowire(t *testing.T) {
+	for s, want := range map[string]MplsPseudowire{"auto": MplsAuto, "ethernet": MplsEthernet, "ethernet-cw": MplsEthernetCW} {
+		if got, err := ParseMplsPseudowire(s); got != want || err != nil {
+			t.Errorf("%s: got %d, %v", s, got, err)
+		}
+	}
+	if _, err := ParseMplsPseudowire("ip"); err == nil {
+		t.Error("ip: got no error")
+	}
+}
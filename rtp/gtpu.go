@@ -0,0 +1,156 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// GtpuPort is the registered GTP-U port used on S1-U and N3
+const GtpuPort = 2152
+
+const (
+	gtpuMessageGPDU            = 0xFF
+	gtpuExtPduSessionContainer = 0x85
+	gtpuPduTypeDownlink        = 0
+	gtpuPduTypeUplink          = 1
+	gtpuFlagExtensionHeader    = 0x04
+	gtpuFlagSequenceNumber     = 0x02
+	gtpuFlagNPdu               = 0x01
+	gtpuMandatoryHeaderLength  = 8
+	gtpuOptionalFieldsLength   = 4
+	gtpuDirectionUnknown       = 0
+	gtpuDirectionUplink        = 1
+	gtpuDirectionDownlink      = 2
+)
+
+func init() {
+	// GTP-U is decoded by decodeGTPULayer, gopacket decoder only handles the basic header
+	layers.RegisterUDPPortLayerType(GtpuPort, gopacket.LayerTypePayload)
+}
+
+// GtpTunnel describes the GTP-U tunnel a stream was carried in
+type GtpTunnel struct {
+	Teid                   uint32
+	OuterSrcIP, OuterDstIP string
+	// known only when PDU session container (N3) tells the direction
+	UeIP string
+	Qfi  int
+}
+
+func (t GtpTunnel) String() string {
+	s := fmt.Sprintf("teid:0x%08X via %s -> %s", t.Teid, t.OuterSrcIP, t.OuterDstIP)
+	if t.UeIP != "" {
+		s += fmt.Sprintf(" ue:%s qfi:%d", t.UeIP, t.Qfi)
+	}
+	return s
+}
+
+// gtpuInfo is collected from the outer packet while decapsulating
+type gtpuInfo struct {
+	teid               uint32
+	outerSrc, outerDst string
+	direction          int
+	qfi                int
+}
+
+func (g *gtpuInfo) tunnelInfo(innerSrc, innerDst string) *GtpTunnel {
+	t := &GtpTunnel{
+		Teid:       g.teid,
+		OuterSrcIP: g.outerSrc,
+		OuterDstIP: g.outerDst,
+		Qfi:        g.qfi,
+	}
+	switch g.direction {
+	case gtpuDirectionUplink:
+		t.UeIP = innerSrc
+	case gtpuDirectionDownlink:
+		t.UeIP = innerDst
+	}
+	return t
+}
+
+// parseGTPU returns tunnel information and the T-PDU of a G-PDU message, see 3GPP TS 29.281
+func parseGTPU(data []byte) (*gtpuInfo, []byte, error) {
+	if len(data) < gtpuMandatoryHeaderLength {
+		return nil, nil, errors.New("GTP-U header too short")
+	}
+	flags := data[0]
+	if flags>>5 != 1 || flags&0x10 == 0 {
+		return nil, nil, errors.New("not GTPv1-U")
+	}
+	if data[1] != gtpuMessageGPDU {
+		return nil, nil, fmt.Errorf("GTP-U message type %d does not carry user data", data[1])
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < gtpuMandatoryHeaderLength+length {
+		return nil, nil, errors.New("GTP-U message truncated")
+	}
+	// anything after the indicated length is link layer padding
+	data = data[:gtpuMandatoryHeaderLength+length]
+
+	info := &gtpuInfo{teid: binary.BigEndian.Uint32(data[4:8])}
+	offset := gtpuMandatoryHeaderLength
+	if flags&(gtpuFlagExtensionHeader|gtpuFlagSequenceNumber|gtpuFlagNPdu) == 0 {
+		return info, data[offset:], nil
+	}
+
+	offset += gtpuOptionalFieldsLength
+	if len(data) < offset {
+		return nil, nil, errors.New("GTP-U optional fields truncated")
+	}
+	nextType := data[offset-1]
+	if flags&gtpuFlagExtensionHeader == 0 {
+		nextType = 0
+	}
+	for nextType != 0 {
+		if len(data) < offset+1 {
+			return nil, nil, errors.New("GTP-U extension header truncated")
+		}
+		extLength := int(data[offset]) * 4 // in 4-octet units, including length and next type
+		if extLength == 0 || len(data) < offset+extLength {
+			return nil, nil, errors.New("GTP-U invalid extension header length")
+		}
+		content := data[offset+1 : offset+extLength-1]
+		if nextType == gtpuExtPduSessionContainer && len(content) >= 2 {
+			switch content[0] >> 4 {
+			case gtpuPduTypeDownlink:
+				info.direction = gtpuDirectionDownlink
+			case gtpuPduTypeUplink:
+				info.direction = gtpuDirectionUplink
+			}
+			info.qfi = int(content[1] & 0x3F)
+		}
+		log.Strace("GTP-U extension header 0x%02x, length %d", nextType, extLength)
+		nextType = data[offset+extLength-1]
+		offset += extLength
+	}
+	return info, data[offset:], nil
+}
+
+func (r *RtpReader) decodeGTPULayer(info *packetInfo, src string, dst string, payload []byte) error {
+	gtp, tpdu, err := parseGTPU(payload)
+	if err != nil {
+		return err
+	}
+	if len(tpdu) == 0 {
+		return errors.New("GTP-U message without T-PDU")
+	}
+	gtp.outerSrc, gtp.outerDst = src, dst
+
+	var innerPacket gopacket.Packet
+	switch tpdu[0] >> 4 {
+	case 4:
+		innerPacket = gopacket.NewPacket(tpdu, layers.LayerTypeIPv4, gopacket.Default)
+	case 6:
+		innerPacket = gopacket.NewPacket(tpdu, layers.LayerTypeIPv6, gopacket.Default)
+	default:
+		return errors.New("GTP-U T-PDU is not IP")
+	}
+	info.gtp = gtp
+	return r.decodePacket(info, innerPacket)
+}
@@ -0,0 +1,93 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// gtpu builds G-PDU with flags, optional fields and extension headers are part of header
+func gtpu(flags byte, teid uint32, header, tpdu []byte) []byte {
+	message := []byte{flags, gtpuMessageGPDU, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(message[2:], uint16(len(header)+len(tpdu)))
+	binary.BigEndian.PutUint32(message[4:], teid)
+	message = append(message, header...)
+	return append(message, tpdu...)
+}
+
+// PDU session container, 3GPP TS 38.415, followed by next extension header type
+func pduSessionContainer(pduType, qfi, next byte) []byte {
+	return []byte{1, pduType << 4, qfi, next}
+}
+
+func TestParseGTPU(t *testing.T) {
+	tpdu := []byte{0x45, 0, 0, 20}
+	tests := []struct {
+		name      string
+		message   []byte
+		teid      uint32
+		direction int
+		qfi       int
+		err       bool
+	}{
+		{"basic header", gtpu(0x30, 0x1234, nil, tpdu), 0x1234, gtpuDirectionUnknown, 0, false},
+		{"sequence number", gtpu(0x32, 1, []byte{0, 7, 0, 0}, tpdu), 1, gtpuDirectionUnknown, 0, false},
+		{"next type without extension flag", gtpu(0x32, 1, []byte{0, 7, 0, gtpuExtPduSessionContainer}, tpdu), 1, gtpuDirectionUnknown, 0, false},
+		{"uplink pdu session container", gtpu(0x34, 2, append([]byte{0, 0, 0, gtpuExtPduSessionContainer},
+			pduSessionContainer(gtpuPduTypeUplink, 9, 0)...), tpdu), 2, gtpuDirectionUplink, 9, false},
+		{"chained extension headers", gtpu(0x36, 3, append([]byte{0, 1, 0, 0x40, 1, 0x08, 0x68, gtpuExtPduSessionContainer},
+			pduSessionContainer(gtpuPduTypeDownlink, 5, 0)...), tpdu), 3, gtpuDirectionDownlink, 5, false},
+		{"longer extension header", gtpu(0x34, 4, []byte{0, 0, 0, gtpuExtPduSessionContainer,
+			2, gtpuPduTypeUplink << 4, 0x41, 0, 0, 0, 0, 0}, tpdu), 4, gtpuDirectionUplink, 1, false},
+		{"zero extension length", gtpu(0x34, 5, []byte{0, 0, 0, gtpuExtPduSessionContainer, 0, 0, 0, 0}, tpdu), 0, 0, 0, true},
+		{"extension truncated", gtpu(0x34, 6, []byte{0, 0, 0, gtpuExtPduSessionContainer, 3, 0, 0, 0}, nil), 0, 0, 0, true},
+		{"optional fields truncated", gtpu(0x32, 7, []byte{0, 7}, nil), 0, 0, 0, true},
+		{"echo request", append([]byte{0x32, 1, 0, 4, 0, 0, 0, 0}, 0, 1, 0, 0), 0, 0, 0, true},
+		{"gtpv2", gtpu(0x48, 8, nil, tpdu), 0, 0, 0, true},
+		{"message truncated", gtpu(0x30, 9, nil, tpdu)[:10], 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		info, got, err := parseGTPU(tt.message)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if info.teid != tt.teid || info.direction != tt.direction || info.qfi != tt.qfi {
+			t.Errorf("%s: got teid 0x%x direction %d qfi %d, want 0x%x, %d, %d", tt.name, info.teid, info.direction, info.qfi, tt.teid, tt.direction, tt.qfi)
+		}
+		if !bytes.Equal(got, tpdu) {
+			t.Errorf("%s: got T-PDU %x, want %x", tt.name, got, tpdu)
+		}
+	}
+
+	// link layer padding after the message isn't part of the T-PDU
+	if _, got, err := parseGTPU(append(gtpu(0x30, 1, nil, tpdu), 0, 0)); err != nil || !bytes.Equal(got, tpdu) {
+		t.Errorf("padded: got T-PDU %x, %v, want %x", got, err, tpdu)
+	}
+}
+
+// streams in GTP-U tunnels tell the tunnel, and the UE address once the direction is known
+func TestDecodeGTPU(t *testing.T) {
+	r := newTestReader()
+	r.SetMinSequential(1)
+	inner := udpPacket(t, "10.45.0.2", 5000, "198.51.100.7", 6000, rtpBytes(0, 1, 160, 0x1111, make([]byte, 160))).Data()
+	header := append([]byte{0, 0, 0, gtpuExtPduSessionContainer}, pduSessionContainer(gtpuPduTypeUplink, 9, 0)...)
+	outer := udpPacket(t, "192.0.2.10", GtpuPort, "192.0.2.20", GtpuPort, gtpu(0x34, 0xABCD, header, inner))
+	if err := feed(r, outer, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.rtpStreamsSorted) != 1 {
+		t.Fatalf("got %d streams, want 1", len(r.rtpStreamsSorted))
+	}
+	s := r.rtpStreamsSorted[0]
+	want := GtpTunnel{Teid: 0xABCD, OuterSrcIP: "192.0.2.10", OuterDstIP: "192.0.2.20", UeIP: "10.45.0.2", Qfi: 9}
+	if s.SrcIP != "10.45.0.2" || s.Tunnel == nil || *s.Tunnel != want {
+		t.Errorf("got stream %s tunnel %+v, want %+v", s, s.Tunnel, want)
+	}
+}
@@ -0,0 +1,199 @@
+package rtp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david-biro/rtpdump/log"
+)
+
+//MinSequential is the default number of packets in sequence needed before a new stream is reported,
+//as in RFC 3550 appendix A.1
+const MinSequential = 2
+
+// packets kept for a candidate stream at most, duplicates and late packets don't advance probation
+const maxProbationPackets = 32
+
+// sequence number gap still considered in sequence, so streams with loss are validated as well
+const maxProbationGap = 16
+
+// candidates idle this long are dropped, a stream sends packets far more often and is validated within a few
+const candidateTimeout = 10 * time.Second
+
+// candidates kept at most, the least recently active one is dropped when exceeded
+const maxCandidates = 8192
+
+//PortRange is an inclusive range of UDP ports
+type PortRange struct {
+	First, Last uint16
+}
+
+//ParsePortRanges parses comma separated ports and ranges, e.g. "5004,10000-20000"
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, field := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(field), "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, errors.New("invalid port '" + field + "'")
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.ParseUint(bounds[1], 10, 16); err != nil || last < first {
+				return nil, errors.New("invalid port range '" + field + "'")
+			}
+		}
+		ranges = append(ranges, PortRange{uint16(first), uint16(last)})
+	}
+	return ranges, nil
+}
+
+func inPortRanges(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+//SetPortFilter restricts ports RTP and RTCP are looked for on, to allowed ones if any and never on denied ones
+func (r *RtpReader) SetPortFilter(allow []PortRange, deny []PortRange) {
+	r.allowedPorts, r.deniedPorts = allow, deny
+}
+
+//SetMinSequential sets number of packets in sequence, with the same SSRC and payload type, needed before
+//a new stream is reported, 1 reports streams from their first packet
+func (r *RtpReader) SetMinSequential(n int) {
+	r.minSequential = n
+}
+
+func (r *RtpReader) isMediaPort(srcPort, dstPort uint16) bool {
+	if inPortRanges(r.deniedPorts, srcPort) || inPortRanges(r.deniedPorts, dstPort) {
+		return false
+	}
+	return len(r.allowedPorts) == 0 || inPortRanges(r.allowedPorts, srcPort) || inPortRanges(r.allowedPorts, dstPort)
+}
+
+// isRtspPort returns true for RTSP connections, unless their port is denied
+func (r *RtpReader) isRtspPort(srcPort, dstPort uint16) bool {
+	if inPortRanges(r.deniedPorts, srcPort) || inPortRanges(r.deniedPorts, dstPort) {
+		return false
+	}
+	return srcPort == RtspPort || dstPort == RtspPort
+}
+
+// pendingPacket is a packet of a stream on probation, added once the stream is validated
+type pendingPacket struct {
+	info             packetInfo
+	key              streamKey
+	src, dst         string
+	srcPort, dstPort uint
+	rtp              *RtpLayer
+}
+
+// rtpCandidate is a flow that may carry a new stream
+type rtpCandidate struct {
+	ssrc        uint32
+	payloadType int
+	lastSeq     uint16
+	sequential  int
+	packets     []*pendingPacket
+	lastSeen    time.Time
+}
+
+// trusted returns true for packets that don't need validation: authenticated SRTP or media negotiated in SDP
+func (r *RtpReader) trusted(p *pendingPacket) bool {
+	if p.info.srtp != nil {
+		return true
+	}
+	if r.sipEndpoints == nil {
+		return false
+	}
+	_, src := r.sipEndpoints[net.JoinHostPort(p.src, strconv.Itoa(int(p.srcPort)))]
+	_, dst := r.sipEndpoints[net.JoinHostPort(p.dst, strconv.Itoa(int(p.dstPort)))]
+	return src || dst
+}
+
+// probe keeps packets of unknown streams until enough of them are in sequence, with consistent SSRC and
+// payload type, random UDP traffic looking like RTP rarely is, returns packets of a validated stream
+func (r *RtpReader) probe(p *pendingPacket) []*pendingPacket {
+	minSequential := r.minSequential
+	if minSequential <= 0 {
+		minSequential = MinSequential
+	}
+	if minSequential == 1 || r.trusted(p) {
+		return []*pendingPacket{p}
+	}
+
+	// candidates are tracked by flow, so a packet with another SSRC restarts probation
+	flow := streamKey{srcIP: p.src, dstIP: p.dst, srcPort: p.srcPort, dstPort: p.dstPort, encap: p.info.encap.String()}
+	if p.info.gtp != nil {
+		flow.teid, flow.tunneled = p.info.gtp.teid, true
+	}
+	if r.candidates == nil {
+		r.candidates = make(map[streamKey]*rtpCandidate)
+	}
+	r.expireCandidates(p.info.receivedAt)
+
+	rtp := p.rtp
+	c, ok := r.candidates[flow]
+	if ok && c.ssrc == rtp.Ssrc && c.payloadType == rtp.PayloadType && len(c.packets) < maxProbationPackets {
+		switch diff := int16(rtp.SequenceNumber - c.lastSeq); {
+		case diff > 0 && diff <= maxProbationGap:
+			c.sequential++
+			c.lastSeq = rtp.SequenceNumber
+		case diff <= 0 && diff > -maxProbationPackets:
+			// duplicate or late packet
+		default:
+			ok = false
+		}
+	} else {
+		ok = false
+	}
+	if !ok {
+		c = &rtpCandidate{ssrc: rtp.Ssrc, payloadType: rtp.PayloadType, lastSeq: rtp.SequenceNumber, sequential: 1}
+		r.addCandidate(flow, c)
+	}
+	c.packets = append(c.packets, p)
+	c.lastSeen = p.info.receivedAt
+
+	if c.sequential < minSequential {
+		return nil
+	}
+	delete(r.candidates, flow)
+	return c.packets
+}
+
+// addCandidate starts probation of a flow, dropping the least recently active candidate if too many are kept
+func (r *RtpReader) addCandidate(flow streamKey, c *rtpCandidate) {
+	if _, ok := r.candidates[flow]; !ok && len(r.candidates) >= maxCandidates {
+		var oldest streamKey
+		var oldestSeen time.Time
+		first := true
+		for k, candidate := range r.candidates {
+			if first || candidate.lastSeen.Before(oldestSeen) {
+				oldest, oldestSeen, first = k, candidate.lastSeen, false
+			}
+		}
+		log.Sdebug("too many RTP candidates, dropping %s:%d -> %s:%d", oldest.srcIP, oldest.srcPort, oldest.dstIP, oldest.dstPort)
+		delete(r.candidates, oldest)
+	}
+	r.candidates[flow] = c
+}
+
+// expireCandidates drops candidates idle for longer than candidateTimeout, checked once a second of capture time
+func (r *RtpReader) expireCandidates(now time.Time) {
+	if now.Sub(r.candidateSweep) < time.Second {
+		return
+	}
+	r.candidateSweep = now
+	for flow, c := range r.candidates {
+		if now.Sub(c.lastSeen) > candidateTimeout {
+			delete(r.candidates, flow)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/srtp"
+	"github.com/google/gopacket/layers"
+)
+
+// RTCP packet types, RFC 3550, RFC 4585 and RFC 3611
+const (
+	rtcpSenderReport   = 200
+	rtcpReceiverReport = 201
+	rtcpSourceDesc     = 202
+	rtcpBye            = 203
+	rtcpApp            = 204
+	rtcpTransportFb    = 205
+	rtcpPayloadFb      = 206
+	rtcpExtendedReport = 207
+)
+
+// feedback message types and XR block types
+const (
+	rtcpFbGenericNack = 1
+	rtcpFbPli         = 1
+	rtcpFbFir         = 4
+	rtcpSdesCname     = 1
+	rtcpXrVoipMetrics = 7
+)
+
+// XR VoIP metrics values meaning the metric is unavailable
+const (
+	xrUnavailable     = 127
+	xrUnavailableLong = 0xFFFF
+)
+
+//RtcpStats is what RTCP packets told about a stream: reports of the far end receiving it,
+//its sender reports and feedback about it, all times in milliseconds
+type RtcpStats struct {
+	Packets         uint
+	SenderReports   uint
+	ReceiverReports uint
+	SenderPackets   uint32 // from last sender report
+	SenderOctets    uint32
+	Cname           string
+	Bye             bool
+	ByeReason       string
+	App             uint
+
+	// from report blocks about the stream, jitter in timestamp units
+	Reports        uint
+	FractionLost   float32
+	CumulativeLost int32
+	Jitter         uint32
+	MaxJitter      uint32
+	RoundTrip      float32
+	MaxRoundTrip   float32
+
+	// RFC 4585 and RFC 5104 feedback about the stream
+	NackedPackets uint
+	Nacks         uint
+	Plis          uint
+	Firs          uint
+
+	// from last RFC 3611 VoIP metrics block about the stream, nil if none
+	VoipMetrics *XrVoipMetrics
+}
+
+//XrVoipMetrics is RTCP-XR VoIP metrics report block, negative values are unavailable
+type XrVoipMetrics struct {
+	LossRate       float32 // percent
+	DiscardRate    float32 // percent
+	RoundTripDelay int
+	EndSystemDelay int
+	RFactor        int
+	MosLq          float32
+	MosCq          float32
+}
+
+func (m XrVoipMetrics) String() string {
+	return fmt.Sprintf("loss:%.2f%% discard:%.2f%% rtd:%dms esd:%dms r:%d mos-lq:%.1f mos-cq:%.1f",
+		m.LossRate, m.DiscardRate, m.RoundTripDelay, m.EndSystemDelay, m.RFactor, m.MosLq, m.MosCq)
+}
+
+// senderReportKey identifies sender report by its ssrc, RTCP addresses and ports and middle 32 bits of
+// NTP timestamp, as referenced by LSR of report blocks sent back on the same ports
+type senderReportKey struct {
+	flow rtcpKey
+	lsr  uint32
+}
+
+// isRtcpPacket tells RTCP from RTP sharing a port, RTCP packet types 192-223 match RTP payload types
+// 64-95 with marker set, which aren't used for RTP with rtcp-mux (RFC 5761 section 4)
+func isRtcpPacket(payload []byte) bool {
+	if len(payload) < 8 || payload[0]>>6 != 2 {
+		return false
+	}
+	if payload[1] < 192 || payload[1] > 223 {
+		return false
+	}
+	return (int(binary.BigEndian.Uint16(payload[2:4]))+1)*4 <= len(payload)
+}
+
+// rtcpKey identifies the stream RTCP statistics are about by its ssrc, addresses and RTP ports, or by RTCP
+// ports until the stream is seen, only ssrc is kept if streams are merged by ssrc
+type rtcpKey struct {
+	ssrc             uint32
+	srcIP, dstIP     string
+	srcPort, dstPort uint
+}
+
+// rtcpFlow is the direction an RTCP packet was sent in
+type rtcpFlow struct {
+	src, dst         string
+	srcPort, dstPort uint
+}
+
+func (r *RtpReader) rtcpKey(ssrc uint32, src string, srcPort uint, dst string, dstPort uint) rtcpKey {
+	if r.mergeBySsrc {
+		return rtcpKey{ssrc: ssrc}
+	}
+	return rtcpKey{ssrc: ssrc, srcIP: src, dstIP: dst, srcPort: srcPort, dstPort: dstPort}
+}
+
+// rtcpStatsKey returns key of statistics RTCP sent on ports srcPort and dstPort is about, RTCP is on the
+// RTP ports with rtcp-mux (RFC 5761) and on the ports next to them otherwise (RFC 3550 section 11)
+func (r *RtpReader) rtcpStatsKey(ssrc uint32, src string, srcPort uint, dst string, dstPort uint) rtcpKey {
+	key := r.rtcpKey(ssrc, src, srcPort, dst, dstPort)
+	if _, ok := r.rtcpStats[key]; ok || srcPort == 0 || dstPort == 0 {
+		return key
+	}
+	if rtpKey := r.rtcpKey(ssrc, src, srcPort-1, dst, dstPort-1); r.rtcpStats[rtpKey] != nil {
+		return rtpKey
+	}
+	return key
+}
+
+// streamRtcp returns RTCP statistics of a new stream, those kept by RTCP ports next to its RTP ports
+// before the stream was seen are taken over
+func (r *RtpReader) streamRtcp(ssrc uint32, src string, srcPort uint, dst string, dstPort uint) *RtcpStats {
+	key := r.rtcpKey(ssrc, src, srcPort, dst, dstPort)
+	if stats, ok := r.rtcpStats[key]; ok {
+		return stats
+	}
+	rtcpKey := r.rtcpKey(ssrc, src, srcPort+1, dst, dstPort+1)
+	if stats, ok := r.rtcpStats[rtcpKey]; ok {
+		delete(r.rtcpStats, rtcpKey)
+		r.rtcpStats[key] = stats
+		return stats
+	}
+	return r.rtcpFor(key)
+}
+
+// rtcpFor returns RTCP statistics of the stream identified by key
+func (r *RtpReader) rtcpFor(key rtcpKey) *RtcpStats {
+	if r.rtcpStats == nil {
+		r.rtcpStats = make(map[rtcpKey]*RtcpStats)
+	}
+	stats, ok := r.rtcpStats[key]
+	if !ok {
+		stats = &RtcpStats{}
+		r.rtcpStats[key] = stats
+	}
+	return stats
+}
+
+// sentStats returns statistics of ssrc sent by the source of the RTCP packet, e.g. of a sender report
+func (r *RtpReader) sentStats(flow rtcpFlow, ssrc uint32) *RtcpStats {
+	return r.rtcpFor(r.rtcpStatsKey(ssrc, flow.src, flow.srcPort, flow.dst, flow.dstPort))
+}
+
+// receivedStats returns statistics of ssrc received by the source of the RTCP packet, e.g. of a report block
+func (r *RtpReader) receivedStats(flow rtcpFlow, ssrc uint32) *RtcpStats {
+	return r.rtcpFor(r.rtcpStatsKey(ssrc, flow.dst, flow.dstPort, flow.src, flow.srcPort))
+}
+
+// decodeRTCP parses compound RTCP packet, SRTCP is decrypted first
+func (r *RtpReader) decodeRTCP(info *packetInfo, src string, dst string, udp *layers.UDP) error {
+	data := udp.Payload
+	ssrc := binary.BigEndian.Uint32(data[4:8])
+	if ctx := srtp.LookupRTCP(ssrc, src, uint(udp.SrcPort), dst, uint(udp.DstPort)); ctx != nil {
+		plain, err := ctx.DecryptRTCP(data)
+		if err != nil {
+			return err
+		}
+		data = plain
+	}
+
+	flow := rtcpFlow{src: src, dst: dst, srcPort: uint(udp.SrcPort), dstPort: uint(udp.DstPort)}
+	for len(data) >= 4 {
+		length := (int(binary.BigEndian.Uint16(data[2:4])) + 1) * 4
+		if data[0]>>6 != 2 || length > len(data) {
+			return errors.New("invalid RTCP packet")
+		}
+		packet := data[:length]
+		if data[0]&0x20 != 0 { // padding
+			padding := int(packet[length-1])
+			if padding == 0 || padding > length-4 {
+				return errors.New("invalid RTCP padding")
+			}
+			packet = packet[:length-padding]
+		}
+		r.decodeRTCPPacket(info, flow, packet)
+		data = data[length:]
+	}
+	return nil
+}
+
+func (r *RtpReader) decodeRTCPPacket(info *packetInfo, flow rtcpFlow, packet []byte) {
+	count := int(packet[0] & 0x1F)
+	packetType := packet[1]
+	body := packet[4:]
+	log.Strace("RTCP packet type %d count %d length %d", packetType, count, len(packet))
+
+	switch packetType {
+	case rtcpSenderReport:
+		// sender ssrc, NTP timestamp, RTP timestamp, packet count, octet count, report blocks
+		if len(body) < 24 {
+			return
+		}
+		ssrc := binary.BigEndian.Uint32(body[0:4])
+		stats := r.sentStats(flow, ssrc)
+		stats.Packets++
+		stats.SenderReports++
+		stats.SenderPackets = binary.BigEndian.Uint32(body[16:20])
+		stats.SenderOctets = binary.BigEndian.Uint32(body[20:24])
+		if r.senderReports == nil {
+			r.senderReports = make(map[senderReportKey]time.Time)
+		}
+		key := senderReportKey{r.rtcpKey(ssrc, flow.src, flow.srcPort, flow.dst, flow.dstPort), binary.BigEndian.Uint32(body[6:10])}
+		r.senderReports[key] = info.receivedAt
+		r.decodeReportBlocks(info, flow, body[24:], count)
+	case rtcpReceiverReport:
+		if len(body) < 4 {
+			return
+		}
+		stats := r.sentStats(flow, binary.BigEndian.Uint32(body[0:4]))
+		stats.Packets++
+		stats.ReceiverReports++
+		r.decodeReportBlocks(info, flow, body[4:], count)
+	case rtcpSourceDesc:
+		r.decodeSourceDescription(flow, body, count)
+	case rtcpBye:
+		if len(body) < count*4 {
+			return
+		}
+		reason := ""
+		if len(body) > count*4 {
+			if n := int(body[count*4]); len(body) >= count*4+1+n {
+				reason = string(body[count*4+1 : count*4+1+n])
+			}
+		}
+		for i := 0; i < count; i++ {
+			stats := r.sentStats(flow, binary.BigEndian.Uint32(body[i*4:]))
+			stats.Packets++
+			stats.Bye, stats.ByeReason = true, reason
+		}
+	case rtcpApp:
+		if len(body) < 8 {
+			return
+		}
+		stats := r.sentStats(flow, binary.BigEndian.Uint32(body[0:4]))
+		stats.Packets++
+		stats.App++
+		log.Sdebug("RTCP APP '%s' subtype %d from 0x%08X", string(body[4:8]), count, binary.BigEndian.Uint32(body[0:4]))
+	case rtcpTransportFb, rtcpPayloadFb:
+		r.decodeFeedback(flow, packetType, count, body)
+	case rtcpExtendedReport:
+		r.decodeExtendedReport(flow, body)
+	}
+}
+
+// decodeReportBlocks updates stats of reported streams, round-trip time is computed from capture times of
+// the sender report and the report block referencing it, so it's the one between the capture point and the far end
+func (r *RtpReader) decodeReportBlocks(info *packetInfo, flow rtcpFlow, blocks []byte, count int) {
+	for i := 0; i < count && len(blocks) >= 24; i++ {
+		ssrc := binary.BigEndian.Uint32(blocks[0:4])
+		stats := r.receivedStats(flow, ssrc)
+		stats.Reports++
+		stats.FractionLost = float32(blocks[4]) * 100 / 256
+		// cumulative number of packets lost is a signed 24 bit value
+		stats.CumulativeLost = int32(binary.BigEndian.Uint32(blocks[4:8])<<8) >> 8
+		stats.Jitter = binary.BigEndian.Uint32(blocks[12:16])
+		if stats.Jitter > stats.MaxJitter {
+			stats.MaxJitter = stats.Jitter
+		}
+
+		lsr := binary.BigEndian.Uint32(blocks[16:20])
+		dlsr := binary.BigEndian.Uint32(blocks[20:24])
+		if sentAt, ok := r.senderReports[senderReportKey{r.rtcpKey(ssrc, flow.dst, flow.dstPort, flow.src, flow.srcPort), lsr}]; ok && lsr != 0 {
+			delay := time.Duration(uint64(dlsr) * uint64(time.Second) / 65536)
+			if rtt := info.receivedAt.Sub(sentAt) - delay; rtt >= 0 {
+				stats.RoundTrip = float32(rtt) / float32(time.Millisecond)
+				if stats.RoundTrip > stats.MaxRoundTrip {
+					stats.MaxRoundTrip = stats.RoundTrip
+				}
+			}
+		}
+		blocks = blocks[24:]
+	}
+}
+
+func (r *RtpReader) decodeSourceDescription(flow rtcpFlow, body []byte, count int) {
+	for i := 0; i < count && len(body) >= 4; i++ {
+		stats := r.sentStats(flow, binary.BigEndian.Uint32(body[0:4]))
+		stats.Packets++
+		offset := 4
+		for offset < len(body) && body[offset] != 0 {
+			if offset+2 > len(body) || offset+2+int(body[offset+1]) > len(body) {
+				return
+			}
+			itemType, itemLen := body[offset], int(body[offset+1])
+			if itemType == rtcpSdesCname {
+				stats.Cname = string(body[offset+2 : offset+2+itemLen])
+			}
+			offset += 2 + itemLen
+		}
+		// null item terminates the chunk, which is padded to a 32 bit boundary
+		offset = (offset + 4) &^ 3
+		if offset > len(body) {
+			return
+		}
+		body = body[offset:]
+	}
+}
+
+func (r *RtpReader) decodeFeedback(flow rtcpFlow, packetType byte, format int, body []byte) {
+	// sender ssrc, media source ssrc, feedback control information
+	if len(body) < 8 {
+		return
+	}
+	mediaSsrc := binary.BigEndian.Uint32(body[4:8])
+	fci := body[8:]
+	switch {
+	case packetType == rtcpTransportFb && format == rtcpFbGenericNack:
+		stats := r.receivedStats(flow, mediaSsrc)
+		stats.Packets++
+		stats.Nacks++
+		for ; len(fci) >= 4; fci = fci[4:] {
+			// packet id and bitmask of following lost packets
+			stats.NackedPackets += 1 + uint(bits.OnesCount16(binary.BigEndian.Uint16(fci[2:4])))
+		}
+	case packetType == rtcpPayloadFb && format == rtcpFbPli:
+		stats := r.receivedStats(flow, mediaSsrc)
+		stats.Packets++
+		stats.Plis++
+	case packetType == rtcpPayloadFb && format == rtcpFbFir:
+		// media source is in FCI entries, RFC 5104 section 4.3.1
+		for ; len(fci) >= 8; fci = fci[8:] {
+			stats := r.receivedStats(flow, binary.BigEndian.Uint32(fci[0:4]))
+			stats.Packets++
+			stats.Firs++
+		}
+	}
+}
+
+func (r *RtpReader) decodeExtendedReport(flow rtcpFlow, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	blocks := body[4:]
+	for len(blocks) >= 4 {
+		blockType := blocks[0]
+		length := (int(binary.BigEndian.Uint16(blocks[2:4])) + 1) * 4
+		if length > len(blocks) {
+			return
+		}
+		if blockType == rtcpXrVoipMetrics && length >= 36 {
+			stats := r.receivedStats(flow, binary.BigEndian.Uint32(blocks[4:8]))
+			stats.Packets++
+			stats.VoipMetrics = parseVoipMetrics(blocks[:36])
+		}
+		blocks = blocks[length:]
+	}
+}
+
+// parseVoipMetrics parses RFC 3611 section 4.7 block
+func parseVoipMetrics(block []byte) *XrVoipMetrics {
+	delay := func(b []byte) int {
+		if v := binary.BigEndian.Uint16(b); v != xrUnavailableLong {
+			return int(v)
+		}
+		return -1
+	}
+	score := func(b byte) int {
+		if b != xrUnavailable {
+			return int(b)
+		}
+		return -1
+	}
+	mos := func(b byte) float32 {
+		if b != xrUnavailable {
+			return float32(b) / 10
+		}
+		return -1
+	}
+	return &XrVoipMetrics{
+		LossRate:       float32(block[8]) * 100 / 256,
+		DiscardRate:    float32(block[9]) * 100 / 256,
+		RoundTripDelay: delay(block[16:18]),
+		EndSystemDelay: delay(block[18:20]),
+		RFactor:        score(block[24]),
+		MosLq:          mos(block[26]),
+		MosCq:          mos(block[27]),
+	}
+}
@@ -0,0 +1,186 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// rtcpPacket builds RTCP packet with count or format field and body padded to 32 bits
+func rtcpPacket(count int, packetType byte, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	packet := []byte{0x80 | byte(count), packetType, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(body)/4))
+	return append(packet, body...)
+}
+
+func words(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// reportBlock builds report block, cumulative number of packets lost is 24 bits
+func reportBlock(ssrc uint32, fractionLost byte, cumulativeLost int32, jitter, lsr, dlsr uint32) []byte {
+	return words(ssrc, uint32(fractionLost)<<24|uint32(cumulativeLost)&0xFFFFFF, 1000, jitter, lsr, dlsr)
+}
+
+// senderReport builds SR, ntpMiddle is the middle 32 bits of the NTP timestamp referenced by LSR
+func senderReport(ssrc, ntpMiddle, packets, octets uint32, blocks ...[]byte) []byte {
+	body := words(ssrc, ntpMiddle>>16, ntpMiddle<<16, 8000, packets, octets)
+	for _, block := range blocks {
+		body = append(body, block...)
+	}
+	return rtcpPacket(len(blocks), rtcpSenderReport, body)
+}
+
+func receiverReport(ssrc uint32, blocks ...[]byte) []byte {
+	body := words(ssrc)
+	for _, block := range blocks {
+		body = append(body, block...)
+	}
+	return rtcpPacket(len(blocks), rtcpReceiverReport, body)
+}
+
+func compound(packets ...[]byte) []byte {
+	var data []byte
+	for _, p := range packets {
+		data = append(data, p...)
+	}
+	return data
+}
+
+func TestDecodeRtcp(t *testing.T) {
+	const sender, media = 0x11111111, 0x22222222
+	voipMetrics := words(sender, media)[4:]
+	voipMetrics = append([]byte{rtcpXrVoipMetrics, 0, 0, 8}, voipMetrics...)
+	voipMetrics = append(voipMetrics, 64, 0, 0, 0, 0, 0, 0, 0, 0, 120, 0xFF, 0xFF, 0, 0, 0, 0, 90, 127, 41, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+	bye := append(words(sender), 4)
+	bye = append(bye, "done"...)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		ssrc  uint32
+		sent  bool // stats of ssrc sent by the source of the packet, else received by it
+		check func(s *RtcpStats) bool
+	}{
+		{"sender report", senderReport(sender, 0x12345678, 100, 16000), sender, true, func(s *RtcpStats) bool {
+			return s.SenderReports == 1 && s.SenderPackets == 100 && s.SenderOctets == 16000 && s.Packets == 1
+		}},
+		{"sender report block", senderReport(sender, 0x12345678, 100, 16000, reportBlock(media, 64, -1, 80, 0, 0)), media, false, func(s *RtcpStats) bool {
+			return s.Reports == 1 && s.FractionLost == 25 && s.CumulativeLost == -1 && s.Jitter == 80 && s.MaxJitter == 80
+		}},
+		{"receiver report", receiverReport(sender, reportBlock(media, 128, 5, 40, 0, 0)), media, false, func(s *RtcpStats) bool {
+			return s.Reports == 1 && s.FractionLost == 50 && s.CumulativeLost == 5 && s.Jitter == 40
+		}},
+		{"receiver report sender", receiverReport(sender), sender, true, func(s *RtcpStats) bool {
+			return s.ReceiverReports == 1 && s.Reports == 0
+		}},
+		{"generic nack", rtcpPacket(rtcpFbGenericNack, rtcpTransportFb, words(sender, media, 100<<16|0x0005, 200<<16)), media, false, func(s *RtcpStats) bool {
+			return s.Nacks == 1 && s.NackedPackets == 4
+		}},
+		{"pli", rtcpPacket(rtcpFbPli, rtcpPayloadFb, words(sender, media)), media, false, func(s *RtcpStats) bool {
+			return s.Plis == 1 && s.Nacks == 0
+		}},
+		{"fir", rtcpPacket(rtcpFbFir, rtcpPayloadFb, words(sender, 0, media, 1<<24)), media, false, func(s *RtcpStats) bool {
+			return s.Firs == 1
+		}},
+		{"xr voip metrics", rtcpPacket(0, rtcpExtendedReport, append(words(sender), voipMetrics...)), media, false, func(s *RtcpStats) bool {
+			m := s.VoipMetrics
+			return m != nil && m.LossRate == 25 && m.DiscardRate == 0 && m.RoundTripDelay == 120 && m.EndSystemDelay == -1 &&
+				m.RFactor == 90 && m.MosLq == 4.1 && m.MosCq == -1
+		}},
+		{"compound with sdes and bye", compound(
+			receiverReport(sender),
+			rtcpPacket(1, rtcpSourceDesc, append(words(sender), append([]byte{rtcpSdesCname, 9}, "alice@pbx"...)...)),
+			rtcpPacket(1, rtcpBye, bye),
+		), sender, true, func(s *RtcpStats) bool {
+			return s.Packets == 3 && s.Cname == "alice@pbx" && s.Bye && s.ByeReason == "done"
+		}},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		if err := feed(r, udpPacket(t, "192.0.2.1", 5001, "192.0.2.2", 6001, tt.data), 0); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		key := r.rtcpKey(tt.ssrc, "192.0.2.1", 5001, "192.0.2.2", 6001)
+		if !tt.sent {
+			key = r.rtcpKey(tt.ssrc, "192.0.2.2", 6001, "192.0.2.1", 5001)
+		}
+		s := r.rtcpStats[key]
+		if s == nil || !tt.check(s) {
+			t.Errorf("%s: got %+v", tt.name, s)
+		}
+	}
+}
+
+// round-trip time is the time between capture of the sender report and of the report block referencing
+// it, less the delay since last sender report of the far end
+func TestRtcpRoundTrip(t *testing.T) {
+	r := newTestReader()
+	feed(r, udpPacket(t, "192.0.2.1", 5001, "192.0.2.2", 6001, senderReport(0x1111, 0x12345678, 1, 160)), 0)
+	rr := receiverReport(0x2222, reportBlock(0x1111, 0, 0, 0, 0x12345678, 65536/8))
+	feed(r, udpPacket(t, "192.0.2.2", 6001, "192.0.2.1", 5001, rr), 175*time.Millisecond)
+	s := r.rtcpStats[r.rtcpKey(0x1111, "192.0.2.1", 5001, "192.0.2.2", 6001)]
+	if s == nil || s.RoundTrip != 50 || s.MaxRoundTrip != 50 {
+		t.Errorf("got %+v, want round trip of 50ms", s)
+	}
+
+	// report block sent back on other ports doesn't reference the sender report
+	r.rtcpStats = nil
+	feed(r, udpPacket(t, "192.0.2.2", 6003, "192.0.2.1", 5003, rr), 175*time.Millisecond)
+	if s := r.rtcpStats[r.rtcpKey(0x1111, "192.0.2.1", 5003, "192.0.2.2", 6003)]; s == nil || s.RoundTrip != 0 {
+		t.Errorf("got %+v, want no round trip", s)
+	}
+}
+
+// RTCP is matched to the stream it's about on the ports next to RTP, also when RTP is on an odd port,
+// or on the RTP ports themselves with rtcp-mux
+func TestRtcpPorts(t *testing.T) {
+	tests := []struct {
+		name      string
+		rtpPorts  [2]uint16
+		rtcpPorts [2]uint16
+		rtcpFirst bool
+	}{
+		{"next ports", [2]uint16{5000, 6000}, [2]uint16{5001, 6001}, false},
+		{"next ports before rtp", [2]uint16{5000, 6000}, [2]uint16{5001, 6001}, true},
+		{"odd rtp port", [2]uint16{5001, 6001}, [2]uint16{5002, 6002}, false},
+		{"odd rtp port before rtp", [2]uint16{5001, 6001}, [2]uint16{5002, 6002}, true},
+		{"rtcp-mux", [2]uint16{5001, 6001}, [2]uint16{5001, 6001}, false},
+		{"rtcp-mux before rtp", [2]uint16{5001, 6001}, [2]uint16{5001, 6001}, true},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		r.SetMinSequential(1)
+		sendRtp := func() {
+			feed(r, udpPacket(t, "192.0.2.1", tt.rtpPorts[0], "192.0.2.2", tt.rtpPorts[1], rtpBytes(0, 1, 160, 0x1111, make([]byte, 160))), 0)
+		}
+		sendRtcp := func() {
+			feed(r, udpPacket(t, "192.0.2.1", tt.rtcpPorts[0], "192.0.2.2", tt.rtcpPorts[1], senderReport(0x1111, 0, 1, 160)), 0)
+			rr := receiverReport(0x2222, reportBlock(0x1111, 0, 3, 0, 0, 0))
+			feed(r, udpPacket(t, "192.0.2.2", tt.rtcpPorts[1], "192.0.2.1", tt.rtcpPorts[0], rr), 0)
+		}
+		if tt.rtcpFirst {
+			sendRtcp()
+			sendRtp()
+		} else {
+			sendRtp()
+			sendRtcp()
+		}
+		if len(r.rtpStreamsSorted) != 1 {
+			t.Errorf("%s: got %d streams, want 1", tt.name, len(r.rtpStreamsSorted))
+			continue
+		}
+		s := r.rtpStreamsSorted[0].Rtcp
+		if s == nil || s.SenderReports != 1 || s.Reports != 1 || s.CumulativeLost != 3 {
+			t.Errorf("%s: got %+v", tt.name, s)
+		}
+	}
+}
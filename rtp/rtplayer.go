@@ -9,7 +9,7 @@ import (
 	"github.com/google/gopacket"
 )
 
-var RtpCapureFilter string = "udp or vlan and not (" +
+var RtpCapureFilter string = "udp or tcp or ip proto 50 or ip6 proto 50 or ip proto 47 or ip6 proto 47 or ether proto 0x8847 or vlan and not (" +
 	"udp port 53 or " + // DNS
 	"udp port 138 or " + // NETBIOS
 	"udp port 67 or " + // BOOTSTRAP
@@ -17,8 +17,7 @@ var RtpCapureFilter string = "udp or vlan and not (" +
 	"udp port 1900 or " + // SSDP
 	//"udp port 4500 or " + // Allow IKE for decrypt
 	"udp port 500 or " + // IKE
-	"udp port 123 or " + // NTP
-	"port 5060" +
+	"udp port 123" + // NTP
 	")"
 
 type RtpLayer struct {
@@ -1,113 +1,329 @@
 package rtp
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"io"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/david-biro/rtpdump/esp"
 	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/srtp"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // RtpReader reads
 type RtpReader struct {
-	handle           *pcap.Handle
-	rtpStreamsMap    map[uint32]*RtpStream
+	source           packetSource
+	rtpStreamsMap    map[streamKey]*RtpStream
 	rtpStreamsSorted []*RtpStream
-	filePath         string
+	filePaths        []string
+	stopped          int32
+	discardPackets   bool
+	mergeBySsrc      bool
+	clockRates       map[int]int
+	espPorts         map[uint16]bool
+	vxlanPorts       map[uint16]bool
+	genevePorts      map[uint16]bool
+	mplsPseudowire   MplsPseudowire
+	sipEndpoints     map[string]*sipEndpoint
+	sdpGeneration    int
+	rtcpStats        map[rtcpKey]*RtcpStats
+	senderReports    map[senderReportKey]time.Time
+	allowedPorts     []PortRange
+	deniedPorts      []PortRange
+	minSequential    int
+	candidates       map[streamKey]*rtpCandidate
+	candidateSweep   time.Time
+	start, end       TimeBound
+	captureStart     time.Time
+	hosts            []*net.IPNet
+	selectedPorts    []PortRange
+	ssrcs            map[uint32]bool
+	tcpFlows         map[tcpFlowKey]*tcpFlow
+	tcpSweep         time.Time
+	defrag           defragmenter
+
+	onStream func(stream *RtpStream)
+	onPacket func(stream *RtpStream, packet *RtpPacket)
+}
+
+// streams are identified by 5-tuple and ssrc, tunneled ones also by GTP-U TEID, VLAN IDs and other
+// encapsulation identifiers
+type streamKey struct {
+	ssrc             uint32
+	srcIP, dstIP     string
+	srcPort, dstPort uint
+	teid             uint32
+	tunneled         bool
+	encap            string
 }
 
-//NewRtpReader creates new reader
-func NewRtpReader(path string) (reader *RtpReader, err error) {
+// NatTraversalPort is the UDP port of encapsulated ESP, RFC 3948
+const NatTraversalPort = 4500
+
+// packetInfo carries capture details collected while decoding encapsulations down to rtp
+type packetInfo struct {
+	receivedAt time.Time
+	gtp        *gtpuInfo
+	srtp       *srtp.Context
+	framing    string
+	encap      Encapsulation
+}
+
+//NewRtpReader creates reader of capture files, packets of several files are merged by timestamp
+func NewRtpReader(paths ...string) (reader *RtpReader, err error) {
 	reader = &RtpReader{}
-	reader.rtpStreamsMap = make(map[uint32]*RtpStream)
-	err = reader.openPcapFile(path)
+	reader.rtpStreamsMap = make(map[streamKey]*RtpStream)
+	err = reader.openPcapFiles(paths)
 	return
 }
 
-func (r *RtpReader) openPcapFile(path string) (err error) {
-	r.filePath = path
-	r.handle, err = pcap.OpenOffline(path)
-	if err != nil {
-		log.Error("Failed to open pcap file, note that pcapng format is not supported\nplease convert to legacy pcap format before using this tool")
-		return err
-	}
-	err = r.handle.SetBPFFilter(RtpCapureFilter)
-	if err != nil {
-		r.handle.Close()
-		log.Error("Failed to set bpf file")
-		return err
-	}
-	return nil
+//NewLiveRtpReader creates reader capturing on network interface
+func NewLiveRtpReader(device string) (reader *RtpReader, err error) {
+	reader = &RtpReader{}
+	reader.rtpStreamsMap = make(map[streamKey]*RtpStream)
+	reader.source, err = openInterface(device)
+	return
 }
 
-func (r *RtpReader) reOpenPcapFile() {
+//NewPipeRtpReader creates reader for pcap or pcapng written to a named pipe, "-" reads stdin
+func NewPipeRtpReader(path string) (reader *RtpReader, err error) {
+	reader = &RtpReader{}
+	reader.rtpStreamsMap = make(map[streamKey]*RtpStream)
+	reader.source, err = openCaptureStream(path)
+	return
+}
+
+//NewUDPRtpReader creates reader receiving rtp on a local udp address
+func NewUDPRtpReader(address string) (reader *RtpReader, err error) {
+	reader = &RtpReader{}
+	reader.rtpStreamsMap = make(map[streamKey]*RtpStream)
+	reader.source, err = openUDPSocket(address)
+	return
+}
+
+func (r *RtpReader) openPcapFiles(paths []string) (err error) {
+	r.filePaths = paths
+	r.source, err = openCaptureFiles(paths)
+	return err
+}
+
+func (r *RtpReader) reOpenPcapFiles() {
 	r.Close()
-	r.openPcapFile(r.filePath)
+	r.tcpFlows, r.tcpSweep = nil, time.Time{}
+	r.candidates, r.candidateSweep = nil, time.Time{}
+	r.defrag = defragmenter{}
+	esp.ResetSecurityAssociations()
+	srtp.ResetContexts()
+	r.openPcapFiles(r.filePaths)
 }
 
 //Close rtp reader
 func (r *RtpReader) Close() {
-	r.handle.Close()
+	r.source.Close()
+}
+
+//OnStream sets function called for every new stream as soon as its first packet is read
+func (r *RtpReader) OnStream(f func(stream *RtpStream)) {
+	r.onStream = f
+}
+
+//OnPacket sets function called for every rtp packet after it was added to its stream
+func (r *RtpReader) OnPacket(f func(stream *RtpStream, packet *RtpPacket)) {
+	r.onPacket = f
+}
+
+//KeepPackets sets whether streams hold their packets, without them packets are
+//only passed to OnPacket function and memory doesn't grow with capture size
+func (r *RtpReader) KeepPackets(keep bool) {
+	r.discardPackets = !keep
+}
+
+//MergeBySsrc sets whether packets with the same ssrc belong to one stream regardless
+//of addresses, e.g. to follow a stream relayed through an SBC as a single one
+func (r *RtpReader) MergeBySsrc(merge bool) {
+	r.mergeBySsrc = merge
+}
+
+//SetClockRate sets RTP timestamp clock rate of a payload type, used for jitter calculation
+func (r *RtpReader) SetClockRate(payloadType int, rate int) {
+	if r.clockRates == nil {
+		r.clockRates = make(map[int]int)
+	}
+	r.clockRates[payloadType] = rate
+}
+
+//SetEspPorts sets UDP ports carrying encapsulated ESP, NatTraversalPort by default
+func (r *RtpReader) SetEspPorts(ports []uint16) {
+	r.espPorts = make(map[uint16]bool)
+	for _, port := range ports {
+		r.espPorts[port] = true
+	}
+}
+
+func (r *RtpReader) isEspPort(port layers.UDPPort) bool {
+	if r.espPorts == nil {
+		return port == NatTraversalPort
+	}
+	return r.espPorts[uint16(port)]
+}
+
+//Stop makes ReadStreams return after the packet being read, safe to call from another goroutine
+func (r *RtpReader) Stop() {
+	atomic.StoreInt32(&r.stopped, 1)
 }
 
 //GetStreams returns rtp streams identified
 func (r *RtpReader) GetStreams() []*RtpStream {
-	packetSource := gopacket.NewPacketSource(r.handle, r.handle.LinkType())
-	for packet := range packetSource.Packets() {
-		receivedAt := packet.Metadata().CaptureInfo.Timestamp
-		r.decodePacket(receivedAt, packet)
-	}
+	r.readPackets(false)
 	/* if no packets were found, try raw link layer */
-	if len(r.rtpStreamsSorted) <= 0 {
-		r.reOpenPcapFile()
-		packetSource = gopacket.NewPacketSource(r.handle, layers.LinkTypeRaw)
-		for packet := range packetSource.Packets() {
-			receivedAt := packet.Metadata().CaptureInfo.Timestamp
-			r.decodePacket(receivedAt, packet)
-		}
+	if len(r.rtpStreamsSorted) <= 0 && len(r.filePaths) > 0 {
+		r.reOpenPcapFiles()
+		r.readPackets(true)
 	}
 	return r.rtpStreamsSorted
 }
 
-func (r *RtpReader) decodeIPv4Packet(receivedAt time.Time, packet gopacket.Packet, ipLayerType gopacket.Layer) error {
+//ReadStreams reads packets until end of input or Stop, reporting streams and packets
+//through OnStream and OnPacket functions as they are decoded
+func (r *RtpReader) ReadStreams() []*RtpStream {
+	r.readPackets(false)
+	return r.rtpStreamsSorted
+}
+
+func (r *RtpReader) readPackets(rawLinkType bool) {
+	for atomic.LoadInt32(&r.stopped) == 0 {
+		data, ci, linkType, err := r.source.ReadPacketData()
+		if err == errReadTimeout {
+			continue
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Serror("failed to read packet: %s", err)
+			return
+		}
+		if s, ok := r.source.(startedSource); ok && r.captureStart.IsZero() {
+			r.captureStart = s.firstPacketTime()
+		}
+		if !r.inTimeWindow(ci.Timestamp) {
+			continue
+		}
+		if rawLinkType {
+			linkType = layers.LinkTypeRaw
+		}
+		packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+		r.decodePacket(&packetInfo{receivedAt: ci.Timestamp}, packet)
+	}
+}
+
+func (r *RtpReader) decodeIPv4Packet(info *packetInfo, packet gopacket.Packet, ipLayerType gopacket.Layer) error {
 	if ipLayerType == nil {
 		log.Sdebug("LayerPayload v4: %s", hex.Dump(ipLayerType.LayerPayload()))
 		return errors.New("Not able to decode ipv4 packet")
 	}
 	ipLayer := ipLayerType.(*layers.IPv4)
+	if ipLayer.Protocol == layers.IPProtocolGRE {
+		return r.decodeGRELayer(info, ipLayer.Payload)
+	}
 	udpLayer, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	if udpLayer == nil {
+		if tcpLayer, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); tcpLayer != nil {
+			return r.decodeTCPLayer(info, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), tcpLayer)
+		}
+		if espLayer, _ := packet.Layer(layers.LayerTypeIPSecESP).(*layers.IPSecESP); espLayer != nil {
+			return r.decodeESPLayer(info, packet, espLayer)
+		}
 		return errors.New("Not UDP Packet")
 	}
-	return r.decodeUDPLayer(receivedAt, packet, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), udpLayer)
+	return r.decodeUDPLayer(info, packet, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), udpLayer)
 }
 
-func (r *RtpReader) decodeIPv6Packet(receivedAt time.Time, packet gopacket.Packet, ipLayerType gopacket.Layer) error {
+func (r *RtpReader) decodeIPv6Packet(info *packetInfo, packet gopacket.Packet, ipLayerType gopacket.Layer) error {
 	if ipLayerType == nil {
 		log.Sdebug("LayerPayload v6: %s", hex.Dump(ipLayerType.LayerPayload()))
 		return errors.New("Not able to decode ipv6 packet")
 	}
 	ipLayer := ipLayerType.(*layers.IPv6)
+	if ipLayer.NextHeader == layers.IPProtocolGRE {
+		return r.decodeGRELayer(info, ipLayer.Payload)
+	}
 	udpLayer, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	if udpLayer == nil {
+		if tcpLayer, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); tcpLayer != nil {
+			return r.decodeTCPLayer(info, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), tcpLayer)
+		}
+		if espLayer, _ := packet.Layer(layers.LayerTypeIPSecESP).(*layers.IPSecESP); espLayer != nil {
+			return r.decodeESPLayer(info, packet, espLayer)
+		}
 		return errors.New("Not UDP Packet")
 	}
-	return r.decodeUDPLayer(receivedAt, packet, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), udpLayer)
+	return r.decodeUDPLayer(info, packet, ipLayer.SrcIP.String(), ipLayer.DstIP.String(), udpLayer)
+}
+
+func (r *RtpReader) decodeTCPLayer(info *packetInfo, src string, dst string, tcp *layers.TCP) error {
+	// SIP messages span segments, they're reassembled like media, a flow may start with CRLF keepalives
+	sip := tcp.SrcPort == SipPort || tcp.DstPort == SipPort || isSipMessage(bytes.TrimLeft(tcp.Payload, "\r\n"))
+	if !sip && !r.isRtspPort(uint16(tcp.SrcPort), uint16(tcp.DstPort)) && !r.isMediaPort(uint16(tcp.SrcPort), uint16(tcp.DstPort)) {
+		return errors.New("Port filtered")
+	}
+	return r.reassembleTCP(info, src, dst, tcp, sip)
 }
 
-func (r *RtpReader) decodeUDPLayer(receivedAt time.Time, packet gopacket.Packet, src string, dst string, udp *layers.UDP) error {
-	if udp.SrcPort%2 != 0 || udp.DstPort%2 != 0 {
-		return errors.New("Likely RTCP packet")
+func (r *RtpReader) decodeUDPLayer(info *packetInfo, packet gopacket.Packet, src string, dst string, udp *layers.UDP) error {
+	if udp.SrcPort == SipPort || udp.DstPort == SipPort || isSipMessage(udp.Payload) {
+		return r.decodeSIP(udp.Payload)
 	}
 
-	if udp.SrcPort == 4500 || udp.DstPort == 4500 {
+	if r.isEspPort(udp.SrcPort) || r.isEspPort(udp.DstPort) {
+		// NAT keepalive and IKE with non-ESP marker share the port, RFC 3948
+		if len(udp.Payload) < 8 || binary.BigEndian.Uint32(udp.Payload[:4]) == 0 {
+			return errors.New("Not ESP packet")
+		}
 		espPacket := gopacket.NewPacket(udp.Payload, layers.LayerTypeIPSecESP, gopacket.Default)
-		espLayer := espPacket.Layer(layers.LayerTypeIPSecESP).(*layers.IPSecESP)
-		return r.decodeESPLayer(receivedAt, packet, espLayer)
+		espLayer, _ := espPacket.Layer(layers.LayerTypeIPSecESP).(*layers.IPSecESP)
+		if espLayer == nil {
+			return errors.New("Not able to decode ESP layer")
+		}
+		return r.decodeESPLayer(info, packet, espLayer)
+	}
+
+	if udp.SrcPort == GtpuPort || udp.DstPort == GtpuPort {
+		return r.decodeGTPULayer(info, src, dst, udp.Payload)
+	}
+
+	if r.isVxlanPort(udp.DstPort) {
+		return r.decodeVXLANLayer(info, udp.Payload)
+	}
+	if r.isGenevePort(udp.DstPort) {
+		return r.decodeGeneveLayer(info, udp.Payload)
+	}
+	return r.decodeMediaLayer(info, src, dst, udp)
+}
+
+// decodeMediaLayer decodes RTP or RTCP of a datagram, or of a frame received over TCP
+func (r *RtpReader) decodeMediaLayer(info *packetInfo, src string, dst string, udp *layers.UDP) error {
+	interleaved := info.framing == framingInterleaved.String() && r.isRtspPort(uint16(udp.SrcPort), uint16(udp.DstPort))
+	if !interleaved && !r.isMediaPort(uint16(udp.SrcPort), uint16(udp.DstPort)) {
+		return errors.New("Port filtered")
+	}
+	if !r.isSelectedHost(src, dst) {
+		return errors.New("Host filtered")
+	}
+	if !r.isSelectedPort(uint16(udp.SrcPort), uint16(udp.DstPort)) {
+		return errors.New("Port filtered")
+	}
+	// RTCP is on the port next to RTP, or on the same port with rtcp-mux (RFC 5761)
+	if isRtcpPacket(udp.Payload) {
+		return r.decodeRTCP(info, src, dst, udp)
 	}
 
 	rtpPacket := gopacket.NewPacket(
@@ -120,49 +336,121 @@ func (r *RtpReader) decodeUDPLayer(receivedAt time.Time, packet gopacket.Packet,
 	if rtpLayer == nil || rtp == nil {
 		return errors.New("Not able to decode RTP layer")
 	}
-	return r.processRtpPacket(receivedAt, src, dst, udp, rtp)
+
+	ctx := srtp.Lookup(rtp.Ssrc, src, uint(udp.SrcPort), dst, uint(udp.DstPort))
+	if ctx != nil {
+		plain, err := ctx.DecryptRTP(udp.Payload)
+		if err != nil {
+			return err
+		}
+		rtpPacket = gopacket.NewPacket(plain, RtpLayerType, gopacket.Default)
+		if rtp, _ = rtpPacket.Layer(RtpLayerType).(*RtpLayer); rtp == nil {
+			return errors.New("Not able to decode decrypted RTP layer")
+		}
+	}
+	info.srtp = ctx
+	return r.processRtpPacket(info, src, dst, udp, rtp)
 }
 
-func (r *RtpReader) decodeESPLayer(receivedAt time.Time, packet gopacket.Packet, espLayer *layers.IPSecESP) error {
+func (r *RtpReader) decodeESPLayer(info *packetInfo, packet gopacket.Packet, espLayer *layers.IPSecESP) error {
 	espPacket := esp.DecodeESPLayer(packet, espLayer)
 	if espPacket != nil {
-		return r.decodePacket(receivedAt, espPacket)
+		return r.decodePacket(info, espPacket)
 	}
 	return errors.New("Not able to decode ESP")
 }
 
-func (r *RtpReader) decodePacket(receivedAt time.Time, packet gopacket.Packet) error {
+func (r *RtpReader) decodePacket(info *packetInfo, packet gopacket.Packet) error {
 	//log.Sdebug("decodePacket: %s", packet.Dump())
+	addLinkEncapsulation(info, packet)
+	// gopacket guesses IP by the first nibble after the label stack, which may be a MAC address as well
+	if r.mplsPseudowire != MplsAuto && packet.Layer(layers.LayerTypeMPLS) != nil {
+		return r.decodeMPLSPayload(info, packet)
+	}
+	if packet = r.defragment(info, packet); packet == nil {
+		return errors.New("IP fragment queued")
+	}
 	networkLayer := packet.Layer(layers.LayerTypeIPv4)
 	if networkLayer != nil {
-		return r.decodeIPv4Packet(receivedAt, packet, networkLayer)
+		return r.decodeIPv4Packet(info, packet, networkLayer)
 	}
 	networkLayer = packet.Layer(layers.LayerTypeIPv6)
 	if networkLayer != nil {
-		return r.decodeIPv6Packet(receivedAt, packet, networkLayer)
+		return r.decodeIPv6Packet(info, packet, networkLayer)
+	}
+	if packet.Layer(layers.LayerTypeMPLS) != nil {
+		return r.decodeMPLSPayload(info, packet)
 	}
 	return errors.New("Failed to decode packet")
 }
 
-func (r *RtpReader) processRtpPacket(receivedAt time.Time, src string, dst string, udp *layers.UDP, rtp *RtpLayer) error {
-	rtp.ReceivedAt = receivedAt
+func (r *RtpReader) processRtpPacket(info *packetInfo, src string, dst string, udp *layers.UDP, rtp *RtpLayer) error {
+	if !r.isSelectedSsrc(rtp.Ssrc) {
+		return errors.New("SSRC filtered")
+	}
+	rtp.ReceivedAt = info.receivedAt
+
+	key := streamKey{ssrc: rtp.Ssrc}
+	if !r.mergeBySsrc {
+		key.srcIP, key.dstIP = src, dst
+		key.srcPort, key.dstPort = uint(udp.SrcPort), uint(udp.DstPort)
+		if info.gtp != nil {
+			key.teid, key.tunneled = info.gtp.teid, true
+		}
+		key.encap = info.encap.String()
+	}
+	p := &pendingPacket{info: *info, key: key, src: src, dst: dst, srcPort: uint(udp.SrcPort), dstPort: uint(udp.DstPort), rtp: rtp}
+	if _, ok := r.rtpStreamsMap[key]; ok {
+		r.addRtpPacket(p)
+		return nil
+	}
+
+	packets := r.probe(p)
+	if packets == nil {
+		return errors.New("RTP stream not validated yet")
+	}
+	for _, p := range packets {
+		r.addRtpPacket(p)
+	}
+	return nil
+}
 
-	s, ok := r.rtpStreamsMap[rtp.Ssrc]
+func (r *RtpReader) addRtpPacket(p *pendingPacket) {
+	rtp, info := p.rtp, &p.info
+	s, ok := r.rtpStreamsMap[p.key]
 	if !ok {
 		s = &RtpStream{
-			SrcIP:          src,
-			SrcPort:        uint(udp.SrcPort),
-			DstIP:          dst,
-			DstPort:        uint(udp.DstPort),
+			SrcIP:          p.src,
+			SrcPort:        p.srcPort,
+			DstIP:          p.dst,
+			DstPort:        p.dstPort,
 			Ssrc:           rtp.Ssrc,
 			PayloadType:    rtp.PayloadType,
 			FirstSeq:       rtp.SequenceNumber,
 			FirstTimestamp: rtp.Timestamp,
-			StartTime:      receivedAt,
+			StartTime:      info.receivedAt,
+			ClockRate:      ClockRate(rtp.PayloadType, r.clockRates),
+			discardPackets: r.discardPackets,
+		}
+		if info.gtp != nil {
+			s.Tunnel = info.gtp.tunnelInfo(p.src, p.dst)
 		}
-		r.rtpStreamsMap[rtp.Ssrc] = s
+		s.Srtp = info.srtp
+		s.Framing = info.framing
+		s.Encapsulation = info.encap
+		s.Rtcp = r.streamRtcp(rtp.Ssrc, p.src, p.srcPort, p.dst, p.dstPort)
+		r.rtpStreamsMap[p.key] = s
 		r.rtpStreamsSorted = append(r.rtpStreamsSorted, s)
+	} else if s.Srtp == nil {
+		s.Srtp = info.srtp // keys of the stream were registered after its first packets
+	}
+	r.linkStream(s)
+	packet := rtp.RtpPacket()
+	added := s.AddPacket(packet)
+	if !ok && r.onStream != nil {
+		r.onStream(s)
+	}
+	if added && r.onPacket != nil {
+		r.onPacket(s, packet)
 	}
-	s.AddPacket(rtp.RtpPacket())
-	return nil
 }
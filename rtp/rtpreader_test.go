@@ -0,0 +1,118 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestReader() *RtpReader {
+	return &RtpReader{rtpStreamsMap: make(map[streamKey]*RtpStream)}
+}
+
+// rtpBytes builds RTP packet without CSRCs and extension
+func rtpBytes(payloadType byte, seq uint16, timestamp, ssrc uint32, payload []byte) []byte {
+	packet := make([]byte, 12, 12+len(payload))
+	packet[0], packet[1] = 0x80, payloadType
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	return append(packet, payload...)
+}
+
+// udpDatagram serializes UDP header with payload, checksum is computed over the IPv4 pseudo header
+func udpDatagram(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16, payload []byte) []byte {
+	t.Helper()
+	ip := &layers.IPv4{SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst), Protocol: layers.IPProtocolUDP}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ipv4Packet serializes IPv4 packet, fragment offset is in 8 octet units
+func ipv4Packet(t *testing.T, src, dst string, protocol layers.IPProtocol, id uint16, more bool, fragOffset uint16, payload []byte) gopacket.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: id, FragOffset: fragOffset, Protocol: protocol,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+func udpPacket(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16, payload []byte) gopacket.Packet {
+	t.Helper()
+	return ipv4Packet(t, src, dst, layers.IPProtocolUDP, 1, false, 0, udpDatagram(t, src, srcPort, dst, dstPort, payload))
+}
+
+// feed decodes packet as if read from a capture at offset from testStart
+func feed(r *RtpReader, packet gopacket.Packet, offset time.Duration) error {
+	return r.decodePacket(&packetInfo{receivedAt: testStart.Add(offset)}, packet)
+}
+
+// a stream is reported once enough packets are in sequence, all of them are added to it
+func TestProbation(t *testing.T) {
+	tests := []struct {
+		name          string
+		minSequential int
+		seqs          []uint16
+		ssrcs         []uint32
+		want          uint
+	}{
+		{"default", 0, []uint16{1, 2}, []uint32{1, 1}, 2},
+		{"not enough packets", 3, []uint16{1, 2}, []uint32{1, 1}, 0},
+		{"gap within limit", 3, []uint16{1, 2, 10}, []uint32{1, 1, 1}, 3},
+		{"gap too large", 3, []uint16{1, 2, 100}, []uint32{1, 1, 1}, 0},
+		{"ssrc changes", 2, []uint16{1, 2, 3}, []uint32{1, 2, 2}, 2},
+		{"single packet", 1, []uint16{7}, []uint32{1}, 1},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		r.SetMinSequential(tt.minSequential)
+		for i, seq := range tt.seqs {
+			payload := rtpBytes(0, seq, uint32(seq)*160, tt.ssrcs[i], make([]byte, 160))
+			feed(r, udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, payload), time.Duration(i)*20*time.Millisecond)
+		}
+		var got uint
+		for _, s := range r.rtpStreamsSorted {
+			got += s.TotalPackets
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d packets in streams, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// candidates idle for candidateTimeout are forgotten, so a packet seen later starts probation again
+func TestProbationTimeout(t *testing.T) {
+	r := newTestReader()
+	r.SetMinSequential(2)
+	frame := make([]byte, 160)
+	feed(r, udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 1, frame)), 0)
+	feed(r, udpPacket(t, "192.0.2.3", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 2, frame)), candidateTimeout+2*time.Second)
+	if len(r.candidates) != 1 {
+		t.Errorf("got %d candidates, want 1", len(r.candidates))
+	}
+	feed(r, udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 2, 320, 1, frame)), candidateTimeout+3*time.Second)
+	if len(r.rtpStreamsSorted) != 0 {
+		t.Errorf("got %d streams from candidate that timed out", len(r.rtpStreamsSorted))
+	}
+}
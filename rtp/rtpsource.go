@@ -0,0 +1,677 @@
+package rtp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+)
+
+// returned by live sources when no packet arrived in time, reading should continue
+var errReadTimeout = errors.New("read timeout")
+
+const liveReadTimeout = 500 * time.Millisecond
+
+//SetCaptureFilter replaces RtpCapureFilter for captures opened afterwards, filter is checked by compiling it
+func SetCaptureFilter(filter string) error {
+	if _, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, filter); err != nil {
+		return err
+	}
+	RtpCapureFilter = filter
+	return nil
+}
+
+// packetSource returns captured packets together with link type of the interface they were captured on
+type packetSource interface {
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error)
+	Close()
+}
+
+// startedSource is implemented by capture file sources, which see every packet of the capture, so the
+// capture starts with the first packet read even if the filter drops it
+type startedSource interface {
+	firstPacketTime() time.Time
+}
+
+// pcapSource reads legacy pcap files and live interfaces through libpcap, files are filtered here rather
+// than by libpcap so their first packet is seen
+type pcapSource struct {
+	handle *pcap.Handle
+	filter *pcap.BPF
+	first  time.Time
+	sll2   bool // frames are Linux SLL2, told by the file header
+}
+
+func (s *pcapSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	for {
+		data, ci, err = s.handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			err = errReadTimeout
+		}
+		if err != nil || s.filter == nil {
+			break
+		}
+		if s.first.IsZero() {
+			s.first = ci.Timestamp
+		}
+		if s.filter.Matches(ci, data) {
+			break
+		}
+	}
+	if s.sll2 && err == nil {
+		data, ci, linkType = fromLinuxSLL2(data, ci)
+		return data, ci, linkType, nil
+	}
+	return data, ci, s.handle.LinkType(), err
+}
+
+func (s *pcapSource) firstPacketTime() time.Time {
+	return s.first
+}
+
+func (s *pcapSource) Close() {
+	s.handle.Close()
+}
+
+// captureReader is implemented by pcap and pcapng stream readers
+type captureReader interface {
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error)
+}
+
+// pcapgoReader adapts legacy pcap stream reader, used where libpcap can't reopen the input
+type pcapgoReader struct {
+	reader *pcapgo.Reader
+	sll2   bool
+}
+
+func (r *pcapgoReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	data, ci, err = r.reader.ReadPacketData()
+	if r.sll2 && err == nil {
+		data, ci, linkType = fromLinuxSLL2(data, ci)
+		return data, ci, linkType, nil
+	}
+	return data, ci, r.reader.LinkType(), err
+}
+
+const pcapHeaderLength = 24
+
+// pcapLinkType returns link type of legacy pcap file header, 0 if it isn't one. The upper 16 bits of the
+// field carry the FCS length
+func pcapLinkType(header []byte) uint32 {
+	if len(header) < pcapHeaderLength {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch binary.BigEndian.Uint32(header) {
+	case 0xA1B2C3D4, 0xA1B23C4D:
+		order = binary.BigEndian
+	case 0xD4C3B2A1, 0x4D3CB2A1:
+		order = binary.LittleEndian
+	default:
+		return 0
+	}
+	return order.Uint32(header[20:24]) & 0xFFFF
+}
+
+// ngReader adapts pcapng stream reader, every packet carries link type of its interface,
+// section and interface comments are logged as they are read
+type ngReader struct {
+	reader     *pcapgo.NgReader
+	blocks     *ngBlockScanner
+	section    int  // index of current section
+	interfaces int  // interfaces of current section already logged
+	newSection bool // a section ended, next one wasn't logged yet
+}
+
+func newNgReader(input io.Reader) (*ngReader, error) {
+	r := &ngReader{blocks: &ngBlockScanner{input: input}}
+	options := pcapgo.DefaultNgReaderOptions
+	options.WantMixedLinkType = true
+	options.SectionEndCallback = func([]pcapgo.NgInterface, pcapgo.NgSectionInfo) {
+		r.section++
+		r.interfaces = 0
+		r.newSection = true
+	}
+	reader, err := pcapgo.NewNgReader(r.blocks, options)
+	if err != nil {
+		return nil, err
+	}
+	r.reader = reader
+	r.logSection()
+	return r, nil
+}
+
+func (r *ngReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	data, ci, err = r.reader.ReadPacketData()
+	if err != nil {
+		return
+	}
+	if r.newSection {
+		r.newSection = false
+		r.logSection()
+	}
+	r.logInterfaces()
+	if r.blocks.linkType(r.section, ci.InterfaceIndex) == linkTypeLinuxSLL2 {
+		data, ci, linkType = fromLinuxSLL2(data, ci)
+		return data, ci, linkType, nil
+	}
+	linkType = r.reader.LinkType()
+	if len(ci.AncillaryData) > 0 {
+		if t, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			linkType = t
+		}
+	}
+	return data, ci, linkType, nil
+}
+
+func (r *ngReader) logSection() {
+	if comment := r.reader.SectionInfo().Comment; comment != "" {
+		log.Sinfo("pcapng section comment: %s", comment)
+	}
+	r.logInterfaces()
+}
+
+func (r *ngReader) logInterfaces() {
+	for ; r.interfaces < r.reader.NInterfaces(); r.interfaces++ {
+		intf, err := r.reader.Interface(r.interfaces)
+		if err != nil {
+			return
+		}
+		log.Sdebug("pcapng interface %d: name:%s, link type:%s, snaplen:%d",
+			r.interfaces, intf.Name, intf.LinkType, intf.SnapLength)
+		if intf.Comment != "" {
+			log.Sinfo("pcapng interface %d comment: %s", r.interfaces, intf.Comment)
+		}
+	}
+}
+
+const (
+	ngBlockHeaderLength = 12 // type, length and the first 4 bytes of the body
+	ngBlockInterface    = 1
+	ngByteOrderMagic    = 0x1A2B3C4D
+)
+
+// ngBlockScanner passes a pcapng stream through to NgReader and records the full link types of interface
+// description blocks, per section
+type ngBlockScanner struct {
+	input     io.Reader
+	order     binary.ByteOrder
+	header    []byte // of the next block, until complete
+	remaining int    // bytes of the current block still to pass
+	linkTypes [][]uint32
+}
+
+func (s *ngBlockScanner) Read(p []byte) (int, error) {
+	n, err := s.input.Read(p)
+	s.scan(p[:n])
+	return n, err
+}
+
+func (s *ngBlockScanner) scan(data []byte) {
+	for len(data) > 0 {
+		if s.remaining > 0 {
+			n := s.remaining
+			if n > len(data) {
+				n = len(data)
+			}
+			s.remaining -= n
+			data = data[n:]
+			continue
+		}
+		n := ngBlockHeaderLength - len(s.header)
+		if n > len(data) {
+			n = len(data)
+		}
+		s.header = append(s.header, data[:n]...)
+		data = data[n:]
+		if len(s.header) == ngBlockHeaderLength {
+			s.block(s.header)
+			s.header = s.header[:0]
+		}
+	}
+}
+
+// block records a section or an interface, a block before the first section header is left to NgReader to fail
+func (s *ngBlockScanner) block(header []byte) {
+	if bytes.Equal(header[:4], pcapngMagic) {
+		s.order = binary.LittleEndian
+		if binary.BigEndian.Uint32(header[8:12]) == ngByteOrderMagic {
+			s.order = binary.BigEndian
+		}
+		s.linkTypes = append(s.linkTypes, nil)
+	}
+	if s.order == nil {
+		return
+	}
+	if s.order.Uint32(header[:4]) == ngBlockInterface {
+		section := len(s.linkTypes) - 1
+		s.linkTypes[section] = append(s.linkTypes[section], uint32(s.order.Uint16(header[8:10])))
+	}
+	s.remaining = int(s.order.Uint32(header[4:8])) - ngBlockHeaderLength
+}
+
+// linkType returns link type of an interface of a section already read, 0 if unknown
+func (s *ngBlockScanner) linkType(section, intf int) uint32 {
+	if section >= len(s.linkTypes) || intf >= len(s.linkTypes[section]) {
+		return 0
+	}
+	return s.linkTypes[section][intf]
+}
+
+// filteredSource reads captures without libpcap handle, bpf filter is compiled
+// per link type since every pcapng interface may use a different one
+type filteredSource struct {
+	closer  io.Closer
+	reader  captureReader
+	filters map[layers.LinkType]*pcap.BPF
+	first   time.Time
+}
+
+func newFilteredSource(closer io.Closer, reader captureReader) *filteredSource {
+	return &filteredSource{
+		closer:  closer,
+		reader:  reader,
+		filters: make(map[layers.LinkType]*pcap.BPF),
+	}
+}
+
+func (s *filteredSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	for {
+		data, ci, linkType, err = s.reader.ReadPacketData()
+		if err != nil {
+			return
+		}
+		if s.first.IsZero() {
+			s.first = ci.Timestamp
+		}
+		filter, ok := s.filters[linkType]
+		if !ok {
+			filter, err = pcap.NewBPF(linkType, 65535, RtpCapureFilter)
+			if err != nil {
+				log.Swarn("failed to set bpf filter for link type %s: %s", linkType, err)
+				err = nil
+			}
+			s.filters[linkType] = filter
+		}
+		if filter == nil || filter.Matches(ci, data) {
+			return
+		}
+	}
+}
+
+func (s *filteredSource) firstPacketTime() time.Time {
+	return s.first
+}
+
+func (s *filteredSource) Close() {
+	s.closer.Close()
+}
+
+// udpSource receives rtp directly on a local socket, every datagram is wrapped
+// into an IP/UDP packet so it can be decoded like a captured one
+type udpSource struct {
+	conn      *net.UDPConn
+	localAddr *net.UDPAddr
+	buf       []byte
+}
+
+func (s *udpSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	s.conn.SetReadDeadline(time.Now().Add(liveReadTimeout))
+	n, remote, err := s.conn.ReadFromUDP(s.buf)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = errReadTimeout
+		}
+		return
+	}
+
+	udp := &layers.UDP{SrcPort: layers.UDPPort(remote.Port), DstPort: layers.UDPPort(s.localAddr.Port)}
+	var network gopacket.SerializableLayer
+	if remote.IP.To4() != nil {
+		localIP := s.localAddr.IP.To4()
+		if localIP == nil {
+			localIP = net.IPv4zero
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: remote.IP.To4(), DstIP: localIP}
+		udp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	} else {
+		localIP := s.localAddr.IP
+		if localIP == nil || localIP.To4() != nil {
+			localIP = net.IPv6unspecified
+		}
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: remote.IP, DstIP: localIP}
+		udp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, network, udp, gopacket.Payload(s.buf[:n]))
+	if err != nil {
+		return
+	}
+	data = buffer.Bytes()
+	ci.Timestamp = time.Now().UTC()
+	ci.CaptureLength = len(data)
+	ci.Length = len(data)
+	return data, ci, layers.LinkTypeRaw, nil
+}
+
+func (s *udpSource) Close() {
+	s.conn.Close()
+}
+
+var (
+	pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A} // section header block type
+	gzipMagic   = []byte{0x1F, 0x8B}
+	zstdMagic   = []byte{0x28, 0xB5, 0x2F, 0xFD}
+)
+
+// openCaptureFile opens pcap or pcapng file, plain or compressed with gzip or zstd,
+// format is detected by magic number
+func openCaptureFile(path string) (packetSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("Failed to open capture file")
+		return nil, err
+	}
+	header := make([]byte, pcapHeaderLength)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	magic := header
+	if len(magic) > len(pcapngMagic) {
+		magic = magic[:len(pcapngMagic)]
+	}
+	if bytes.HasPrefix(magic, pcapngMagic) || bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) {
+		file.Seek(0, io.SeekStart)
+		return openCaptureReader(file, file)
+	}
+	file.Close()
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		log.Error("Failed to open pcap file")
+		return nil, err
+	}
+	filter, err := handle.NewBPF(RtpCapureFilter)
+	if err != nil {
+		handle.Close()
+		log.Error("Failed to set bpf file")
+		return nil, err
+	}
+	return &pcapSource{handle: handle, filter: filter, sll2: pcapLinkType(header) == linkTypeLinuxSLL2}, nil
+}
+
+// openCaptureStream reads pcap or pcapng from a named pipe or stdin ("-")
+func openCaptureStream(path string) (packetSource, error) {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			log.Error("Failed to open capture pipe")
+			return nil, err
+		}
+	}
+	source, err := openCaptureReader(file, file)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeSource(source), nil
+}
+
+// pipeSource reads a capture stream in background, pipes have no read deadline so packets
+// are waited for with timeout, otherwise Stop would take effect only after the next packet
+type pipeSource struct {
+	source  packetSource
+	packets chan pipePacket
+	done    chan struct{}
+}
+
+type pipePacket struct {
+	sourcePacket
+	err error
+}
+
+func newPipeSource(source packetSource) *pipeSource {
+	s := &pipeSource{
+		source:  source,
+		packets: make(chan pipePacket),
+		done:    make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+// read hands packets over until the first error, which is handed over as well
+func (s *pipeSource) read() {
+	defer close(s.packets)
+	for {
+		p := pipePacket{}
+		p.data, p.ci, p.linkType, p.err = s.source.ReadPacketData()
+		select {
+		case s.packets <- p:
+		case <-s.done:
+			return
+		}
+		if p.err != nil {
+			return
+		}
+	}
+}
+
+func (s *pipeSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	timer := time.NewTimer(liveReadTimeout)
+	defer timer.Stop()
+	select {
+	case p, ok := <-s.packets:
+		if !ok {
+			return nil, ci, linkType, io.EOF
+		}
+		return p.data, p.ci, p.linkType, p.err
+	case <-timer.C:
+		return nil, ci, linkType, errReadTimeout
+	}
+}
+
+// Close doesn't wait for background read, a blocked read of stdin can't be interrupted
+func (s *pipeSource) Close() {
+	close(s.done)
+	s.source.Close()
+}
+
+// closers closes a decompressor and the file it reads
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, closer := range c {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openCaptureReader reads pcap or pcapng, optionally gzip or zstd compressed, input can't be rewound
+// so format is detected without seeking, closer is closed with the returned source
+func openCaptureReader(closer io.Closer, input io.Reader) (packetSource, error) {
+	buffered := bufio.NewReaderSize(input, 65536)
+	magic, err := buffered.Peek(len(pcapngMagic))
+	if err != nil {
+		closer.Close()
+		log.Error("Failed to read capture header")
+		return nil, err
+	}
+	var decompressed io.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		if decompressed, err = gzip.NewReader(buffered); err != nil {
+			closer.Close()
+			log.Error("Failed to read gzip header")
+			return nil, err
+		}
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			closer.Close()
+			log.Error("Failed to read zstd header")
+			return nil, err
+		}
+		decompressed = decoder
+		closer = closers{decoder.IOReadCloser(), closer}
+	}
+	if decompressed != nil {
+		buffered = bufio.NewReaderSize(decompressed, 65536)
+		if magic, err = buffered.Peek(len(pcapngMagic)); err != nil {
+			closer.Close()
+			log.Error("Failed to read capture header")
+			return nil, err
+		}
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		reader, err := newNgReader(buffered)
+		if err != nil {
+			closer.Close()
+			log.Error("Failed to read pcapng stream")
+			return nil, err
+		}
+		return newFilteredSource(closer, reader), nil
+	}
+	header, _ := buffered.Peek(pcapHeaderLength)
+	sll2 := pcapLinkType(header) == linkTypeLinuxSLL2
+	reader, err := pcapgo.NewReader(buffered)
+	if err != nil {
+		closer.Close()
+		log.Error("Failed to read pcap stream")
+		return nil, err
+	}
+	return newFilteredSource(closer, &pcapgoReader{reader: reader, sll2: sll2}), nil
+}
+
+// sourcePacket is the next packet of a merged source
+type sourcePacket struct {
+	data     []byte
+	ci       gopacket.CaptureInfo
+	linkType layers.LinkType
+}
+
+// mergedSource reads several captures as one, packets are returned in timestamp order across
+// them so streams continue over file boundaries and captures of different probes interleave
+type mergedSource struct {
+	sources []packetSource
+	paths   []string
+	next    []*sourcePacket
+	done    []bool
+}
+
+func (m *mergedSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	earliest := -1
+	for i, source := range m.sources {
+		if m.next[i] == nil && !m.done[i] {
+			p := &sourcePacket{}
+			p.data, p.ci, p.linkType, err = source.ReadPacketData()
+			if err != nil {
+				// rotated captures are often truncated, the other files are still read
+				if err != io.EOF {
+					log.Swarn("%s: %s, skipping rest of file", m.paths[i], err)
+				}
+				m.done[i] = true
+				continue
+			}
+			m.next[i] = p
+		}
+		if m.next[i] != nil && (earliest < 0 || m.next[i].ci.Timestamp.Before(m.next[earliest].ci.Timestamp)) {
+			earliest = i
+		}
+	}
+	if earliest < 0 {
+		return nil, ci, linkType, io.EOF
+	}
+	p := m.next[earliest]
+	m.next[earliest] = nil
+	return p.data, p.ci, p.linkType, nil
+}
+
+// firstPacketTime returns time of the earliest first packet of the captures
+func (m *mergedSource) firstPacketTime() (first time.Time) {
+	for _, source := range m.sources {
+		if s, ok := source.(startedSource); ok {
+			if t := s.firstPacketTime(); !t.IsZero() && (first.IsZero() || t.Before(first)) {
+				first = t
+			}
+		}
+	}
+	return first
+}
+
+func (m *mergedSource) Close() {
+	for _, source := range m.sources {
+		source.Close()
+	}
+}
+
+// openCaptureFiles opens captures to be read merged, a single file is read directly
+func openCaptureFiles(paths []string) (packetSource, error) {
+	if len(paths) == 1 {
+		return openCaptureFile(paths[0])
+	}
+	m := &mergedSource{paths: paths, next: make([]*sourcePacket, len(paths)), done: make([]bool, len(paths))}
+	for _, path := range paths {
+		source, err := openCaptureFile(path)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		m.sources = append(m.sources, source)
+	}
+	return m, nil
+}
+
+// openInterface starts live capture on a network interface
+func openInterface(device string) (packetSource, error) {
+	handle, err := pcap.OpenLive(device, 65535, true, liveReadTimeout)
+	if err != nil {
+		log.Error("Failed to open interface")
+		return nil, err
+	}
+	err = handle.SetBPFFilter(RtpCapureFilter)
+	if err != nil {
+		handle.Close()
+		log.Error("Failed to set bpf file")
+		return nil, err
+	}
+	return &pcapSource{handle: handle}, nil
+}
+
+// openUDPSocket listens for rtp on local address
+func openUDPSocket(address string) (packetSource, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Error("Failed to resolve local address")
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		log.Error("Failed to listen on local address")
+		return nil, err
+	}
+	return &udpSource{
+		conn:      conn,
+		localAddr: conn.LocalAddr().(*net.UDPAddr),
+		buf:       make([]byte, 65535),
+	}, nil
+}
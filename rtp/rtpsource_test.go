@@ -0,0 +1,95 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ngBlock builds pcapng block, body is padded to 32 bits
+func ngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	length := uint32(ngBlockHeaderLength + (len(body)+3)&^3)
+	block := make([]byte, length)
+	order.PutUint32(block, blockType)
+	order.PutUint32(block[4:], length)
+	copy(block[8:], body)
+	order.PutUint32(block[length-4:], length)
+	return block
+}
+
+func ngSection(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body, ngByteOrderMagic)
+	order.PutUint16(body[4:], 1)
+	copy(body[8:], bytes.Repeat([]byte{0xFF}, 8)) // section length unknown
+	return ngBlock(order, binary.BigEndian.Uint32(pcapngMagic), body)
+}
+
+func ngInterface(order binary.ByteOrder, linkType uint16) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body, linkType)
+	order.PutUint32(body[4:], 65535)
+	return ngBlock(order, ngBlockInterface, body)
+}
+
+func ngPacket(order binary.ByteOrder, intf uint32, data []byte) []byte {
+	body := make([]byte, 20, 20+len(data))
+	order.PutUint32(body, intf)
+	order.PutUint32(body[12:], uint32(len(data)))
+	order.PutUint32(body[16:], uint32(len(data)))
+	return ngBlock(order, 6, append(body, data...))
+}
+
+// SLL2 link type of every section and interface is known, gopacket truncates it to 8 bits
+func TestNgReaderLinuxSLL2(t *testing.T) {
+	ip := udpPacket(t, "192.0.2.1", 5000, "192.0.2.2", 6000, rtpBytes(0, 1, 160, 0x1111, make([]byte, 160))).Data()
+	le, be := binary.LittleEndian, binary.BigEndian
+	stream := compound(
+		ngSection(le), ngInterface(le, uint16(layers.LinkTypeEthernet)), ngInterface(le, linkTypeLinuxSLL2),
+		ngPacket(le, 1, sll2Frame(layers.EthernetTypeIPv4, ip)),
+		ngPacket(le, 0, ethernetFrame(testMAC, layers.EthernetTypeIPv4, ip)),
+		ngSection(be), ngInterface(be, linkTypeLinuxSLL2),
+		ngPacket(be, 0, sll2Frame(layers.EthernetTypeIPv4, ip)))
+	// headers split across reads
+	r, err := newNgReader(iotest.OneByteReader(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []layers.LinkType{layers.LinkTypeLinuxSLL, layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL} {
+		data, _, linkType, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if linkType != want {
+			t.Errorf("packet %d: got link type %s, want %s", i, linkType, want)
+		}
+		if packet := gopacket.NewPacket(data, linkType, gopacket.Default); packet.Layer(layers.LayerTypeUDP) == nil {
+			t.Errorf("packet %d: got %s", i, packet)
+		}
+	}
+	if _, _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestPcapLinkType(t *testing.T) {
+	header := make([]byte, pcapHeaderLength)
+	binary.LittleEndian.PutUint32(header, 0xA1B2C3D4)
+	binary.LittleEndian.PutUint32(header[20:], 0x10000000|linkTypeLinuxSLL2) // with FCS length
+	if got := pcapLinkType(header); got != linkTypeLinuxSLL2 {
+		t.Errorf("got %d, want %d", got, linkTypeLinuxSLL2)
+	}
+	binary.BigEndian.PutUint32(header, 0xA1B23C4D)
+	binary.BigEndian.PutUint32(header[20:], uint32(layers.LinkTypeEthernet))
+	if got := pcapLinkType(header); got != uint32(layers.LinkTypeEthernet) {
+		t.Errorf("got %d, want %d", got, layers.LinkTypeEthernet)
+	}
+	if got := pcapLinkType(ngSection(binary.LittleEndian)); got != 0 {
+		t.Errorf("pcapng: got %d, want 0", got)
+	}
+}
@@ -0,0 +1,179 @@
+package rtp
+
+import (
+	"fmt"
+	"time"
+)
+
+//DefaultClockRate is used for dynamic payload types without a configured clock rate
+const DefaultClockRate = 8000
+
+// static payload type clock rates, RFC 3551 tables 4 and 5
+var staticClockRates = map[int]int{
+	0: 8000, 3: 8000, 4: 8000, 5: 8000, 6: 16000, 7: 8000, 8: 8000, 9: 8000,
+	10: 44100, 11: 44100, 12: 8000, 13: 8000, 14: 90000, 15: 8000, 16: 11025,
+	17: 22050, 18: 8000, 25: 90000, 26: 90000, 28: 90000, 31: 90000, 32: 90000,
+	33: 90000, 34: 90000,
+}
+
+// sequence numbers below the highest one remembered for duplicate detection
+const seqWindowSize = 64
+
+// rtpStats keeps per stream state needed for RFC 3550 statistics
+type rtpStats struct {
+	lastArrival  time.Time
+	lastTransit  uint32
+	jitterSum    float64
+	jitterCount  uint
+	receivedMask uint64 // bit n set if CurSeq-n was received
+	totalBytes   uint64
+}
+
+//ClockRate returns RTP timestamp clock rate of payload type, custom rates take precedence
+func ClockRate(payloadType int, custom map[int]int) int {
+	if rate, ok := custom[payloadType]; ok {
+		return rate
+	}
+	if rate, ok := staticClockRates[payloadType]; ok {
+		return rate
+	}
+	return DefaultClockRate
+}
+
+// updateArrivalStats computes interarrival jitter as in RFC 3550 A.8, delta and bitrate,
+// for every packet that is not a duplicate, in arrival order
+func (r *RtpStream) updateArrivalStats(rtp *RtpPacket) {
+	if r.ClockRate == 0 {
+		r.ClockRate = DefaultClockRate
+	}
+	r.stats.totalBytes += uint64(len(rtp.Data))
+
+	// arrival in timestamp units, transit wraps with the timestamp so it's kept in 32 bits
+	ns, rate := rtp.ReceivedAt.UnixNano(), int64(r.ClockRate)
+	arrival := uint32(ns/1e9*rate + ns%1e9*rate/1e9)
+	transit := arrival - rtp.Timestamp
+	if !r.stats.lastArrival.IsZero() {
+		if delta := rtp.ReceivedAt.Sub(r.stats.lastArrival); delta > r.MaxDelta {
+			r.MaxDelta = delta
+		}
+		d := int32(transit - r.stats.lastTransit)
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+		jitterMs := float32(r.jitter * 1000 / float64(r.ClockRate))
+		if jitterMs > r.MaxJitter {
+			r.MaxJitter = jitterMs
+		}
+		r.stats.jitterSum += float64(jitterMs)
+		r.stats.jitterCount++
+		r.MeanJitter = float32(r.stats.jitterSum / float64(r.stats.jitterCount))
+		r.Jitter = jitterMs
+	}
+	r.stats.lastArrival = rtp.ReceivedAt
+	r.stats.lastTransit = transit
+
+	if duration := rtp.ReceivedAt.Sub(r.StartTime).Seconds(); duration > 0 {
+		r.MeanBandwidth = float32(float64(r.stats.totalBytes*8) / duration / 1000)
+	}
+}
+
+// advanceSeqWindow records a packet that moved highest sequence number forward by n
+func (r *RtpStream) advanceSeqWindow(n uint) {
+	if n >= seqWindowSize {
+		r.stats.receivedMask = 1
+		return
+	}
+	r.stats.receivedMask = r.stats.receivedMask<<n | 1
+}
+
+// handleLatePacket classifies packet older than CurSeq as duplicate or reordered,
+// reordered packet reported as lost earlier is no longer counted as lost
+func (r *RtpStream) handleLatePacket(rtp *RtpPacket) {
+	back := uint(r.CurSeq - rtp.SequenceNumber)
+	if back < seqWindowSize && r.stats.receivedMask&(1<<back) != 0 {
+		r.DuplicatePackets++
+		return
+	}
+	r.ReorderedPackets++
+	if back < seqWindowSize {
+		r.stats.receivedMask |= 1 << back
+		if r.LostPackets > 0 {
+			r.LostPackets--
+		}
+	}
+	r.updateArrivalStats(rtp)
+}
+
+//LostPercent returns lost packets as a percentage of expected packets
+func (r RtpStream) LostPercent() float64 {
+	if r.TotalExpectedPackets == 0 {
+		return 0
+	}
+	return float64(r.LostPackets) * 100 / float64(r.TotalExpectedPackets)
+}
+
+//Stats returns RTP stream analysis summary
+func (r RtpStream) Stats() string {
+	s := fmt.Sprintf(
+		"packets:%d expected:%d lost:%d (%.2f%%) duplicates:%d reordered:%d max delta:%.2fms "+
+			"jitter:%.2fms max jitter:%.2fms mean jitter:%.2fms mean bitrate:%.2fkbps clock rate:%d",
+		r.TotalPackets+r.ReorderedPackets,
+		r.TotalExpectedPackets,
+		r.LostPackets,
+		r.LostPercent(),
+		r.DuplicatePackets,
+		r.ReorderedPackets,
+		float64(r.MaxDelta)/float64(time.Millisecond),
+		r.Jitter,
+		r.MaxJitter,
+		r.MeanJitter,
+		r.MeanBandwidth,
+		r.ClockRate,
+	)
+	if r.Srtp != nil {
+		s += fmt.Sprintf(" srtp authenticated:%d failed:%d", r.Srtp.Authenticated, r.Srtp.AuthFailures)
+	}
+	return s
+}
+
+//RtcpStats returns summary of RTCP about the stream, loss and jitter as reported by the far end,
+//empty if there was none
+func (r RtpStream) RtcpStats() string {
+	rtcp := r.Rtcp
+	if rtcp == nil || rtcp.Packets == 0 {
+		return ""
+	}
+	clockRate := r.ClockRate
+	if clockRate == 0 {
+		clockRate = DefaultClockRate
+	}
+	s := fmt.Sprintf("sr:%d rr:%d", rtcp.SenderReports, rtcp.ReceiverReports)
+	if rtcp.Reports > 0 {
+		s += fmt.Sprintf(" reported lost:%d (%.2f%% last interval) jitter:%.2fms max jitter:%.2fms",
+			rtcp.CumulativeLost,
+			rtcp.FractionLost,
+			float64(rtcp.Jitter)*1000/float64(clockRate),
+			float64(rtcp.MaxJitter)*1000/float64(clockRate),
+		)
+	}
+	if rtcp.MaxRoundTrip > 0 {
+		s += fmt.Sprintf(" rtt:%.2fms max rtt:%.2fms", rtcp.RoundTrip, rtcp.MaxRoundTrip)
+	}
+	if rtcp.Nacks > 0 || rtcp.Plis > 0 || rtcp.Firs > 0 {
+		s += fmt.Sprintf(" nack:%d (%d packets) pli:%d fir:%d", rtcp.Nacks, rtcp.NackedPackets, rtcp.Plis, rtcp.Firs)
+	}
+	if rtcp.VoipMetrics != nil {
+		s += " xr " + rtcp.VoipMetrics.String()
+	}
+	if rtcp.Cname != "" {
+		s += " cname:" + rtcp.Cname
+	}
+	if rtcp.Bye {
+		s += " bye"
+		if rtcp.ByeReason != "" {
+			s += ":" + rtcp.ByeReason
+		}
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package rtp
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// interarrival jitter as in RFC 3550 section 6.4.1 and A.8, J += (|D| - J) / 16 in timestamp units
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name       string
+		clockRate  int
+		firstTs    uint32
+		tsStep     uint32
+		arrivals   []float64 // ms
+		jitter     float64   // ms
+		maxJitter  float64
+		meanJitter float64
+	}{
+		{"constant transit", 8000, 0, 160, []float64{0, 20, 40, 60}, 0, 0, 0},
+		// D of 16 units gives J = 1, the packet after the late one has D of 16 as well, J = 1 + 15/16
+		{"one late packet", 8000, 0, 160, []float64{0, 20, 42, 60}, 1.9375 / 8, 1.9375 / 8, (1.0/8 + 1.9375/8) / 3},
+		{"early packet", 8000, 0, 160, []float64{0, 20, 38, 60}, 1.9375 / 8, 1.9375 / 8, (1.0/8 + 1.9375/8) / 3},
+		{"16 kHz", 16000, 0, 320, []float64{0, 20, 41}, 1.0 / 16, 1.0 / 16, 1.0 / 32},
+		{"timestamp wraps", 8000, 0xFFFFFF00, 160, []float64{0, 20, 40, 60}, 0, 0, 0},
+		// every transit differs by 8 units, J converges to 8 units = 1 ms
+		{"alternating", 8000, 0, 160, []float64{0, 21, 40, 61, 80}, 8 * (1 - math.Pow(15.0/16, 4)) / 8, 8 * (1 - math.Pow(15.0/16, 4)) / 8,
+			(1 - 15.0/16 + 1 - math.Pow(15.0/16, 2) + 1 - math.Pow(15.0/16, 3) + 1 - math.Pow(15.0/16, 4)) / 4},
+	}
+	for _, tt := range tests {
+		s := &RtpStream{ClockRate: tt.clockRate, StartTime: testStart, discardPackets: true}
+		for i, ms := range tt.arrivals {
+			s.AddPacket(&RtpPacket{
+				ReceivedAt:     testStart.Add(time.Duration(ms * float64(time.Millisecond))),
+				SequenceNumber: uint16(i + 1),
+				Timestamp:      tt.firstTs + uint32(i)*tt.tsStep,
+			})
+		}
+		for _, v := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"jitter", float64(s.Jitter), tt.jitter},
+			{"max jitter", float64(s.MaxJitter), tt.maxJitter},
+			{"mean jitter", float64(s.MeanJitter), tt.meanJitter},
+		} {
+			if math.Abs(v.got-v.want) > 1e-5 {
+				t.Errorf("%s: got %s %.6fms, want %.6fms", tt.name, v.name, v.got, v.want)
+			}
+		}
+	}
+}
+
+func TestLossAndReordering(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		seqs                                 []uint16
+		expected, lost, duplicate, reordered uint
+	}{
+		{"in order", []uint16{1, 2, 3, 4}, 4, 0, 0, 0},
+		{"lost", []uint16{1, 2, 5, 6}, 6, 2, 0, 0},
+		{"reordered", []uint16{1, 3, 2, 4}, 4, 0, 0, 1},
+		{"duplicate", []uint16{1, 2, 2, 3}, 3, 0, 1, 0},
+		{"wrap", []uint16{65534, 65535, 0, 1}, 4, 0, 0, 0},
+		{"lost across wrap", []uint16{65534, 1}, 4, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		s := &RtpStream{ClockRate: 8000, StartTime: testStart, discardPackets: true}
+		for i, seq := range tt.seqs {
+			s.AddPacket(&RtpPacket{
+				ReceivedAt:     testStart.Add(time.Duration(i) * 20 * time.Millisecond),
+				SequenceNumber: seq,
+				Timestamp:      uint32(seq) * 160,
+			})
+		}
+		if s.TotalExpectedPackets != tt.expected || s.LostPackets != tt.lost || s.DuplicatePackets != tt.duplicate || s.ReorderedPackets != tt.reordered {
+			t.Errorf("%s: got expected:%d lost:%d duplicates:%d reordered:%d, want %d, %d, %d, %d", tt.name,
+				s.TotalExpectedPackets, s.LostPackets, s.DuplicatePackets, s.ReorderedPackets,
+				tt.expected, tt.lost, tt.duplicate, tt.reordered)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/srtp"
 	"github.com/david-biro/rtpdump/util"
 )
 
@@ -16,6 +17,14 @@ type RtpStream struct {
 	SrcIP, DstIP       string
 	SrcPort, DstPort   uint
 	StartTime, EndTime time.Time
+	Tunnel             *GtpTunnel
+	Srtp               *srtp.Context
+	Call               *SipCall
+	Format             *MediaFormat
+	Rtcp               *RtcpStats
+	Framing            string // framing of RTP received over TCP
+	Encapsulation      Encapsulation
+	ClockRate          int
 
 	// Internal - improve
 	FirstTimestamp uint32
@@ -23,30 +32,57 @@ type RtpStream struct {
 	Cycle          uint
 	CurSeq         uint16
 
-	// Calculated
+	// Calculated, jitter in milliseconds, bandwidth in kbps
+	TotalPackets         uint
 	TotalExpectedPackets uint
 	LostPackets          uint
+	DuplicatePackets     uint
+	ReorderedPackets     uint
+	Jitter               float32
+	MaxJitter            float32
 	MeanJitter           float32
+	MaxDelta             time.Duration
 	MeanBandwidth        float32
 
-	RtpPackets []*RtpPacket
+	RtpPackets     []*RtpPacket
+	discardPackets bool
+	jitter         float64 // in timestamp units
+	stats          rtpStats
+	sdpGeneration  int
 }
 
 func (r RtpStream) String() string {
-	return fmt.Sprintf("%s - %s   0x%08X   %3d   %5d   %s:%d -> %s:%d",
+	s := fmt.Sprintf("%s - %s   0x%08X   %3d   %5d   %s:%d -> %s:%d",
 		util.TimeToStr(r.StartTime),
 		util.TimeToStr(r.EndTime),
 		r.Ssrc,
 		r.PayloadType,
-		len(r.RtpPackets),
+		r.TotalPackets,
 		r.SrcIP,
 		r.SrcPort,
 		r.DstIP,
 		r.DstPort,
 	)
+	if r.Format != nil {
+		s += "   " + r.Format.String()
+	}
+	if len(r.Encapsulation) > 0 {
+		s += "   " + r.Encapsulation.String()
+	}
+	if r.Tunnel != nil {
+		s += "   " + r.Tunnel.String()
+	}
+	if r.Srtp != nil {
+		s += "   srtp:" + r.Srtp.Suite()
+	}
+	if r.Framing != "" {
+		s += "   tcp:" + r.Framing
+	}
+	return s
 }
 
-func (r *RtpStream) AddPacket(rtp *RtpPacket) {
+//AddPacket appends packet to the stream, returns false if it was ignored as out of sequence
+func (r *RtpStream) AddPacket(rtp *RtpPacket) bool {
 	var lostPackets int32 = 0
 
 	// skip calculating number of lost packets if this is the first packet of the stream
@@ -57,7 +93,8 @@ func (r *RtpStream) AddPacket(rtp *RtpPacket) {
 	if lostPackets < 0 { // if number of lost packets is negative,
 		// detect sequence number wrap-around and treat it as stream continuation while accounting for possible packet losses (±100 packets)
 		if !((r.CurSeq > 65435) && (rtp.SequenceNumber < 100)) { // else, ignore out-of-sequence packets
-			return
+			r.handleLatePacket(rtp)
+			return false
 		}
 
 		// handle sequence number overflow and lost packets by
@@ -69,10 +106,31 @@ func (r *RtpStream) AddPacket(rtp *RtpPacket) {
 		log.Sdebug("%d packets lost between packets %d and %d", lostPackets, r.CurSeq, rtp.SequenceNumber)
 	}
 
+	r.updateArrivalStats(rtp)
+	r.advanceSeqWindow(uint(rtp.SequenceNumber - r.CurSeq))
+
 	r.EndTime = rtp.ReceivedAt
 	r.CurSeq = rtp.SequenceNumber
 	r.TotalExpectedPackets += 1 + uint(lostPackets) // count current packet and all lost packets
 	r.LostPackets += uint(lostPackets)
 
-	r.RtpPackets = append(r.RtpPackets, rtp)
+	r.TotalPackets++
+	if !r.discardPackets {
+		r.RtpPackets = append(r.RtpPackets, rtp)
+	}
+	return true
+}
+
+//SsrcCollisions returns streams sharing ssrc with another stream, grouped by ssrc
+func SsrcCollisions(streams []*RtpStream) map[uint32][]*RtpStream {
+	bySsrc := make(map[uint32][]*RtpStream)
+	for _, s := range streams {
+		bySsrc[s.Ssrc] = append(bySsrc[s.Ssrc], s)
+	}
+	for ssrc, s := range bySsrc {
+		if len(s) < 2 {
+			delete(bySsrc, ssrc)
+		}
+	}
+	return bySsrc
 }
@@ -0,0 +1,182 @@
+package rtp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/david-biro/rtpdump/srtp"
+)
+
+//MediaFormat is payload format negotiated for a payload type with a=rtpmap and a=fmtp
+type MediaFormat struct {
+	PayloadType int
+	Encoding    string
+	ClockRate   int
+	Channels    int
+	Fmtp        map[string]string
+}
+
+func (f MediaFormat) String() string {
+	s := fmt.Sprintf("%s/%d", f.Encoding, f.ClockRate)
+	if f.Channels > 1 {
+		s += "/" + strconv.Itoa(f.Channels)
+	}
+	return s
+}
+
+// static payload type encodings, RFC 3551 table 4
+var staticEncodings = map[int]string{
+	0: "PCMU", 3: "GSM", 4: "G723", 5: "DVI4", 6: "DVI4", 7: "LPC", 8: "PCMA", 9: "G722",
+	10: "L16", 11: "L16", 12: "QCELP", 13: "CN", 14: "MPA", 15: "G728", 16: "DVI4",
+	17: "DVI4", 18: "G729", 25: "CelB", 26: "JPEG", 28: "nv", 31: "H261", 32: "MPV",
+	33: "MP2T", 34: "H263",
+}
+
+// sdpMedia is a media description, connection address is the one media is received on
+type sdpMedia struct {
+	mediaType string
+	ip        string
+	port      uint
+	formats   map[int]*MediaFormat
+	crypto    []string
+}
+
+// parseSdp returns media descriptions with their formats, static payload types without
+// a=rtpmap get their RFC 3551 encoding
+func parseSdp(body []byte) []*sdpMedia {
+	var sessionIP string
+	var media []*sdpMedia
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		var m *sdpMedia
+		if len(media) > 0 {
+			m = media[len(media)-1]
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'c':
+			// c=IN IP4 192.0.2.1
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				continue
+			}
+			ip := strings.Split(fields[2], "/")[0] // multicast ttl
+			if parsed := net.ParseIP(ip); parsed != nil {
+				ip = parsed.String()
+			}
+			if m == nil {
+				sessionIP = ip
+			} else {
+				m.ip = ip
+			}
+		case 'm':
+			// m=audio 49170 RTP/SAVP 0 96
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				continue
+			}
+			port, err := strconv.ParseUint(strings.Split(fields[1], "/")[0], 10, 16)
+			if err != nil {
+				continue
+			}
+			m = &sdpMedia{mediaType: fields[0], port: uint(port), formats: make(map[int]*MediaFormat)}
+			for _, format := range fields[3:] {
+				pt, err := strconv.Atoi(format)
+				if err != nil {
+					continue
+				}
+				if encoding, ok := staticEncodings[pt]; ok {
+					m.formats[pt] = &MediaFormat{PayloadType: pt, Encoding: encoding, ClockRate: staticClockRates[pt], Channels: 1}
+				}
+			}
+			media = append(media, m)
+		case 'a':
+			if m == nil {
+				continue
+			}
+			name, attribute := value, ""
+			if i := strings.Index(value, ":"); i >= 0 {
+				name, attribute = value[:i], value[i+1:]
+			}
+			switch name {
+			case "rtpmap":
+				// a=rtpmap:96 AMR-WB/16000/1
+				fields := strings.Fields(attribute)
+				if len(fields) < 2 {
+					continue
+				}
+				pt, err := strconv.Atoi(fields[0])
+				if err != nil {
+					continue
+				}
+				encoding := strings.Split(fields[1], "/")
+				f := &MediaFormat{PayloadType: pt, Encoding: encoding[0], ClockRate: DefaultClockRate, Channels: 1}
+				if len(encoding) > 1 {
+					f.ClockRate, _ = strconv.Atoi(encoding[1])
+				}
+				if len(encoding) > 2 {
+					f.Channels, _ = strconv.Atoi(encoding[2])
+				}
+				if old, ok := m.formats[pt]; ok {
+					f.Fmtp = old.Fmtp
+				}
+				m.formats[pt] = f
+			case "fmtp":
+				// a=fmtp:96 octet-align=1; mode-set=0,2,5,7
+				i := strings.IndexAny(attribute, " \t")
+				if i < 0 {
+					continue
+				}
+				pt, err := strconv.Atoi(attribute[:i])
+				if err != nil {
+					continue
+				}
+				f, ok := m.formats[pt]
+				if !ok {
+					f = &MediaFormat{PayloadType: pt, ClockRate: DefaultClockRate, Channels: 1}
+					m.formats[pt] = f
+				}
+				f.Fmtp = make(map[string]string)
+				for _, parameter := range strings.Split(attribute[i+1:], ";") {
+					parameter = strings.TrimSpace(parameter)
+					if parameter == "" {
+						continue
+					}
+					if j := strings.Index(parameter, "="); j >= 0 {
+						f.Fmtp[strings.ToLower(parameter[:j])] = parameter[j+1:]
+					} else {
+						f.Fmtp[strings.ToLower(parameter)] = ""
+					}
+				}
+			case "crypto":
+				m.crypto = append(m.crypto, attribute)
+			}
+		}
+	}
+
+	for _, m := range media {
+		if m.ip == "" {
+			m.ip = sessionIP
+		}
+	}
+	return media
+}
+
+// registerSrtpKeys registers keys of a=crypto attributes (RFC 4568) for media sent from the
+// address advertised in SDP, assuming symmetric RTP
+func (m *sdpMedia) registerSrtpKeys() {
+	if m.ip == "" || m.port == 0 {
+		return
+	}
+	for _, crypto := range m.crypto {
+		if err := srtp.AddCryptoAttribute(m.ip, m.port, crypto); err != nil {
+			log.Swarn("ignoring a=crypto for %s:%d: %s", m.ip, m.port, err)
+		}
+	}
+}
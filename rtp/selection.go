@@ -0,0 +1,135 @@
+package rtp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david-biro/rtpdump/util"
+)
+
+//TimeBound is an absolute time or, if Relative, an offset from the first packet of the capture
+type TimeBound struct {
+	Time     time.Time
+	Offset   time.Duration
+	Relative bool
+}
+
+//ParseTimeBound parses time as shown in stream list or ISO 8601, or offset from capture start, e.g. "+90s"
+func ParseTimeBound(s string) (TimeBound, error) {
+	if offset, err := time.ParseDuration(strings.TrimPrefix(s, "+")); err == nil {
+		return TimeBound{Offset: offset, Relative: true}, nil
+	}
+	t, err := util.StrToTime(s)
+	if err != nil {
+		return TimeBound{}, errors.New("invalid time '" + s + "', expected \"dd-mm-yyyy hh:mm:ss\", ISO 8601 or offset like \"+90s\"")
+	}
+	return TimeBound{Time: t}, nil
+}
+
+// at returns absolute time of bound, zero if not set
+func (b TimeBound) at(captureStart time.Time) time.Time {
+	if b.Relative {
+		return captureStart.Add(b.Offset)
+	}
+	return b.Time
+}
+
+//ParseHosts parses comma separated addresses and networks, e.g. "10.0.0.1,192.168.0.0/16"
+func ParseHosts(s string) ([]*net.IPNet, error) {
+	var hosts []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if _, ipNet, err := net.ParseCIDR(field); err == nil {
+			hosts = append(hosts, ipNet)
+			continue
+		}
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, errors.New("invalid host '" + field + "'")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		hosts = append(hosts, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return hosts, nil
+}
+
+//ParseSsrcs parses comma separated SSRCs, in hex with 0x prefix or decimal
+func ParseSsrcs(s string) ([]uint32, error) {
+	var ssrcs []uint32
+	for _, field := range strings.Split(s, ",") {
+		ssrc, err := strconv.ParseUint(strings.TrimSpace(field), 0, 32)
+		if err != nil {
+			return nil, errors.New("invalid ssrc '" + field + "'")
+		}
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+	return ssrcs, nil
+}
+
+//SetTimeWindow skips packets captured before start or after end, zero bounds aren't checked
+func (r *RtpReader) SetTimeWindow(start, end TimeBound) {
+	r.start, r.end = start, end
+}
+
+//SetHostFilter only looks for RTP and RTCP sent from or to given hosts, after decapsulation
+func (r *RtpReader) SetHostFilter(hosts []*net.IPNet) {
+	r.hosts = hosts
+}
+
+//SetSelectedPorts only looks for RTP and RTCP sent from or to given ports, after decapsulation
+func (r *RtpReader) SetSelectedPorts(ports []PortRange) {
+	r.selectedPorts = ports
+}
+
+//SetSsrcFilter only reports streams with given SSRCs
+func (r *RtpReader) SetSsrcFilter(ssrcs []uint32) {
+	r.ssrcs = nil
+	if len(ssrcs) > 0 {
+		r.ssrcs = make(map[uint32]bool, len(ssrcs))
+		for _, ssrc := range ssrcs {
+			r.ssrcs[ssrc] = true
+		}
+	}
+}
+
+// inTimeWindow is checked for every packet read, before decoding it, capture files start with their first
+// packet, filtered or not, live captures with their first packet matching the filter
+func (r *RtpReader) inTimeWindow(t time.Time) bool {
+	if r.captureStart.IsZero() {
+		r.captureStart = t
+	}
+	if start := r.start.at(r.captureStart); !start.IsZero() && t.Before(start) {
+		return false
+	}
+	if end := r.end.at(r.captureStart); !end.IsZero() && t.After(end) {
+		return false
+	}
+	return true
+}
+
+func (r *RtpReader) isSelectedHost(src, dst string) bool {
+	if len(r.hosts) == 0 {
+		return true
+	}
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	for _, host := range r.hosts {
+		if (srcIP != nil && host.Contains(srcIP)) || (dstIP != nil && host.Contains(dstIP)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RtpReader) isSelectedPort(srcPort, dstPort uint16) bool {
+	return len(r.selectedPorts) == 0 || inPortRanges(r.selectedPorts, srcPort) || inPortRanges(r.selectedPorts, dstPort)
+}
+
+func (r *RtpReader) isSelectedSsrc(ssrc uint32) bool {
+	return r.ssrcs == nil || r.ssrcs[ssrc]
+}
@@ -0,0 +1,209 @@
+package rtp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/david-biro/rtpdump/log"
+)
+
+// SipPort is the default SIP port, messages on other ports are recognized by their start line
+const SipPort = 5060
+
+// compact header forms, RFC 3261 section 7.3.3
+var sipCompactHeaders = map[string]string{
+	"i": "call-id",
+	"f": "from",
+	"t": "to",
+	"c": "content-type",
+	"l": "content-length",
+	"m": "contact",
+	"v": "via",
+}
+
+var sipMethods = []string{"INVITE", "ACK", "BYE", "CANCEL", "OPTIONS", "REGISTER", "PRACK",
+	"SUBSCRIBE", "NOTIFY", "PUBLISH", "INFO", "REFER", "MESSAGE", "UPDATE"}
+
+//SipCall describes the SIP dialog a stream was negotiated in
+type SipCall struct {
+	CallID   string
+	From, To string
+}
+
+func (c SipCall) String() string {
+	return c.CallID + "   " + c.From + " -> " + c.To
+}
+
+// sipMessage is a parsed SIP request or response, headers by lower case full name
+type sipMessage struct {
+	startLine string
+	headers   map[string]string
+	body      []byte
+}
+
+// sipEndpoint is a media address advertised in SDP with its payload formats
+type sipEndpoint struct {
+	call    *SipCall
+	formats map[int]*MediaFormat
+}
+
+// isSipMessage returns true if payload starts with a status line or a request line ending in the SIP
+// version, RTSP requests use the same methods, e.g. OPTIONS keepalives of interleaved media connections
+func isSipMessage(payload []byte) bool {
+	if bytes.HasPrefix(payload, []byte("SIP/2.0 ")) {
+		return true
+	}
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return false
+	}
+	requestLine := bytes.TrimRight(payload[:end], "\r")
+	if !bytes.HasSuffix(requestLine, []byte(" SIP/2.0")) {
+		return false
+	}
+	for _, method := range sipMethods {
+		if len(requestLine) > len(method) && requestLine[len(method)] == ' ' && bytes.HasPrefix(requestLine, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSipMessages parses all messages of a datagram or of a message reassembled from TCP, bodies are cut at Content-Length
+func parseSipMessages(payload []byte) []*sipMessage {
+	var messages []*sipMessage
+	for len(payload) > 0 && isSipMessage(payload) {
+		end := bytes.Index(payload, []byte("\r\n\r\n"))
+		separatorLen := 4
+		if end < 0 {
+			if end = bytes.Index(payload, []byte("\n\n")); end < 0 {
+				end, separatorLen = len(payload), 0
+			} else {
+				separatorLen = 2
+			}
+		}
+
+		lines := strings.Split(strings.Replace(string(payload[:end]), "\r\n", "\n", -1), "\n")
+		message := &sipMessage{startLine: lines[0], headers: make(map[string]string)}
+		for _, line := range lines[1:] {
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				continue
+			}
+			name := strings.ToLower(strings.TrimSpace(line[:i]))
+			if full, ok := sipCompactHeaders[name]; ok {
+				name = full
+			}
+			if _, ok := message.headers[name]; !ok { // first occurrence is enough for the headers used
+				message.headers[name] = strings.TrimSpace(line[i+1:])
+			}
+		}
+
+		payload = payload[end+separatorLen:]
+		bodyLen := len(payload)
+		if length, err := strconv.Atoi(message.headers["content-length"]); err == nil && length < bodyLen {
+			bodyLen = length
+		}
+		message.body = payload[:bodyLen]
+		payload = payload[bodyLen:]
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// sipMessageSize returns size of SIP message at the start of stream data with its body, 0 if incomplete,
+// Content-Length is mandatory on streams, RFC 3261 section 20.14
+func sipMessageSize(data []byte) (int, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0, nil
+	}
+	size := end + 4
+	for _, line := range strings.Split(string(data[:end]), "\r\n")[1:] {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		if name == "content-length" || name == "l" {
+			length, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil || length < 0 {
+				return 0, errors.New("invalid SIP Content-Length")
+			}
+			size += length
+			break
+		}
+	}
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// sipAddress returns URI of From or To header value without display name and parameters
+func sipAddress(value string) string {
+	if i := strings.Index(value, "<"); i >= 0 {
+		if j := strings.Index(value[i:], ">"); j > 0 {
+			return value[i+1 : i+j]
+		}
+	}
+	return strings.TrimSpace(strings.Split(value, ";")[0])
+}
+
+// decodeSIP links media addresses in SDP bodies to their call and registers SRTP keys
+func (r *RtpReader) decodeSIP(payload []byte) error {
+	for _, message := range parseSipMessages(payload) {
+		if !strings.Contains(strings.ToLower(message.headers["content-type"]), "application/sdp") || len(message.body) == 0 {
+			continue
+		}
+		call := &SipCall{
+			CallID: message.headers["call-id"],
+			From:   sipAddress(message.headers["from"]),
+			To:     sipAddress(message.headers["to"]),
+		}
+		log.Sdebug("SDP in '%s', call %s", message.startLine, call.CallID)
+		for _, media := range parseSdp(message.body) {
+			media.registerSrtpKeys()
+			if media.ip == "" || media.port == 0 {
+				continue
+			}
+			if r.sipEndpoints == nil {
+				r.sipEndpoints = make(map[string]*sipEndpoint)
+			}
+			r.sipEndpoints[net.JoinHostPort(media.ip, strconv.Itoa(int(media.port)))] = &sipEndpoint{call: call, formats: media.formats}
+			r.sdpGeneration++
+		}
+	}
+	return nil
+}
+
+// linkStream sets call and payload format of a stream from SDP, payload types offered by
+// the receiver take precedence as they are what it expects to receive (RFC 3264)
+func (r *RtpReader) linkStream(s *RtpStream) {
+	if s.sdpGeneration == r.sdpGeneration {
+		return
+	}
+	s.sdpGeneration = r.sdpGeneration
+	for _, address := range []string{
+		net.JoinHostPort(s.DstIP, strconv.Itoa(int(s.DstPort))),
+		net.JoinHostPort(s.SrcIP, strconv.Itoa(int(s.SrcPort))),
+	} {
+		endpoint, ok := r.sipEndpoints[address]
+		if !ok {
+			continue
+		}
+		if s.Call == nil {
+			s.Call = endpoint.call
+		}
+		if format, ok := endpoint.formats[s.PayloadType]; ok && format.Encoding != "" {
+			s.Format = format
+			if _, custom := r.clockRates[s.PayloadType]; !custom && format.ClockRate > 0 {
+				s.ClockRate = format.ClockRate
+			}
+			return
+		}
+	}
+}
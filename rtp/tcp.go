@@ -0,0 +1,433 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/david-biro/rtpdump/log"
+	"github.com/google/gopacket/layers"
+)
+
+// data buffered for a TCP direction at most, a frame is 64k at most in both framings
+const maxTCPBuffer = 256 * 1024
+
+// out of order segments kept for a TCP direction at most, a gap is skipped when exceeded
+const maxPendingSegments = 64
+
+// data searched for a valid frame before a TCP direction is considered not to carry media
+const maxFramingSearch = 16 * 1024
+
+//RtspPort is the registered RTSP port, connections on it are reassembled for interleaved media even if the
+//media port filter doesn't allow it
+const RtspPort = 554
+
+// TCP directions idle this long are dropped, one seen again is picked up like one captured from the middle
+const tcpFlowTimeout = 5 * time.Minute
+
+// TCP directions reassembled at most, the least recently active one is dropped when exceeded
+const maxTCPFlows = 4096
+
+type tcpFraming int
+
+const (
+	framingUnknown     tcpFraming = iota
+	framingRfc4571                // 16 bit length prefix, RFC 4571
+	framingInterleaved            // '$', channel and 16 bit length, interleaved with RTSP messages, RFC 2326
+	framingSip                    // SIP messages, delimited by Content-Length, RFC 3261 section 18.3
+	framingNone
+)
+
+func (f tcpFraming) String() string {
+	switch f {
+	case framingRfc4571:
+		return "rfc4571"
+	case framingInterleaved:
+		return "rtsp"
+	}
+	return ""
+}
+
+// rtspMethods start RTSP requests sent on connections carrying interleaved media
+var rtspMethods = []string{"RTSP/1.0 ", "OPTIONS ", "DESCRIBE ", "ANNOUNCE ", "SETUP ", "PLAY ", "PAUSE ",
+	"RECORD ", "TEARDOWN ", "GET_PARAMETER ", "SET_PARAMETER ", "REDIRECT "}
+
+// TCP directions are reassembled separately
+type tcpFlowKey struct {
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+	encap            string
+}
+
+// tcpFlow is the reassembly state of a TCP direction
+type tcpFlow struct {
+	nextSeq  uint32
+	buffer   []byte
+	pending  map[uint32][]byte
+	framing  tcpFraming
+	searched int // bytes skipped since the last frame while framing was unknown
+	detectAt int // buffer length detection is run again at
+	lastSeen time.Time
+}
+
+// reassembleTCP appends segment to its direction and decodes RTP and RTCP of every complete frame, or every
+// complete message of a SIP flow, a flow seen from the middle is picked up from its first segment captured
+func (r *RtpReader) reassembleTCP(info *packetInfo, src string, dst string, tcp *layers.TCP, sip bool) error {
+	key := tcpFlowKey{srcIP: src, dstIP: dst, srcPort: uint16(tcp.SrcPort), dstPort: uint16(tcp.DstPort), encap: info.encap.String()}
+	if r.tcpFlows == nil {
+		r.tcpFlows = make(map[tcpFlowKey]*tcpFlow)
+	}
+	r.expireTCPFlows(info.receivedAt)
+	if tcp.RST {
+		delete(r.tcpFlows, key)
+		return errors.New("TCP connection reset")
+	}
+	if tcp.SYN {
+		r.addTCPFlow(key, &tcpFlow{nextSeq: tcp.Seq + 1, lastSeen: info.receivedAt})
+		return nil
+	}
+
+	flow, ok := r.tcpFlows[key]
+	if !ok {
+		if len(tcp.Payload) == 0 {
+			return errors.New("No TCP payload")
+		}
+		flow = &tcpFlow{nextSeq: tcp.Seq}
+		r.addTCPFlow(key, flow)
+	}
+	flow.lastSeen = info.receivedAt
+	if tcp.FIN {
+		// no more data to wait for before detecting framing
+		flow.detectAt = 0
+		defer delete(r.tcpFlows, key)
+	}
+	if sip && flow.framing == framingUnknown {
+		flow.framing = framingSip
+	}
+	if flow.framing == framingNone {
+		return errors.New("No media framing on TCP flow")
+	}
+	flow.add(tcp.Seq, tcp.Payload)
+
+	if flow.framing == framingSip {
+		for message := flow.nextSipMessage(); message != nil; message = flow.nextSipMessage() {
+			r.decodeSIP(message)
+		}
+		return nil
+	}
+
+	udp := &layers.UDP{SrcPort: layers.UDPPort(tcp.SrcPort), DstPort: layers.UDPPort(tcp.DstPort)}
+	for {
+		frame := flow.nextFrame()
+		if frame == nil {
+			break
+		}
+		frameInfo := *info
+		frameInfo.framing = flow.framing.String()
+		udp.Payload = frame
+		if err := r.decodeMediaLayer(&frameInfo, src, dst, udp); err != nil {
+			log.Strace("TCP %s:%d -> %s:%d: %s", src, tcp.SrcPort, dst, tcp.DstPort, err)
+		}
+	}
+	if flow.framing == framingNone {
+		log.Sdebug("no RTP framing found on TCP %s:%d -> %s:%d", src, tcp.SrcPort, dst, tcp.DstPort)
+		flow.buffer, flow.pending = nil, nil
+	}
+	return nil
+}
+
+// addTCPFlow starts reassembly of a direction, dropping the least recently active one if too many are kept
+func (r *RtpReader) addTCPFlow(key tcpFlowKey, flow *tcpFlow) {
+	if _, ok := r.tcpFlows[key]; !ok && len(r.tcpFlows) >= maxTCPFlows {
+		var oldest tcpFlowKey
+		var oldestSeen time.Time
+		first := true
+		for k, f := range r.tcpFlows {
+			if first || f.lastSeen.Before(oldestSeen) {
+				oldest, oldestSeen, first = k, f.lastSeen, false
+			}
+		}
+		log.Sdebug("too many TCP flows, dropping %s:%d -> %s:%d", oldest.srcIP, oldest.srcPort, oldest.dstIP, oldest.dstPort)
+		delete(r.tcpFlows, oldest)
+	}
+	r.tcpFlows[key] = flow
+}
+
+// expireTCPFlows drops directions idle for longer than tcpFlowTimeout, checked once a second of capture time
+func (r *RtpReader) expireTCPFlows(now time.Time) {
+	if now.Sub(r.tcpSweep) < time.Second {
+		return
+	}
+	r.tcpSweep = now
+	for key, flow := range r.tcpFlows {
+		if now.Sub(flow.lastSeen) > tcpFlowTimeout {
+			log.Sdebug("TCP flow %s:%d -> %s:%d timed out", key.srcIP, key.srcPort, key.dstIP, key.dstPort)
+			delete(r.tcpFlows, key)
+		}
+	}
+}
+
+// add appends data in sequence to the buffer, retransmitted data is dropped and segments received
+// ahead of a gap are kept until it is filled
+func (f *tcpFlow) add(seq uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if diff := int32(seq - f.nextSeq); diff > 0 {
+		if f.pending == nil {
+			f.pending = make(map[uint32][]byte)
+		}
+		if len(f.pending) < maxPendingSegments {
+			f.pending[seq] = append([]byte(nil), data...)
+			return
+		}
+		// the gap won't be filled, continue from the oldest segment kept and find the next frame
+		log.Sdebug("TCP segment lost, skipping %d bytes", diff)
+		f.pending[seq] = append([]byte(nil), data...)
+		f.nextSeq = f.oldestPending()
+		f.buffer = f.buffer[:0]
+		if f.framing != framingUnknown && f.framing != framingSip {
+			f.framing, f.searched, f.detectAt = framingUnknown, 0, 0
+		}
+	} else if f.append(seq, data) == 0 {
+		return
+	}
+	for progress := true; progress; {
+		progress = false
+		for seq, data := range f.pending {
+			if int32(seq-f.nextSeq) <= 0 {
+				delete(f.pending, seq)
+				f.append(seq, data)
+				progress = true
+			}
+		}
+	}
+}
+
+// append adds part of data not received yet, returns number of bytes added
+func (f *tcpFlow) append(seq uint32, data []byte) int {
+	overlap := int(int32(f.nextSeq - seq))
+	if overlap >= len(data) {
+		return 0
+	}
+	data = data[overlap:]
+	if len(f.buffer)+len(data) > maxTCPBuffer {
+		log.Sdebug("TCP buffer full, dropping %d bytes", len(f.buffer))
+		f.buffer = f.buffer[:0]
+		if f.framing != framingSip {
+			f.framing, f.searched, f.detectAt = framingUnknown, 0, 0
+		}
+	}
+	f.buffer = append(f.buffer, data...)
+	f.nextSeq += uint32(len(data))
+	return len(data)
+}
+
+func (f *tcpFlow) oldestPending() uint32 {
+	var oldest uint32
+	first := true
+	for seq := range f.pending {
+		if first || int32(seq-oldest) < 0 {
+			oldest, first = seq, false
+		}
+	}
+	return oldest
+}
+
+// consume drops n bytes from the start of the buffer
+func (f *tcpFlow) consume(n int) {
+	f.buffer = f.buffer[:copy(f.buffer, f.buffer[n:])]
+}
+
+// nextFrame returns a copy of the next RTP or RTCP frame in the buffer, nil if more data is needed,
+// RTSP messages are skipped and framing is searched again after invalid data, the direction is given
+// up once maxFramingSearch bytes are skipped without a frame
+func (f *tcpFlow) nextFrame() []byte {
+	for len(f.buffer) > 0 {
+		if f.framing == framingUnknown {
+			// the buffer is scanned from its start again, so it has to double before the next attempt
+			if len(f.buffer) < f.detectAt {
+				return nil
+			}
+			framing, offset := detectFraming(f.buffer)
+			f.searched += offset
+			f.consume(offset)
+			if framing == framingUnknown {
+				if f.searched+len(f.buffer) > maxFramingSearch {
+					f.framing = framingNone
+				}
+				f.detectAt = 2 * len(f.buffer)
+				return nil
+			}
+			f.framing, f.detectAt = framing, 0
+		}
+
+		var frame []byte
+		var size int
+		var err error
+		switch f.framing {
+		case framingRfc4571:
+			frame, size, err = rfc4571Frame(f.buffer)
+		case framingInterleaved:
+			frame, size, err = interleavedFrame(f.buffer)
+		default:
+			return nil
+		}
+		if err != nil {
+			log.Sdebug("invalid %s framing on TCP, searching next frame: %s", f.framing, err)
+			f.framing = framingUnknown
+			f.consume(1)
+			f.searched++
+			continue
+		}
+		if size == 0 {
+			return nil
+		}
+		if frame != nil {
+			frame = append([]byte(nil), frame...)
+		}
+		f.consume(size)
+		if frame != nil {
+			f.searched = 0
+			return frame
+		}
+	}
+	return nil
+}
+
+// nextSipMessage returns a copy of the next complete SIP message in the buffer, nil if more data is needed,
+// lines before a start line, e.g. keepalives or the rest of a message captured partially, are skipped
+func (f *tcpFlow) nextSipMessage() []byte {
+	for len(f.buffer) > 0 {
+		if isSipMessage(f.buffer) {
+			size, err := sipMessageSize(f.buffer)
+			if err == nil {
+				if size == 0 {
+					return nil
+				}
+				message := append([]byte(nil), f.buffer[:size]...)
+				f.consume(size)
+				return message
+			}
+			log.Sdebug("invalid SIP message on TCP, searching next one: %s", err)
+		}
+		end := bytes.Index(f.buffer, []byte("\r\n"))
+		if end < 0 {
+			return nil
+		}
+		f.consume(end + 2)
+	}
+	return nil
+}
+
+// isMediaHeader returns true if data may start an RTP or RTCP packet
+func isMediaHeader(data []byte) bool {
+	return len(data) > 0 && data[0]>>6 == 2
+}
+
+func isRtspMessage(data []byte) bool {
+	for _, method := range rtspMethods {
+		n := len(method)
+		if len(data) < n {
+			n = len(data)
+		}
+		if n > 0 && string(data[:n]) == method[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFraming searches data for the first position a frame can start at, returns framing found there,
+// unknown with position of the first possible frame if more data is needed, a frame followed by another
+// one is preferred to an incomplete one, whose length may be just payload of a frame captured partially
+func detectFraming(data []byte) (tcpFraming, int) {
+	incomplete := len(data)
+	for i := 0; i < len(data); i++ {
+		if data[i] == '$' || isRtspMessage(data[i:]) {
+			switch _, size, err := interleavedFrame(data[i:]); {
+			case err != nil:
+			case size == 0:
+				if i < incomplete {
+					incomplete = i
+				}
+			case data[i] != '$' || i+size == len(data) || data[i+size] == '$' || isRtspMessage(data[i+size:]):
+				return framingInterleaved, i
+			}
+		}
+		switch _, size, err := rfc4571Frame(data[i:]); {
+		case err != nil:
+		case size == 0, i+size < len(data) && i+size+2 >= len(data):
+			if i < incomplete {
+				incomplete = i
+			}
+		case i+size == len(data), isMediaHeader(data[i+size+2:]):
+			return framingRfc4571, i
+		}
+	}
+	return framingUnknown, incomplete
+}
+
+// rfc4571Frame returns frame at the start of data and bytes it takes, size is 0 if incomplete
+func rfc4571Frame(data []byte) ([]byte, int, error) {
+	if len(data) < 3 {
+		return nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if length < 8 || !isMediaHeader(data[2:]) {
+		return nil, 0, errors.New("not an RTP or RTCP frame")
+	}
+	if len(data) < 2+length {
+		return nil, 0, nil
+	}
+	return data[2 : 2+length], 2 + length, nil
+}
+
+// interleavedFrame returns '$' frame at the start of data and bytes it takes, an RTSP message is
+// skipped with nil frame, size is 0 if incomplete
+func interleavedFrame(data []byte) ([]byte, int, error) {
+	if len(data) > 0 && data[0] != '$' {
+		size, err := rtspMessageSize(data)
+		return nil, size, err
+	}
+	if len(data) < 5 {
+		return nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < 8 || !isMediaHeader(data[4:]) {
+		return nil, 0, errors.New("not an RTP or RTCP frame")
+	}
+	if len(data) < 4+length {
+		return nil, 0, nil
+	}
+	return data[4 : 4+length], 4 + length, nil
+}
+
+// rtspMessageSize returns size of RTSP message with its body, 0 if incomplete
+func rtspMessageSize(data []byte) (int, error) {
+	if !isRtspMessage(data) {
+		return 0, errors.New("not an RTSP message")
+	}
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0, nil
+	}
+	size := end + 4
+	for _, line := range strings.Split(string(data[:end]), "\r\n") {
+		name := strings.SplitN(line, ":", 2)
+		if len(name) == 2 && strings.EqualFold(strings.TrimSpace(name[0]), "Content-Length") {
+			length, err := strconv.Atoi(strings.TrimSpace(name[1]))
+			if err != nil || length < 0 {
+				return 0, errors.New("invalid RTSP Content-Length")
+			}
+			size += length
+		}
+	}
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
@@ -0,0 +1,186 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func rfc4571(packet []byte) []byte {
+	frame := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	return append(frame, packet...)
+}
+
+func interleaved(channel byte, packet []byte) []byte {
+	frame := []byte{'$', channel, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+	return append(frame, packet...)
+}
+
+// split cuts data at the given offsets
+func split(data []byte, offsets ...int) [][]byte {
+	var segments [][]byte
+	start := 0
+	for _, offset := range offsets {
+		segments = append(segments, data[start:offset])
+		start = offset
+	}
+	return append(segments, data[start:])
+}
+
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// bytewise splits data into segments of a byte
+func bytewise(data []byte) [][]byte {
+	var segments [][]byte
+	for i := range data {
+		segments = append(segments, data[i:i+1])
+	}
+	return segments
+}
+
+// inOrder numbers segments from seq
+func inOrder(seq uint32, segments [][]byte) []tcpSegment {
+	var numbered []tcpSegment
+	for _, data := range segments {
+		numbered = append(numbered, tcpSegment{seq, data})
+		seq += uint32(len(data))
+	}
+	return numbered
+}
+
+func TestTcpFrames(t *testing.T) {
+	p1 := rtpBytes(0, 1, 160, 0x1111, bytes.Repeat([]byte{0xD5}, 20))
+	p2 := rtpBytes(0, 2, 320, 0x1111, bytes.Repeat([]byte{0xD5}, 20))
+	p3 := rtpBytes(0, 3, 480, 0x1111, bytes.Repeat([]byte{0xD5}, 20))
+	rfcStream := compound(rfc4571(p1), rfc4571(p2), rfc4571(p3))
+	rtsp := []byte("RTSP/1.0 200 OK\r\nCSeq: 4\r\nContent-Length: 4\r\n\r\nbody")
+	rtspStream := compound(interleaved(0, p1), rtsp, interleaved(0, p2), interleaved(1, senderReport(0x1111, 0, 2, 40)), interleaved(0, p3))
+	reordered := inOrder(1000, split(rfcStream, 10, 40, 70))
+	reordered[1], reordered[2] = reordered[2], reordered[1]
+	retransmitted := inOrder(1000, split(rfcStream, 30, 60))
+	// overlaps both the segment before and the one after it
+	retransmitted = append(retransmitted[:1], tcpSegment{1020, rfcStream[20:50]}, retransmitted[1], retransmitted[2])
+
+	tests := []struct {
+		name     string
+		segments []tcpSegment
+		framing  tcpFraming
+		frames   [][]byte
+	}{
+		{"rfc4571", inOrder(1000, [][]byte{rfcStream}), framingRfc4571, [][]byte{p1, p2, p3}},
+		{"rfc4571 split in length", inOrder(1000, split(rfcStream, 1, 35, 37)), framingRfc4571, [][]byte{p1, p2, p3}},
+		{"rfc4571 split in packets", inOrder(1000, split(rfcStream, 5, 20, 40, 80)), framingRfc4571, [][]byte{p1, p2, p3}},
+		{"rfc4571 from the middle", inOrder(1000, [][]byte{rfcStream[20:]}), framingRfc4571, [][]byte{p2, p3}},
+		{"rfc4571 out of order", reordered, framingRfc4571, [][]byte{p1, p2, p3}},
+		{"rfc4571 retransmitted", retransmitted, framingRfc4571, [][]byte{p1, p2, p3}},
+		{"interleaved", inOrder(1000, [][]byte{rtspStream}), framingInterleaved,
+			[][]byte{p1, p2, senderReport(0x1111, 0, 2, 40), p3}},
+		{"interleaved split", inOrder(1000, split(rtspStream, 2, 36, 50, 90, len(rtspStream)-1)), framingInterleaved,
+			[][]byte{p1, p2, senderReport(0x1111, 0, 2, 40), p3}},
+		{"rtsp first", inOrder(1000, split(compound(rtsp, rtspStream), 10)), framingInterleaved,
+			[][]byte{p1, p2, senderReport(0x1111, 0, 2, 40), p3}},
+		{"rfc4571 byte by byte", inOrder(1000, bytewise(rfcStream)), framingRfc4571, [][]byte{p1, p2, p3}},
+		{"interleaved byte by byte", inOrder(1000, bytewise(rtspStream)), framingInterleaved,
+			[][]byte{p1, p2, senderReport(0x1111, 0, 2, 40), p3}},
+		{"no framing", inOrder(1000, [][]byte{bytes.Repeat([]byte{0}, maxFramingSearch+1)}), framingNone, nil},
+		// every byte starts a frame longer than the search, detection doesn't scan them again for every segment
+		{"incomplete frames byte by byte", inOrder(1000, bytewise(bytes.Repeat([]byte{0x80}, 2*maxFramingSearch))), framingNone, nil},
+	}
+	for _, tt := range tests {
+		f := &tcpFlow{nextSeq: tt.segments[0].seq}
+		var frames [][]byte
+		for _, s := range tt.segments {
+			f.add(s.seq, s.data)
+			for frame := f.nextFrame(); frame != nil; frame = f.nextFrame() {
+				frames = append(frames, frame)
+			}
+		}
+		if f.framing != tt.framing {
+			t.Errorf("%s: got framing %d, want %d", tt.name, f.framing, tt.framing)
+		}
+		if len(frames) != len(tt.frames) {
+			t.Errorf("%s: got %d frames, want %d", tt.name, len(frames), len(tt.frames))
+			continue
+		}
+		for i := range frames {
+			if !bytes.Equal(frames[i], tt.frames[i]) {
+				t.Errorf("%s: frame %d: got %x, want %x", tt.name, i, frames[i], tt.frames[i])
+			}
+		}
+	}
+}
+
+// sendTCP decodes segments of a direction, the last one with FIN if fin is set
+func sendTCP(r *RtpReader, srcPort, dstPort layers.TCPPort, segments []tcpSegment, fin bool) {
+	for i, s := range segments {
+		tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: s.seq}
+		tcp.Payload = s.data
+		tcp.FIN = fin && i == len(segments)-1
+		r.decodeTCPLayer(&packetInfo{receivedAt: testStart}, "192.0.2.1", "192.0.2.2", tcp)
+	}
+}
+
+// RTP received over TCP is decoded like a datagram, the stream tells the framing
+func TestReassembleTCP(t *testing.T) {
+	r := newTestReader()
+	var data []byte
+	for seq := uint16(1); seq <= 3; seq++ {
+		data = append(data, rfc4571(rtpBytes(0, seq, uint32(seq)*160, 0x1111, make([]byte, 160)))...)
+	}
+	sendTCP(r, 40000, 5004, inOrder(1000, split(data, 100, 300)), true)
+	if len(r.rtpStreamsSorted) != 1 {
+		t.Fatalf("got %d streams, want 1", len(r.rtpStreamsSorted))
+	}
+	if s := r.rtpStreamsSorted[0]; s.TotalPackets != 3 || s.Framing != "rfc4571" {
+		t.Errorf("got %d packets with framing %q, want 3 with rfc4571", s.TotalPackets, s.Framing)
+	}
+	if len(r.tcpFlows) != 0 {
+		t.Errorf("got %d flows after FIN, want 0", len(r.tcpFlows))
+	}
+}
+
+// only directions on media ports, RTSP and SIP connections are reassembled
+func TestTcpPortFilter(t *testing.T) {
+	var media, interleavedMedia []byte
+	for seq := uint16(1); seq <= 3; seq++ {
+		packet := rtpBytes(0, seq, uint32(seq)*160, 0x1111, make([]byte, 160))
+		media = append(media, rfc4571(packet)...)
+		interleavedMedia = append(interleavedMedia, interleaved(0, packet)...)
+	}
+	invite := []byte("INVITE sip:bob@192.0.2.2 SIP/2.0\r\nCall-ID: a\r\nContent-Length: 10\r\n\r\n")
+	tests := []struct {
+		name    string
+		dstPort layers.TCPPort
+		data    []byte
+		deny    bool
+		streams int
+		flows   int
+	}{
+		{"media port", 10002, media, false, 1, 1},
+		{"other port", 5004, media, false, 0, 0},
+		{"rtsp", RtspPort, interleavedMedia, false, 1, 1},
+		{"rtsp denied", RtspPort, interleavedMedia, true, 0, 0},
+		{"sip", SipPort, invite, false, 0, 1},
+		{"sip on other port", 5080, invite, false, 0, 1},
+	}
+	for _, tt := range tests {
+		r := newTestReader()
+		r.SetMinSequential(1)
+		var deny []PortRange
+		if tt.deny {
+			deny = []PortRange{{RtspPort, RtspPort}}
+		}
+		r.SetPortFilter([]PortRange{{10000, 20000}}, deny)
+		sendTCP(r, 40000, tt.dstPort, inOrder(1000, [][]byte{tt.data}), false)
+		if len(r.rtpStreamsSorted) != tt.streams || len(r.tcpFlows) != tt.flows {
+			t.Errorf("%s: got %d streams and %d flows, want %d and %d", tt.name, len(r.rtpStreamsSorted), len(r.tcpFlows), tt.streams, tt.flows)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package srtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// key derivation labels, RFC 3711 section 4.3.1
+const (
+	labelRtpEncryption  = 0x00
+	labelRtpAuth        = 0x01
+	labelRtpSalt        = 0x02
+	labelRtcpEncryption = 0x03
+	labelRtcpAuth       = 0x04
+	labelRtcpSalt       = 0x05
+)
+
+const hmacSha1KeyLen = 20
+
+//Suite describes SRTP crypto suite from RFC 4568, RFC 6188 and RFC 7714
+type Suite struct {
+	Name       string
+	keyLen     int
+	saltLen    int
+	rtpTagLen  int
+	rtcpTagLen int
+	aead       bool
+}
+
+var suites = []*Suite{
+	{Name: "AES_CM_128_HMAC_SHA1_80", keyLen: 16, saltLen: 14, rtpTagLen: 10, rtcpTagLen: 10},
+	{Name: "AES_CM_128_HMAC_SHA1_32", keyLen: 16, saltLen: 14, rtpTagLen: 4, rtcpTagLen: 10},
+	{Name: "AES_256_CM_HMAC_SHA1_80", keyLen: 32, saltLen: 14, rtpTagLen: 10, rtcpTagLen: 10},
+	{Name: "AES_256_CM_HMAC_SHA1_32", keyLen: 32, saltLen: 14, rtpTagLen: 4, rtcpTagLen: 10},
+	{Name: "AEAD_AES_128_GCM", keyLen: 16, saltLen: 12, rtpTagLen: 16, rtcpTagLen: 16, aead: true},
+	{Name: "AEAD_AES_256_GCM", keyLen: 32, saltLen: 12, rtpTagLen: 16, rtcpTagLen: 16, aead: true},
+}
+
+func findSuite(name string) *Suite {
+	for _, s := range suites {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// sessionKeys are derived from master key for one direction, key derivation rate is assumed 0
+type sessionKeys struct {
+	suite   *Suite
+	rtpEnc  cipher.Block
+	rtpAead cipher.AEAD
+	rtpAuth []byte
+	rtpSalt []byte
+
+	rtcpEnc  cipher.Block
+	rtcpAead cipher.AEAD
+	rtcpAuth []byte
+	rtcpSalt []byte
+}
+
+// deriveKey implements AES-CM PRF, RFC 3711 section 4.3.3, shorter GCM salt is zero padded as libsrtp does
+func deriveKey(masterKey, masterSalt []byte, label byte, length int) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+
+	out := make([]byte, (length+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	for i := 0; i < len(out); i += aes.BlockSize {
+		binary.BigEndian.PutUint16(iv[14:], uint16(i/aes.BlockSize))
+		block.Encrypt(out[i:i+aes.BlockSize], iv)
+	}
+	return out[:length], nil
+}
+
+func newSessionKeys(suite *Suite, masterKey, masterSalt []byte) (*sessionKeys, error) {
+	keys := &sessionKeys{suite: suite}
+
+	derive := func(encLabel, authLabel, saltLabel byte) (cipher.Block, cipher.AEAD, []byte, []byte, error) {
+		encKey, err := deriveKey(masterKey, masterSalt, encLabel, suite.keyLen)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		salt, err := deriveKey(masterKey, masterSalt, saltLabel, suite.saltLen)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		block, err := aes.NewCipher(encKey)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if suite.aead {
+			aead, err := cipher.NewGCMWithTagSize(block, suite.rtpTagLen)
+			return nil, aead, nil, salt, err
+		}
+		authKey, err := deriveKey(masterKey, masterSalt, authLabel, hmacSha1KeyLen)
+		return block, nil, authKey, salt, err
+	}
+
+	var err error
+	keys.rtpEnc, keys.rtpAead, keys.rtpAuth, keys.rtpSalt, err = derive(labelRtpEncryption, labelRtpAuth, labelRtpSalt)
+	if err != nil {
+		return nil, err
+	}
+	keys.rtcpEnc, keys.rtcpAead, keys.rtcpAuth, keys.rtcpSalt, err = derive(labelRtcpEncryption, labelRtcpAuth, labelRtcpSalt)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// counter mode IV, RFC 3711 section 4.1.1
+func counterIV(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var ssrcBytes [4]byte
+	binary.BigEndian.PutUint32(ssrcBytes[:], ssrc)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= ssrcBytes[i]
+	}
+	for i := 0; i < 6; i++ {
+		iv[13-i] ^= byte(index >> (8 * uint(i)))
+	}
+	return iv
+}
+
+// GCM nonce, RFC 7714 sections 8.1 and 9.1, index is ROC||SEQ for SRTP and 0x0000||SRTCP index for SRTCP
+func gcmNonce(salt []byte, ssrc uint32, index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[2:6], ssrc)
+	for i := 0; i < 6; i++ {
+		nonce[11-i] = byte(index >> (8 * uint(i)))
+	}
+	for i := range nonce {
+		nonce[i] ^= salt[i]
+	}
+	return nonce
+}
+
+func hmacTag(key []byte, tagLen int, data ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)[:tagLen]
+}
+
+var errAuthentication = errors.New("srtp authentication failed")
+
+// decryptRTP authenticates and decrypts packet with given index, returning plain rtp packet
+func (k *sessionKeys) decryptRTP(packet []byte, headerLen int, mkiLen int, ssrc uint32, index uint64) ([]byte, error) {
+	tagLen := k.suite.rtpTagLen
+	if len(packet) < headerLen+mkiLen+tagLen {
+		return nil, errors.New("srtp packet too short")
+	}
+	if k.suite.aead {
+		// tag is part of the cipher text, MKI follows it (RFC 7714 section 8)
+		nonce := gcmNonce(k.rtpSalt, ssrc, index)
+		plain, err := k.rtpAead.Open(nil, nonce, packet[headerLen:len(packet)-mkiLen], packet[:headerLen])
+		if err != nil {
+			return nil, errAuthentication
+		}
+		return append(append([]byte(nil), packet[:headerLen]...), plain...), nil
+	}
+
+	roc := uint32(index >> 16)
+	authenticated := packet[:len(packet)-mkiLen-tagLen]
+	var rocBytes [4]byte
+	binary.BigEndian.PutUint32(rocBytes[:], roc)
+	expected := hmacTag(k.rtpAuth, tagLen, authenticated, rocBytes[:])
+	if subtle.ConstantTimeCompare(expected, packet[len(packet)-tagLen:]) != 1 {
+		return nil, errAuthentication
+	}
+
+	out := append([]byte(nil), authenticated...)
+	stream := cipher.NewCTR(k.rtpEnc, counterIV(k.rtpSalt, ssrc, index))
+	stream.XORKeyStream(out[headerLen:], out[headerLen:])
+	return out, nil
+}
+
+// decryptRTCP authenticates and decrypts compound packet, RFC 3711 section 3.4 and RFC 7714 section 9
+func (k *sessionKeys) decryptRTCP(packet []byte, mkiLen int) ([]byte, error) {
+	tagLen := k.suite.rtcpTagLen
+	if len(packet) < 8+4+mkiLen+tagLen {
+		return nil, errors.New("srtcp packet too short")
+	}
+	ssrc := binary.BigEndian.Uint32(packet[4:8])
+
+	if k.suite.aead {
+		// cipher text with tag, E flag with index and MKI (RFC 7714 section 9)
+		trailer := len(packet) - mkiLen - 4
+		eIndex := binary.BigEndian.Uint32(packet[trailer : trailer+4])
+		nonce := gcmNonce(k.rtcpSalt, ssrc, uint64(eIndex&0x7FFFFFFF))
+		if eIndex&0x80000000 == 0 { // authenticated only, whole packet is associated data
+			tagStart := trailer - tagLen
+			aad := append(append([]byte(nil), packet[:tagStart]...), packet[trailer:trailer+4]...)
+			if _, err := k.rtcpAead.Open(nil, nonce, packet[tagStart:trailer], aad); err != nil {
+				return nil, errAuthentication
+			}
+			return append([]byte(nil), packet[:tagStart]...), nil
+		}
+		aad := append(append([]byte(nil), packet[:8]...), packet[trailer:trailer+4]...)
+		plain, err := k.rtcpAead.Open(nil, nonce, packet[8:trailer], aad)
+		if err != nil {
+			return nil, errAuthentication
+		}
+		return append(append([]byte(nil), packet[:8]...), plain...), nil
+	}
+
+	// E flag with index, MKI and tag (RFC 3711 section 3.4)
+	trailer := len(packet) - tagLen - mkiLen - 4
+	eIndex := binary.BigEndian.Uint32(packet[trailer : trailer+4])
+	encrypted := eIndex&0x80000000 != 0
+	index := eIndex & 0x7FFFFFFF
+
+	expected := hmacTag(k.rtcpAuth, tagLen, packet[:trailer+4])
+	if subtle.ConstantTimeCompare(expected, packet[len(packet)-tagLen:]) != 1 {
+		return nil, errAuthentication
+	}
+	out := append([]byte(nil), packet[:trailer]...)
+	if encrypted {
+		stream := cipher.NewCTR(k.rtcpEnc, counterIV(k.rtcpSalt, ssrc, uint64(index)))
+		stream.XORKeyStream(out[8:], out[8:])
+	}
+	return out, nil
+}
@@ -0,0 +1,402 @@
+package srtp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/david-biro/rtpdump/log"
+)
+
+// initial roll-over counters tried when a capture starts in the middle of a long stream
+const maxRocGuess = 64
+
+// packets of a stream tried against every key and roll-over counter before giving up on it,
+// the search starts again when new keys for the stream are registered
+const maxRocSearches = 16
+
+//MasterKey is SRTP master key and salt with its crypto suite
+type MasterKey struct {
+	suite  *Suite
+	key    []byte
+	salt   []byte
+	mkiLen int
+	keys   *sessionKeys
+}
+
+//Context keeps SRTP state of a single stream
+type Context struct {
+	Ssrc          uint32
+	Src, Dst      string
+	Authenticated uint
+	AuthFailures  uint
+
+	candidates []*MasterKey
+	key        *MasterKey
+	roc        uint32
+	highestSeq uint16
+	searches   int
+
+	srcIP, dstIP     string
+	srcPort, dstPort uint
+}
+
+type contextKey struct {
+	ssrc     uint32
+	src, dst string
+}
+
+// keys by selector: "ssrc:<hex>", "src:<addr>" or "flow:<src addr>-<dst addr>"
+var keyList = make(map[string][]*MasterKey)
+var contexts = make(map[contextKey]*Context)
+var contextsSorted []*Context
+
+func ssrcSelector(ssrc uint32) string {
+	return fmt.Sprintf("ssrc:%08x", ssrc)
+}
+
+func addrSelector(ip string, port uint) string {
+	return "src:" + net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+func flowSelector(srcIP string, srcPort uint, dstIP string, dstPort uint) string {
+	return "flow:" + net.JoinHostPort(srcIP, strconv.Itoa(int(srcPort))) + "-" + net.JoinHostPort(dstIP, strconv.Itoa(int(dstPort)))
+}
+
+// normalizeAddr parses "ip:port" or "[ipv6]:port"
+func normalizeAddr(s string) (string, uint, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", 0, errors.New("invalid ip address " + host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return ip.String(), uint(port), nil
+}
+
+func parseSelector(s string) (string, error) {
+	if strings.HasPrefix(s, "0x") {
+		ssrc, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+		if err != nil {
+			return "", err
+		}
+		return ssrcSelector(uint32(ssrc)), nil
+	}
+	if i := strings.Index(s, "-"); i > 0 {
+		srcIP, srcPort, err := normalizeAddr(s[:i])
+		if err != nil {
+			return "", err
+		}
+		dstIP, dstPort, err := normalizeAddr(s[i+1:])
+		if err != nil {
+			return "", err
+		}
+		return flowSelector(srcIP, srcPort, dstIP, dstPort), nil
+	}
+	ip, port, err := normalizeAddr(s)
+	if err != nil {
+		return "", err
+	}
+	return addrSelector(ip, port), nil
+}
+
+// parseKeyParams parses "inline:<base64>[|lifetime][|MKI:length]", "0x<hex>" or plain base64 master key and salt
+func parseKeyParams(suite *Suite, params string) (*MasterKey, error) {
+	mkiLen := 0
+	var keySalt []byte
+	var err error
+	if strings.HasPrefix(params, "0x") {
+		keySalt, err = hex.DecodeString(strings.TrimPrefix(params, "0x"))
+	} else {
+		parts := strings.Split(strings.TrimPrefix(params, "inline:"), "|")
+		for _, part := range parts[1:] {
+			if i := strings.Index(part, ":"); i > 0 { // MKI value:length, lifetime has no colon
+				if mkiLen, err = strconv.Atoi(part[i+1:]); err != nil {
+					return nil, errors.New("invalid MKI length")
+				}
+			}
+		}
+		keySalt, err = base64.StdEncoding.DecodeString(parts[0])
+		if err != nil { // some implementations omit base64 padding
+			keySalt, err = base64.RawStdEncoding.DecodeString(parts[0])
+		}
+	}
+	if err != nil {
+		return nil, errors.New("invalid key encoding")
+	}
+	if len(keySalt) != suite.keyLen+suite.saltLen {
+		return nil, fmt.Errorf("%s requires %d bytes of key and salt, got %d", suite.Name, suite.keyLen+suite.saltLen, len(keySalt))
+	}
+
+	key := &MasterKey{
+		suite:  suite,
+		key:    keySalt[:suite.keyLen],
+		salt:   keySalt[suite.keyLen:],
+		mkiLen: mkiLen,
+	}
+	if key.keys, err = newSessionKeys(suite, key.key, key.salt); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func addKey(selector string, key *MasterKey) {
+	for _, k := range keyList[selector] {
+		if k.suite == key.suite && string(k.key) == string(key.key) && string(k.salt) == string(key.salt) {
+			return
+		}
+	}
+	keyList[selector] = append(keyList[selector], key)
+}
+
+//LoadKeyFile load key file, one key per line: [ssrc | src-ip:port | src-ip:port-dst-ip:port] [crypto suite] [key]
+func LoadKeyFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		selector, err := parseSelector(fields[0])
+		if err != nil {
+			log.Sdebug("srtp key file: invalid selector %s: %s", fields[0], err)
+			continue
+		}
+		suite := findSuite(fields[1])
+		if suite == nil {
+			log.Serror("srtp crypto suite %s not supported", fields[1])
+			continue
+		}
+		key, err := parseKeyParams(suite, fields[2])
+		if err != nil {
+			log.Serror("srtp key file: %s", err)
+			continue
+		}
+		addKey(selector, key)
+	}
+	return nil
+}
+
+//AddCryptoAttribute registers keys of SDP "a=crypto:" attribute value (RFC 4568) for media sent from ip and port
+func AddCryptoAttribute(ip string, port uint, attribute string) error {
+	fields := strings.Fields(attribute)
+	if len(fields) < 3 {
+		return errors.New("invalid crypto attribute")
+	}
+	suite := findSuite(fields[1])
+	if suite == nil {
+		return errors.New("srtp crypto suite " + fields[1] + " not supported")
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	for _, params := range strings.Split(fields[2], ";") {
+		key, err := parseKeyParams(suite, params)
+		if err != nil {
+			return err
+		}
+		log.Sdebug("srtp key %s for media from %s:%d", suite.Name, ip, port)
+		addKey(addrSelector(ip, port), key)
+	}
+	invalidateContexts(ip, port)
+	return nil
+}
+
+// invalidateContexts makes streams sent from ip and port that have no verified key yet try the keys registered since their first packet
+func invalidateContexts(ip string, port uint) {
+	for _, c := range contextsSorted {
+		if c.key == nil && c.srcIP == ip && c.srcPort == port {
+			c.candidates = candidateKeys(c.Ssrc, c.srcIP, c.srcPort, c.dstIP, c.dstPort)
+			c.searches = 0
+		}
+	}
+}
+
+func candidateKeys(ssrc uint32, srcIP string, srcPort uint, dstIP string, dstPort uint) []*MasterKey {
+	var candidates []*MasterKey
+	candidates = append(candidates, keyList[flowSelector(srcIP, srcPort, dstIP, dstPort)]...)
+	candidates = append(candidates, keyList[addrSelector(srcIP, srcPort)]...)
+	candidates = append(candidates, keyList[ssrcSelector(ssrc)]...)
+	return candidates
+}
+
+//HasKeys returns true if any key was loaded or harvested
+func HasKeys() bool {
+	return len(keyList) > 0
+}
+
+//Lookup returns SRTP context of a stream, nil if no key matches it
+func Lookup(ssrc uint32, srcIP string, srcPort uint, dstIP string, dstPort uint) *Context {
+	if len(keyList) == 0 {
+		return nil
+	}
+	src := net.JoinHostPort(srcIP, strconv.Itoa(int(srcPort)))
+	dst := net.JoinHostPort(dstIP, strconv.Itoa(int(dstPort)))
+	k := contextKey{ssrc: ssrc, src: src, dst: dst}
+	if c, ok := contexts[k]; ok {
+		return c
+	}
+
+	candidates := candidateKeys(ssrc, srcIP, srcPort, dstIP, dstPort)
+	if len(candidates) == 0 {
+		return nil
+	}
+	c := &Context{Ssrc: ssrc, Src: src, Dst: dst, candidates: candidates,
+		srcIP: srcIP, srcPort: srcPort, dstIP: dstIP, dstPort: dstPort}
+	contexts[k] = c
+	contextsSorted = append(contextsSorted, c)
+	return c
+}
+
+//LookupRTCP returns SRTP context of the stream RTCP belongs to, on the same port with rtcp-mux or the next one
+func LookupRTCP(ssrc uint32, srcIP string, srcPort uint, dstIP string, dstPort uint) *Context {
+	if c := Lookup(ssrc, srcIP, srcPort, dstIP, dstPort); c != nil {
+		return c
+	}
+	if srcPort > 0 && dstPort > 0 {
+		return Lookup(ssrc, srcIP, srcPort-1, dstIP, dstPort-1)
+	}
+	return nil
+}
+
+//ResetContexts drops the state of every stream, so a capture can be read again from the start
+func ResetContexts() {
+	contexts = make(map[contextKey]*Context)
+	contextsSorted = nil
+}
+
+//Contexts returns SRTP contexts in order of appearance
+func Contexts() []*Context {
+	return contextsSorted
+}
+
+//Suite returns name of the crypto suite once a key was verified
+func (c *Context) Suite() string {
+	if c.key == nil {
+		return "unknown"
+	}
+	return c.key.suite.Name
+}
+
+func (c Context) String() string {
+	return fmt.Sprintf("0x%08X %s -> %s %s roc:%d authenticated:%d failed:%d",
+		c.Ssrc, c.Src, c.Dst, c.Suite(), c.roc, c.Authenticated, c.AuthFailures)
+}
+
+func rtpHeaderLen(packet []byte) (int, error) {
+	if len(packet) < 12 {
+		return 0, errors.New("RTP header should contain at least 12 octets")
+	}
+	headerLen := 12 + 4*int(packet[0]&0x0F)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < headerLen+4 {
+			return 0, errors.New("not enough octets for RTP extension header")
+		}
+		headerLen += 4 + 4*int(binary.BigEndian.Uint16(packet[headerLen+2:headerLen+4]))
+	}
+	if len(packet) < headerLen {
+		return 0, errors.New("not enough octets for RTP header")
+	}
+	return headerLen, nil
+}
+
+// estimateIndex guesses packet index from roll-over counter and highest sequence number, RFC 3711 section 3.3.1
+func (c *Context) estimateIndex(seq uint16) uint32 {
+	v := c.roc
+	if c.highestSeq < 32768 {
+		if int(seq)-int(c.highestSeq) > 32768 && v > 0 {
+			v--
+		}
+	} else if int(c.highestSeq)-32768 > int(seq) {
+		v++
+	}
+	return v
+}
+
+//DecryptRTP verifies authentication tag and returns decrypted rtp packet
+func (c *Context) DecryptRTP(packet []byte) ([]byte, error) {
+	headerLen, err := rtpHeaderLen(packet)
+	if err != nil {
+		return nil, err
+	}
+	seq := binary.BigEndian.Uint16(packet[2:4])
+
+	if c.key == nil { // find the key and initial roll-over counter that authenticate the packet
+		if c.searches >= maxRocSearches {
+			c.AuthFailures++
+			return nil, errAuthentication
+		}
+		c.searches++
+		for _, key := range c.candidates {
+			for roc := uint32(0); roc < maxRocGuess; roc++ {
+				plain, err := key.keys.decryptRTP(packet, headerLen, key.mkiLen, c.Ssrc, uint64(roc)<<16|uint64(seq))
+				if err != nil {
+					if err != errAuthentication {
+						return nil, err
+					}
+					continue
+				}
+				log.Sdebug("srtp stream 0x%08X uses %s, initial roc %d", c.Ssrc, key.suite.Name, roc)
+				c.key, c.roc, c.highestSeq = key, roc, seq
+				c.Authenticated++
+				return plain, nil
+			}
+		}
+		c.AuthFailures++
+		return nil, errAuthentication
+	}
+
+	v := c.estimateIndex(seq)
+	plain, err := c.key.keys.decryptRTP(packet, headerLen, c.key.mkiLen, c.Ssrc, uint64(v)<<16|uint64(seq))
+	if err != nil {
+		if err == errAuthentication {
+			c.AuthFailures++
+			log.Sdebug("srtp authentication failed for 0x%08X seq %d", c.Ssrc, seq)
+		}
+		return nil, err
+	}
+	c.Authenticated++
+	if v > c.roc {
+		c.roc, c.highestSeq = v, seq
+	} else if v == c.roc && seq > c.highestSeq {
+		c.highestSeq = seq
+	}
+	return plain, nil
+}
+
+//DecryptRTCP verifies authentication tag and returns decrypted compound rtcp packet
+func (c *Context) DecryptRTCP(packet []byte) ([]byte, error) {
+	keys := c.candidates
+	if c.key != nil {
+		keys = []*MasterKey{c.key}
+	}
+	for _, key := range keys {
+		plain, err := key.keys.decryptRTCP(packet, key.mkiLen)
+		if err == nil {
+			return plain, nil
+		}
+		if err != errAuthentication {
+			return nil, err
+		}
+	}
+	return nil, errAuthentication
+}
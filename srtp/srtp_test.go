@@ -0,0 +1,295 @@
+package srtp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
+
+// RFC 3711 appendix B.3
+const (
+	b3MasterKey  = "E1F97A0D3E018BE0D64FA32C06DE4139"
+	b3MasterSalt = "0EC675AD498AFEEBB6960B3AABE6"
+)
+
+func TestDeriveKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		label  byte
+		length int
+		want   string
+	}{
+		{"cipher key", labelRtpEncryption, 16, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{"cipher salt", labelRtpSalt, 14, "30CBBC08863D8C85D49DB34A9AE1"},
+		{"auth key", labelRtpAuth, 20, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+	}
+	for _, tt := range tests {
+		got, err := deriveKey(unhex(t, b3MasterKey), unhex(t, b3MasterSalt), tt.label, tt.length)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %X, want %X", tt.name, got, want)
+		}
+	}
+}
+
+// RFC 3711 appendix B.2, keystream segments of session key and salt for ssrc 0 and index 0
+func TestCounterKeystream(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "2B7E151628AED2A6ABF7158809CF4F3C"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := counterIV(unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD"), 0, 0)
+	if want := unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD0000"); !bytes.Equal(iv, want) {
+		t.Fatalf("iv: got %X, want %X", iv, want)
+	}
+	keystream := make([]byte, 3*aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(keystream, keystream)
+	want := unhex(t, "E03EAD0935C95E80E166B16DD92B4EB4"+
+		"D23513162B02D0F72A43A2FE4A5F97AB"+
+		"41E95B3BB0A2E8DD477901E4FCA894C0")
+	if !bytes.Equal(keystream, want) {
+		t.Errorf("keystream: got %X, want %X", keystream, want)
+	}
+}
+
+func TestCounterIV(t *testing.T) {
+	tests := []struct {
+		salt  string
+		ssrc  uint32
+		index uint64
+		want  string
+	}{
+		{"0000000000000000000000000000", 0, 0, "00000000000000000000000000000000"},
+		{"0000000000000000000000000000", 0xDECAFBAD, 0x1234, "00000000DECAFBAD0000000012340000"},
+		{"0000000000000000000000000000", 0, 0x0001FFFF, "000000000000000000000001FFFF0000"},
+		{"F0F1F2F3F4F5F6F7F8F9FAFBFCFD", 0x01020304, 0x0000000A0001, "F0F1F2F3F5F7F5F3F8F9FAF1FCFC0000"},
+	}
+	for _, tt := range tests {
+		got := counterIV(unhex(t, tt.salt), tt.ssrc, tt.index)
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("ssrc %08X index %X: got %X, want %X", tt.ssrc, tt.index, got, want)
+		}
+	}
+}
+
+// RFC 7714 section 16.1
+const (
+	gcmKey    = "000102030405060708090a0b0c0d0e0f"
+	gcmSalt   = "517569642070726f2071756f"
+	gcmHeader = "8040f17b8041f8d35501a0b2"
+	gcmPlain  = "47616c6c696120657374206f6d6e69732064697669736120696e207061727465732074726573"
+	gcmSealed = "f24de3a3fb34de6cacba861c9d7e4bcabe633bd50d294e6f42a5f47a51c7d19b36de3adf8833899d7f27beb16a9152cf765ee4390cce"
+)
+
+func TestGcmNonce(t *testing.T) {
+	tests := []struct {
+		ssrc  uint32
+		index uint64
+		want  string
+	}{
+		{0x5501a0b2, 0xf17b, "51753c6580c2726f20718414"},
+		{0x5501a0b2, 0x1f17b, "51753c6580c2726f20708414"},
+		{0, 0, gcmSalt},
+	}
+	for _, tt := range tests {
+		got := gcmNonce(unhex(t, gcmSalt), tt.ssrc, tt.index)
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("ssrc %08X index %X: got %x, want %x", tt.ssrc, tt.index, got, want)
+		}
+	}
+}
+
+func gcmSessionKeys(t *testing.T) *sessionKeys {
+	block, err := aes.NewCipher(unhex(t, gcmKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCMWithTagSize(block, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sessionKeys{suite: findSuite("AEAD_AES_128_GCM"), rtpAead: aead, rtpSalt: unhex(t, gcmSalt)}
+}
+
+func TestDecryptRTPGcm(t *testing.T) {
+	keys := gcmSessionKeys(t)
+	packet := unhex(t, gcmHeader+gcmSealed)
+	plain, err := keys.decryptRTP(packet, 12, 0, 0x5501a0b2, 0xf17b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, gcmHeader+gcmPlain); !bytes.Equal(plain, want) {
+		t.Errorf("got %x, want %x", plain, want)
+	}
+
+	packet[len(packet)-1] ^= 1
+	if _, err := keys.decryptRTP(packet, 12, 0, 0x5501a0b2, 0xf17b); err != errAuthentication {
+		t.Errorf("modified tag: got %v, want %v", err, errAuthentication)
+	}
+}
+
+// reference packet of libsrtp test driver, master key and salt of RFC 3711 appendix B.3
+const (
+	cmPlain  = "800f1234decafbadcafebabeabababababababababababababababab"
+	cmSealed = "800f1234decafbadcafebabe4e55dc4ce79978d88ca4d215949d2402b78d6acc99ea179b8dbb"
+)
+
+func cmMasterKey(t *testing.T) *MasterKey {
+	key, err := parseKeyParams(findSuite("AES_CM_128_HMAC_SHA1_80"), "0x"+b3MasterKey+b3MasterSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestDecryptRTPCounterMode(t *testing.T) {
+	key := cmMasterKey(t)
+	tests := []struct {
+		name   string
+		modify func(p []byte)
+		err    error
+	}{
+		{"valid", func(p []byte) {}, nil},
+		{"modified tag", func(p []byte) { p[len(p)-1] ^= 1 }, errAuthentication},
+		{"modified header", func(p []byte) { p[1] ^= 1 }, errAuthentication},
+		{"modified payload", func(p []byte) { p[12] ^= 1 }, errAuthentication},
+	}
+	for _, tt := range tests {
+		packet := unhex(t, cmSealed)
+		tt.modify(packet)
+		plain, err := key.keys.decryptRTP(packet, 12, 0, 0xcafebabe, 0x1234)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if want := unhex(t, cmPlain); err == nil && !bytes.Equal(plain, want) {
+			t.Errorf("%s: got %x, want %x", tt.name, plain, want)
+		}
+	}
+}
+
+func TestHmacTag(t *testing.T) {
+	key := cmMasterKey(t)
+	packet := unhex(t, cmSealed)
+	authenticated := packet[:len(packet)-10]
+	if got, want := hmacTag(key.keys.rtpAuth, 10, authenticated, []byte{0, 0, 0, 0}), packet[len(packet)-10:]; !bytes.Equal(got, want) {
+		t.Errorf("roc 0: got %x, want %x", got, want)
+	}
+	if got := hmacTag(key.keys.rtpAuth, 10, authenticated, []byte{0, 0, 0, 1}); bytes.Equal(got, packet[len(packet)-10:]) {
+		t.Errorf("roc 1: tag %x should differ", got)
+	}
+}
+
+func TestEstimateIndex(t *testing.T) {
+	tests := []struct {
+		roc        uint32
+		highestSeq uint16
+		seq        uint16
+		want       uint32
+	}{
+		{0, 100, 101, 0},
+		{0, 100, 50, 0},
+		{0, 10, 65500, 0}, // late packet of the previous roll-over, there is none
+		{1, 10, 65500, 0},
+		{1, 65500, 10, 2},
+		{1, 65500, 65400, 1},
+		{1, 40000, 7231, 2},
+		{1, 40000, 7232, 1},
+	}
+	for _, tt := range tests {
+		c := &Context{roc: tt.roc, highestSeq: tt.highestSeq}
+		if got := c.estimateIndex(tt.seq); got != tt.want {
+			t.Errorf("roc %d highest %d seq %d: got %d, want %d", tt.roc, tt.highestSeq, tt.seq, got, tt.want)
+		}
+	}
+}
+
+// DecryptRTP guesses initial roll-over counter of a capture starting in the middle of a stream
+// and follows the counter when sequence number wraps
+func TestDecryptRTPRollOver(t *testing.T) {
+	key := cmMasterKey(t)
+	seal := func(seq uint16, roc uint32) []byte {
+		packet := unhex(t, cmPlain)
+		packet[2], packet[3] = byte(seq>>8), byte(seq)
+		index := uint64(roc)<<16 | uint64(seq)
+		cipher.NewCTR(key.keys.rtpEnc, counterIV(key.keys.rtpSalt, 0xcafebabe, index)).XORKeyStream(packet[12:], packet[12:])
+		rocBytes := []byte{byte(roc >> 24), byte(roc >> 16), byte(roc >> 8), byte(roc)}
+		return append(packet, hmacTag(key.keys.rtpAuth, 10, packet, rocBytes)...)
+	}
+
+	c := &Context{Ssrc: 0xcafebabe, candidates: []*MasterKey{key}}
+	packets := []struct {
+		seq uint16
+		roc uint32
+	}{{65534, 3}, {65535, 3}, {1, 4}, {0, 4}, {2, 4}}
+	for _, p := range packets {
+		plain, err := c.DecryptRTP(seal(p.seq, p.roc))
+		if err != nil {
+			t.Fatalf("seq %d roc %d: %s", p.seq, p.roc, err)
+		}
+		if !bytes.Equal(plain[12:], unhex(t, cmPlain)[12:]) {
+			t.Errorf("seq %d roc %d: got payload %x", p.seq, p.roc, plain[12:])
+		}
+	}
+	if c.roc != 4 || c.highestSeq != 2 || c.Authenticated != uint(len(packets)) {
+		t.Errorf("got roc %d, highest seq %d, authenticated %d", c.roc, c.highestSeq, c.Authenticated)
+	}
+}
+
+// a key negotiated in SDP after the first packets of a stream replaces keys that never authenticated it,
+// until then the search for key and roll-over counter gives up after maxRocSearches packets
+func TestLateCryptoAttribute(t *testing.T) {
+	defer func() {
+		keyList = make(map[string][]*MasterKey)
+		ResetContexts()
+	}()
+	const ip, port = "192.0.2.1", 5004
+	wrong, err := parseKeyParams(findSuite("AES_CM_128_HMAC_SHA1_80"), "0x"+strings.Repeat("00", 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addKey(addrSelector(ip, port), wrong)
+
+	c := Lookup(0xcafebabe, ip, port, "192.0.2.2", 6000)
+	if c == nil {
+		t.Fatal("no context for stream with a key")
+	}
+	for i := 0; i < maxRocSearches+2; i++ {
+		if _, err := c.DecryptRTP(unhex(t, cmSealed)); err != errAuthentication {
+			t.Fatalf("packet %d: got error %v, want %v", i, err, errAuthentication)
+		}
+	}
+	if c.searches != maxRocSearches || c.AuthFailures != maxRocSearches+2 {
+		t.Errorf("got %d searches, %d failures, want %d and %d", c.searches, c.AuthFailures, maxRocSearches, maxRocSearches+2)
+	}
+
+	keySalt := base64.StdEncoding.EncodeToString(unhex(t, b3MasterKey+b3MasterSalt))
+	if err := AddCryptoAttribute(ip, port, "1 AES_CM_128_HMAC_SHA1_80 inline:"+keySalt); err != nil {
+		t.Fatal(err)
+	}
+	if got := Lookup(0xcafebabe, ip, port, "192.0.2.2", 6000); got != c {
+		t.Fatalf("got context %p, want the cached %p", got, c)
+	}
+	plain, err := c.DecryptRTP(unhex(t, cmSealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, cmPlain); !bytes.Equal(plain, want) {
+		t.Errorf("got %x, want %x", plain, want)
+	}
+}
@@ -30,3 +30,23 @@ func TimeMsToStr(t time.Time) string {
 		t.UTC().Second(),
 		t.UTC().Nanosecond()/1000)
 }
+
+// layouts accepted for times given on the command line, the first one is how times are shown
+var timeLayouts = []string{
+	"02-01-2006 15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+//StrToTime parses time as shown by TimeToStr or in ISO 8601 format, UTC unless a zone is given
+func StrToTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}